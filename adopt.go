@@ -0,0 +1,117 @@
+package cyclist
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// adoptInstances brings the in service instances of the auto scaling group
+// that cyclist has no state for under management, as when first pointed at
+// the group or after its data was lost, setting them up with a temporary
+// token so that they may recover without a restart
+func adoptInstances(db repo, log logrus.FieldLogger, asSvc autoscalingiface.AutoScalingAPI,
+	tokGen tokenGenerator, asgName string) ([]string, error) {
+
+	if strings.TrimSpace(asgName) == "" {
+		return nil, errEmptyASGName
+	}
+
+	asg, err := describeAutoScalingGroup(asSvc, asgName)
+	if err != nil {
+		return nil, err
+	}
+
+	adopted := []string{}
+	for _, inst := range asg.Instances {
+		if aws.StringValue(inst.LifecycleState) != autoscaling.LifecycleStateInService {
+			continue
+		}
+
+		instanceID := aws.StringValue(inst.InstanceId)
+		state, err := db.fetchInstanceState(instanceID)
+		if err != nil && err != errNoInstanceState {
+			return adopted, err
+		}
+
+		if state != "" {
+			continue
+		}
+
+		log.WithFields(logrus.Fields{
+			"asg":      asgName,
+			"instance": instanceID,
+		}).Info("adopting instance")
+
+		err = db.setInstanceState(instanceID, "up")
+		if err != nil {
+			return adopted, err
+		}
+
+		err = db.storeTempInstanceToken(instanceID, tokGen.GenerateToken())
+		if err != nil {
+			return adopted, err
+		}
+
+		err = db.storeInstanceEvent(instanceID, "adopted")
+		if err != nil {
+			return adopted, err
+		}
+
+		adopted = append(adopted, instanceID)
+	}
+
+	return adopted, nil
+}
+
+func newAdoptionsHandlerFunc(db repo, log logrus.FieldLogger,
+	asSvc autoscalingiface.AutoScalingAPI, tokGen tokenGenerator) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		log = log.WithFields(logrus.Fields{
+			"path":   r.URL.Path,
+			"method": r.Method,
+		})
+
+		body := &jsonAdoptionRequest{}
+		err := json.NewDecoder(r.Body).Decode(body)
+		if err != nil {
+			log.WithField("err", err).Error("invalid json received")
+			jsonRespond(w, http.StatusBadRequest, &jsonErr{
+				Err: errors.Wrap(err, "invalid json received"),
+			})
+			return
+		}
+
+		adopted, err := adoptInstances(db, log, asSvc, tokGen, body.ASGName)
+		if err != nil {
+			log.WithField("err", err).Error("adopting instances failed")
+			jsonRespond(w, http.StatusBadRequest, &jsonErr{
+				Err: errors.Wrap(err, "adopting instances failed"),
+			})
+			return
+		}
+
+		jsonRespond(w, http.StatusOK, &jsonAdoptions{
+			Instances: adopted,
+			ASGName:   body.ASGName,
+			Total:     len(adopted),
+		})
+	}
+}
+
+type jsonAdoptionRequest struct {
+	ASGName string `json:"asg"`
+}
+
+type jsonAdoptions struct {
+	Instances []string `json:"instances"`
+	ASGName   string   `json:"@asg"`
+	Total     int      `json:"@total"`
+}
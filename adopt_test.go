@@ -0,0 +1,74 @@
+package cyclist
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdoptInstances(t *testing.T) {
+	db := newTestRepo()
+	_ = db.setInstanceState("i-bababab", "down")
+
+	tca := &testCycleASG{
+		desired: 3,
+		instances: map[string]string{
+			"i-fafafaf": autoscaling.LifecycleStateInService,
+			"i-bababab": autoscaling.LifecycleStateInService,
+			"i-cacacac": autoscaling.LifecycleStatePendingWait,
+		},
+	}
+
+	adopted, err := adoptInstances(db, shushLog, newTestAutoScalingService(tca.handle),
+		newTestTokenGenerator(), "cat-theatre-napkin-hose")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"i-fafafaf"}, adopted)
+
+	assert.Equal(t, "up", db.s["i-fafafaf"])
+	assert.NotNil(t, db.e["i-fafafaf"]["adopted"])
+	tok, err := db.fetchTempInstanceToken("i-fafafaf")
+	assert.Nil(t, err)
+	assert.NotEqual(t, "", tok)
+
+	assert.Equal(t, "down", db.s["i-bababab"])
+	assert.Nil(t, db.e["i-bababab"]["adopted"])
+	assert.Equal(t, "", db.s["i-cacacac"])
+}
+
+func TestAdoptInstances_WithEmptyASGName(t *testing.T) {
+	_, err := adoptInstances(newTestRepo(), shushLog, newTestAutoScalingService(nil),
+		newTestTokenGenerator(), " ")
+	assert.Equal(t, errEmptyASGName, err)
+}
+
+type testFailingStateRepo struct {
+	*testRepo
+}
+
+func (tfsr *testFailingStateRepo) fetchInstanceState(instanceID string) (string, error) {
+	return "", errors.New("i/o timeout")
+}
+
+func TestAdoptInstances_WithFailingRepo(t *testing.T) {
+	db := newTestRepo()
+	_ = db.setInstanceState("i-fafafaf", "down")
+	_ = db.storeTempInstanceToken("i-fafafaf", "TEMPYTEMPTEMP")
+
+	tca := &testCycleASG{
+		desired: 1,
+		instances: map[string]string{
+			"i-fafafaf": autoscaling.LifecycleStateInService,
+		},
+	}
+
+	adopted, err := adoptInstances(&testFailingStateRepo{testRepo: db}, shushLog,
+		newTestAutoScalingService(tca.handle), newTestTokenGenerator(), "cat-theatre-napkin-hose")
+	assert.NotNil(t, err)
+	assert.Len(t, adopted, 0)
+
+	assert.Equal(t, "down", db.s["i-fafafaf"])
+	assert.Equal(t, "TEMPYTEMPTEMP", db.tt["i-fafafaf"])
+	assert.Nil(t, db.e["i-fafafaf"]["adopted"])
+}
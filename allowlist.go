@@ -0,0 +1,99 @@
+package cyclist
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// lifecycleAllowlist restricts which topics, accounts and auto scaling groups
+// cyclist will act on.  An empty list allows everything, as does a nil
+// *lifecycleAllowlist.
+type lifecycleAllowlist struct {
+	topicARNs       []string
+	accountIDs      []string
+	asgNamePatterns []string
+}
+
+func newLifecycleAllowlist(topicARNs, accountIDs, asgNamePatterns []string) (*lifecycleAllowlist, error) {
+	al := &lifecycleAllowlist{
+		topicARNs:       cleanAllowlistEntries(topicARNs),
+		accountIDs:      cleanAllowlistEntries(accountIDs),
+		asgNamePatterns: cleanAllowlistEntries(asgNamePatterns),
+	}
+
+	for _, pattern := range al.asgNamePatterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid asg name pattern %q: %v", pattern, err)
+		}
+	}
+
+	return al, nil
+}
+
+func (al *lifecycleAllowlist) allowTopic(topicARN string) error {
+	if al == nil || len(al.topicARNs) == 0 {
+		return nil
+	}
+
+	for _, allowed := range al.topicARNs {
+		if topicARN == allowed {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("topic %q is not allowed", topicARN)
+}
+
+func (al *lifecycleAllowlist) allowLifecycleAction(la *lifecycleAction) error {
+	if al == nil {
+		return nil
+	}
+
+	if len(al.accountIDs) > 0 {
+		allowed := false
+		for _, accountID := range al.accountIDs {
+			if la.AccountID == accountID {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			return fmt.Errorf("account %q is not allowed", la.AccountID)
+		}
+	}
+
+	if !al.allowASGName(la.AutoScalingGroupName) {
+		return fmt.Errorf("auto scaling group %q is not allowed", la.AutoScalingGroupName)
+	}
+
+	return nil
+}
+
+func (al *lifecycleAllowlist) allowASGName(asgName string) bool {
+	if al == nil || len(al.asgNamePatterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range al.asgNamePatterns {
+		if ok, _ := path.Match(pattern, asgName); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func cleanAllowlistEntries(entries []string) []string {
+	cleaned := []string{}
+	for _, entry := range entries {
+		for _, part := range strings.Split(entry, ",") {
+			part = strings.TrimSpace(part)
+			if part != "" {
+				cleaned = append(cleaned, part)
+			}
+		}
+	}
+	return cleaned
+}
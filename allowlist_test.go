@@ -0,0 +1,63 @@
+package cyclist
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewLifecycleAllowlist(t *testing.T) {
+	al, err := newLifecycleAllowlist(
+		[]string{" arn:aws:sns:nz-isengard-1:999999999999:toaster-pastries , "},
+		[]string{"999999999999,888888888888"},
+		[]string{"workers-*"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"arn:aws:sns:nz-isengard-1:999999999999:toaster-pastries"}, al.topicARNs)
+	assert.Equal(t, []string{"999999999999", "888888888888"}, al.accountIDs)
+	assert.Equal(t, []string{"workers-*"}, al.asgNamePatterns)
+
+	_, err = newLifecycleAllowlist(nil, nil, []string{"workers-["})
+	assert.NotNil(t, err)
+}
+
+func TestLifecycleAllowlist_allowTopic(t *testing.T) {
+	var al *lifecycleAllowlist
+	assert.Nil(t, al.allowTopic("arn:aws:sns:nz-isengard-1:999999999999:anything"))
+
+	al, _ = newLifecycleAllowlist(nil, nil, nil)
+	assert.Nil(t, al.allowTopic("arn:aws:sns:nz-isengard-1:999999999999:anything"))
+
+	al, _ = newLifecycleAllowlist([]string{"arn:aws:sns:nz-isengard-1:999999999999:toaster-pastries"}, nil, nil)
+	assert.Nil(t, al.allowTopic("arn:aws:sns:nz-isengard-1:999999999999:toaster-pastries"))
+	assert.NotNil(t, al.allowTopic("arn:aws:sns:nz-isengard-1:999999999999:anything"))
+	assert.NotNil(t, al.allowTopic(""))
+}
+
+func TestLifecycleAllowlist_allowLifecycleAction(t *testing.T) {
+	var al *lifecycleAllowlist
+	assert.Nil(t, al.allowLifecycleAction(&lifecycleAction{}))
+
+	al, _ = newLifecycleAllowlist(nil, []string{"999999999999"}, []string{"workers-*", "builders"})
+
+	for _, tc := range []struct {
+		accountID string
+		asgName   string
+		allowed   bool
+	}{
+		{accountID: "999999999999", asgName: "workers-production", allowed: true},
+		{accountID: "999999999999", asgName: "builders", allowed: true},
+		{accountID: "999999999999", asgName: "builders-2", allowed: false},
+		{accountID: "888888888888", asgName: "workers-production", allowed: false},
+		{accountID: "", asgName: "workers-production", allowed: false},
+	} {
+		err := al.allowLifecycleAction(&lifecycleAction{
+			AccountID:            tc.accountID,
+			AutoScalingGroupName: tc.asgName,
+		})
+		if tc.allowed {
+			assert.Nil(t, err, "account=%q asg=%q", tc.accountID, tc.asgName)
+		} else {
+			assert.NotNil(t, err, "account=%q asg=%q", tc.accountID, tc.asgName)
+		}
+	}
+}
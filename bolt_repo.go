@@ -0,0 +1,737 @@
+package cyclist
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltRepoSweepInterval = time.Minute
+	boltRepoOpenTimeout   = 5 * time.Second
+
+	boltBucketStates           = []byte("states")
+	boltBucketProtections      = []byte("protections")
+	boltBucketEvents           = []byte("events")
+	boltBucketLifecycleActions = []byte("lifecycle_actions")
+	boltBucketLastTransitions  = []byte("last_transitions")
+	boltBucketTokens           = []byte("tokens")
+	boltBucketTempTokens       = []byte("temp_tokens")
+	boltBucketSubscriptions    = []byte("subscriptions")
+	boltBucketMessages         = []byte("messages")
+	boltBucketCycleRuns        = []byte("cycle_runs")
+	boltBucketCycleLocks       = []byte("cycle_locks")
+
+	boltBuckets = [][]byte{
+		boltBucketStates,
+		boltBucketProtections,
+		boltBucketEvents,
+		boltBucketLifecycleActions,
+		boltBucketLastTransitions,
+		boltBucketTokens,
+		boltBucketTempTokens,
+		boltBucketSubscriptions,
+		boltBucketMessages,
+		boltBucketCycleRuns,
+		boltBucketCycleLocks,
+	}
+
+	boltExpiringBuckets = [][]byte{
+		boltBucketEvents,
+		boltBucketLifecycleActions,
+		boltBucketLastTransitions,
+		boltBucketTokens,
+		boltBucketTempTokens,
+		boltBucketMessages,
+		boltBucketCycleLocks,
+	}
+)
+
+// boltRepo is a repo kept in a bolt database file for single node use without
+// redis. Entries expire after the same TTLs as their redis counterparts, where
+// a TTL of 0 never expires, and are swept out on writes at most once per sweep
+// interval.
+type boltRepo struct {
+	db  *bolt.DB
+	now func() time.Time
+
+	// lastSweep is only accessed within write transactions, which bolt
+	// serializes
+	lastSweep time.Time
+
+	instEventTTL           time.Duration
+	instLifecycleActionTTL time.Duration
+	instTempTokTTL         time.Duration
+	instTokTTL             time.Duration
+	messageTTL             time.Duration
+}
+
+// boltEntry wraps every value stored in a bolt bucket, where a zero ExpiresAt
+// never expires
+type boltEntry struct {
+	Value     json.RawMessage `json:"value"`
+	ExpiresAt time.Time       `json:"expires_at"`
+}
+
+// newBoltRepo opens the bolt database at path, creating it if needed. Bolt
+// holds a file lock on the database while it is open, so only one process may
+// use it at a time, and others fail to open it after boltRepoOpenTimeout.
+func newBoltRepo(path string, instEventTTL, instLifecycleActionTTL, instTempTokTTL, instTokTTL, messageTTL time.Duration) (*boltRepo, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: boltRepoOpenTimeout})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("failed to open bolt database '%s': its file lock is still held by another process after %v, as only one cyclist process may use a bolt database at a time", path, boltRepoOpenTimeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bolt database '%s': %v", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range boltBuckets {
+			_, err := tx.CreateBucketIfNotExists(bucket)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return &boltRepo{
+		db:  db,
+		now: time.Now,
+
+		instEventTTL:           instEventTTL,
+		instLifecycleActionTTL: instLifecycleActionTTL,
+		instTempTokTTL:         instTempTokTTL,
+		instTokTTL:             instTokTTL,
+		messageTTL:             messageTTL,
+	}, nil
+}
+
+func (br *boltRepo) close() error {
+	return br.db.Close()
+}
+
+func (br *boltRepo) expiresAt(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return br.now().Add(ttl)
+}
+
+func (br *boltRepo) expired(expiresAt time.Time) bool {
+	return !expiresAt.IsZero() && !br.now().Before(expiresAt)
+}
+
+// update runs f in a write transaction, sweeping out expired entries first
+func (br *boltRepo) update(f func(*bolt.Tx) error) error {
+	return br.db.Update(func(tx *bolt.Tx) error {
+		err := br.sweep(tx)
+		if err != nil {
+			return err
+		}
+		return f(tx)
+	})
+}
+
+func (br *boltRepo) sweep(tx *bolt.Tx) error {
+	if br.now().Sub(br.lastSweep) < boltRepoSweepInterval {
+		return nil
+	}
+	br.lastSweep = br.now()
+
+	for _, bucket := range boltExpiringBuckets {
+		b := tx.Bucket(bucket)
+		expiredKeys := [][]byte{}
+
+		err := b.ForEach(func(key, entryBytes []byte) error {
+			entry := &boltEntry{}
+			err := json.Unmarshal(entryBytes, entry)
+			if err != nil || br.expired(entry.ExpiresAt) {
+				expiredKeys = append(expiredKeys, append([]byte{}, key...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, key := range expiredKeys {
+			err = b.Delete(key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (br *boltRepo) put(tx *bolt.Tx, bucket []byte, key string, v interface{}, expiresAt time.Time) error {
+	valueBytes, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	entryBytes, err := json.Marshal(&boltEntry{Value: valueBytes, ExpiresAt: expiresAt})
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(bucket).Put([]byte(key), entryBytes)
+}
+
+// get decodes the unexpired value at key into v, returning its entry or nil if
+// there is none
+func (br *boltRepo) get(tx *bolt.Tx, bucket []byte, key string, v interface{}) (*boltEntry, error) {
+	entryBytes := tx.Bucket(bucket).Get([]byte(key))
+	if entryBytes == nil {
+		return nil, nil
+	}
+
+	return br.decode(entryBytes, v)
+}
+
+func (br *boltRepo) decode(entryBytes []byte, v interface{}) (*boltEntry, error) {
+	entry := &boltEntry{}
+	err := json.Unmarshal(entryBytes, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	if br.expired(entry.ExpiresAt) {
+		return nil, nil
+	}
+
+	return entry, json.Unmarshal(entry.Value, v)
+}
+
+// each calls f with the key and raw entry of every unexpired entry whose key
+// starts with prefix, in key order
+func (br *boltRepo) each(tx *bolt.Tx, bucket []byte, prefix string, f func(string, []byte) error) error {
+	c := tx.Bucket(bucket).Cursor()
+	prefixBytes := []byte(prefix)
+
+	for key, entryBytes := c.Seek(prefixBytes); key != nil && bytes.HasPrefix(key, prefixBytes); key, entryBytes = c.Next() {
+		entry := &boltEntry{}
+		err := json.Unmarshal(entryBytes, entry)
+		if err != nil {
+			return err
+		}
+
+		if br.expired(entry.ExpiresAt) {
+			continue
+		}
+
+		err = f(string(key), entryBytes)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (br *boltRepo) setInstanceState(instanceID, state string) error {
+	if strings.TrimSpace(instanceID) == "" {
+		return errEmptyInstanceID
+	}
+
+	return br.update(func(tx *bolt.Tx) error {
+		return br.put(tx, boltBucketStates, instanceID, state, time.Time{})
+	})
+}
+
+func (br *boltRepo) fetchInstanceState(instanceID string) (string, error) {
+	if strings.TrimSpace(instanceID) == "" {
+		return "", errEmptyInstanceID
+	}
+
+	state := ""
+	err := br.db.View(func(tx *bolt.Tx) error {
+		entry, err := br.get(tx, boltBucketStates, instanceID, &state)
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			return errNoInstanceState
+		}
+		return nil
+	})
+
+	return state, err
+}
+
+func (br *boltRepo) wipeInstanceState(instanceID string) error {
+	if strings.TrimSpace(instanceID) == "" {
+		return errEmptyInstanceID
+	}
+
+	return br.update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(boltBucketStates).Delete([]byte(instanceID))
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltBucketProtections).Delete([]byte(instanceID))
+	})
+}
+
+func (br *boltRepo) storeInstanceProtection(instanceID string, protected bool) error {
+	if strings.TrimSpace(instanceID) == "" {
+		return errEmptyInstanceID
+	}
+
+	return br.update(func(tx *bolt.Tx) error {
+		return br.put(tx, boltBucketProtections, instanceID, protected, time.Time{})
+	})
+}
+
+func (br *boltRepo) fetchInstanceProtection(instanceID string) (bool, error) {
+	if strings.TrimSpace(instanceID) == "" {
+		return false, errEmptyInstanceID
+	}
+
+	protected := false
+	err := br.db.View(func(tx *bolt.Tx) error {
+		_, err := br.get(tx, boltBucketProtections, instanceID, &protected)
+		return err
+	})
+
+	return protected, err
+}
+
+func (br *boltRepo) storeInstanceEvent(instanceID, event string) error {
+	if strings.TrimSpace(instanceID) == "" {
+		return errEmptyInstanceID
+	}
+
+	if strings.TrimSpace(event) == "" {
+		return errEmptyEvent
+	}
+
+	return br.update(func(tx *bolt.Tx) error {
+		events := map[string]time.Time{}
+		entry, err := br.get(tx, boltBucketEvents, instanceID, &events)
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			events = map[string]time.Time{}
+		}
+
+		events[event] = br.now().UTC()
+		return br.put(tx, boltBucketEvents, instanceID, events, br.expiresAt(br.instEventTTL))
+	})
+}
+
+func (br *boltRepo) fetchInstanceEvent(instanceID, event string) (*lifecycleEvent, error) {
+	events, err := br.fetchInstanceEvents(instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, le := range events {
+		if le.Event == event {
+			return le, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no %s event for instance %s", event, instanceID)
+}
+
+func (br *boltRepo) fetchInstanceEvents(instanceID string) ([]*lifecycleEvent, error) {
+	if strings.TrimSpace(instanceID) == "" {
+		return nil, errEmptyInstanceID
+	}
+
+	events := map[string]time.Time{}
+	err := br.db.View(func(tx *bolt.Tx) error {
+		_, err := br.get(tx, boltBucketEvents, instanceID, &events)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return boltLifecycleEvents(events), nil
+}
+
+func (br *boltRepo) fetchAllInstanceEvents() (map[string][]*lifecycleEvent, error) {
+	res := map[string][]*lifecycleEvent{}
+
+	err := br.db.View(func(tx *bolt.Tx) error {
+		return br.each(tx, boltBucketEvents, "", func(instanceID string, entryBytes []byte) error {
+			events := map[string]time.Time{}
+			_, err := br.decode(entryBytes, &events)
+			if err != nil {
+				return err
+			}
+
+			res[instanceID] = boltLifecycleEvents(events)
+			return nil
+		})
+	})
+
+	return res, err
+}
+
+func boltLifecycleEvents(eventsMap map[string]time.Time) []*lifecycleEvent {
+	events := []*lifecycleEvent{}
+	for event, ts := range eventsMap {
+		events = append(events, &lifecycleEvent{Event: event, Timestamp: ts})
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Timestamp.Equal(events[j].Timestamp) {
+			return events[i].Event < events[j].Event
+		}
+		return events[i].Timestamp.Before(events[j].Timestamp)
+	})
+
+	return events
+}
+
+func (br *boltRepo) storeInstanceLifecycleAction(la *lifecycleAction) error {
+	if la.LifecycleTransition == "" || la.EC2InstanceID == "" ||
+		la.AutoScalingGroupName == "" || la.LifecycleHookName == "" {
+		return fmt.Errorf("missing required fields in lifecycle action: %+v", la)
+	}
+
+	stored := &lifecycleAction{
+		LifecycleTransition:  la.LifecycleTransition,
+		EC2InstanceID:        la.EC2InstanceID,
+		LifecycleActionToken: la.LifecycleActionToken,
+		AutoScalingGroupName: la.AutoScalingGroupName,
+		LifecycleHookName:    la.LifecycleHookName,
+		Origin:               la.Origin,
+		Destination:          la.Destination,
+	}
+
+	return br.update(func(tx *bolt.Tx) error {
+		return br.put(tx, boltBucketLifecycleActions,
+			lifecycleActionKey(la.Transition(), la.EC2InstanceID, la.LifecycleHookName),
+			stored, br.expiresAt(br.instLifecycleActionTTL))
+	})
+}
+
+func (br *boltRepo) fetchInstanceLifecycleActions(transition, instanceID string) ([]*lifecycleAction, error) {
+	if strings.TrimSpace(instanceID) == "" {
+		return nil, errEmptyInstanceID
+	}
+
+	return br.fetchLifecycleActions(lifecycleActionKey(transition, instanceID, ""), func(*lifecycleAction) bool {
+		return true
+	})
+}
+
+func (br *boltRepo) completeInstanceLifecycleAction(transition, instanceID, hookName string) error {
+	return br.setInstanceLifecycleActionBits(transition, instanceID, hookName, false)
+}
+
+func (br *boltRepo) expireInstanceLifecycleAction(transition, instanceID, hookName string) error {
+	return br.setInstanceLifecycleActionBits(transition, instanceID, hookName, true)
+}
+
+func (br *boltRepo) setInstanceLifecycleActionBits(transition, instanceID, hookName string, expired bool) error {
+	if strings.TrimSpace(instanceID) == "" {
+		return errEmptyInstanceID
+	}
+
+	key := lifecycleActionKey(transition, instanceID, hookName)
+
+	return br.update(func(tx *bolt.Tx) error {
+		la := &lifecycleAction{}
+		entry, err := br.get(tx, boltBucketLifecycleActions, key, la)
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			return fmt.Errorf("no lifecycle action found for transition '%s', instance ID '%s', hook '%s'",
+				transition, instanceID, hookName)
+		}
+
+		la.Completed = true
+		if expired {
+			la.Expired = true
+		}
+
+		return br.put(tx, boltBucketLifecycleActions, key, la, entry.ExpiresAt)
+	})
+}
+
+func (br *boltRepo) fetchPendingLifecycleActions(transition string) ([]*lifecycleAction, error) {
+	return br.fetchLifecycleActions(fmt.Sprintf("%s:", transition), func(la *lifecycleAction) bool {
+		return !la.Completed
+	})
+}
+
+func (br *boltRepo) fetchLifecycleActions(prefix string, f func(*lifecycleAction) bool) ([]*lifecycleAction, error) {
+	res := []*lifecycleAction{}
+
+	err := br.db.View(func(tx *bolt.Tx) error {
+		return br.each(tx, boltBucketLifecycleActions, prefix, func(_ string, entryBytes []byte) error {
+			la := &lifecycleAction{}
+			_, err := br.decode(entryBytes, la)
+			if err != nil {
+				return err
+			}
+
+			if f(la) {
+				res = append(res, la)
+			}
+			return nil
+		})
+	})
+
+	return res, err
+}
+
+func (br *boltRepo) storeInstanceLastTransition(instanceID, transition string, ts time.Time) error {
+	if strings.TrimSpace(instanceID) == "" {
+		return errEmptyInstanceID
+	}
+
+	return br.update(func(tx *bolt.Tx) error {
+		return br.put(tx, boltBucketLastTransitions, instanceID,
+			&instanceTransition{Transition: transition, Time: ts.UTC()},
+			br.expiresAt(br.instLifecycleActionTTL))
+	})
+}
+
+func (br *boltRepo) fetchInstanceLastTransition(instanceID string) (*instanceTransition, error) {
+	if strings.TrimSpace(instanceID) == "" {
+		return nil, errEmptyInstanceID
+	}
+
+	var it *instanceTransition
+	err := br.db.View(func(tx *bolt.Tx) error {
+		found := &instanceTransition{}
+		entry, err := br.get(tx, boltBucketLastTransitions, instanceID, found)
+		if entry != nil {
+			it = found
+		}
+		return err
+	})
+
+	return it, err
+}
+
+func (br *boltRepo) storeInstanceToken(instanceID, token string) error {
+	return br.storeInstanceTokenTTL(boltBucketTokens, instanceID, token, br.instTokTTL)
+}
+
+func (br *boltRepo) storeTempInstanceToken(instanceID, token string) error {
+	return br.storeInstanceTokenTTL(boltBucketTempTokens, instanceID, token, br.instTempTokTTL)
+}
+
+func (br *boltRepo) storeInstanceTokenTTL(bucket []byte, instanceID, token string, ttl time.Duration) error {
+	if strings.TrimSpace(instanceID) == "" {
+		return errEmptyInstanceID
+	}
+
+	if strings.TrimSpace(token) == "" {
+		return errEmptyToken
+	}
+
+	return br.update(func(tx *bolt.Tx) error {
+		return br.put(tx, bucket, instanceID, token, br.expiresAt(ttl))
+	})
+}
+
+func (br *boltRepo) fetchInstanceToken(instanceID string) (string, error) {
+	return br.fetchInstanceTokenTTL(boltBucketTokens, instanceID, br.instTokTTL)
+}
+
+func (br *boltRepo) fetchTempInstanceToken(instanceID string) (string, error) {
+	return br.fetchInstanceTokenTTL(boltBucketTempTokens, instanceID, 0)
+}
+
+// fetchInstanceTokenTTL returns the token, extending its expiry by the TTL if
+// greater than 0
+func (br *boltRepo) fetchInstanceTokenTTL(bucket []byte, instanceID string, ttl time.Duration) (string, error) {
+	if strings.TrimSpace(instanceID) == "" {
+		return "", errEmptyInstanceID
+	}
+
+	token := ""
+	fetch := func(tx *bolt.Tx) error {
+		entry, err := br.get(tx, bucket, instanceID, &token)
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			return fmt.Errorf("no token for instance '%s'", instanceID)
+		}
+		if ttl > 0 {
+			return br.put(tx, bucket, instanceID, token, br.expiresAt(ttl))
+		}
+		return nil
+	}
+
+	if ttl > 0 {
+		return token, br.update(fetch)
+	}
+	return token, br.db.View(fetch)
+}
+
+func (br *boltRepo) storeSNSSubscriptionState(topicARN, state string) error {
+	if strings.TrimSpace(topicARN) == "" {
+		return errEmptyTopicARN
+	}
+
+	return br.update(func(tx *bolt.Tx) error {
+		return br.put(tx, boltBucketSubscriptions, topicARN, &snsSubscription{
+			TopicARN:  topicARN,
+			State:     state,
+			UpdatedAt: br.now().UTC().Format(time.RFC3339Nano),
+		}, time.Time{})
+	})
+}
+
+func (br *boltRepo) fetchSNSSubscriptions() ([]*snsSubscription, error) {
+	subs := []*snsSubscription{}
+
+	err := br.db.View(func(tx *bolt.Tx) error {
+		return br.each(tx, boltBucketSubscriptions, "", func(_ string, entryBytes []byte) error {
+			sub := &snsSubscription{}
+			_, err := br.decode(entryBytes, sub)
+			if err != nil {
+				return err
+			}
+
+			subs = append(subs, sub)
+			return nil
+		})
+	})
+
+	return subs, err
+}
+
+func (br *boltRepo) markMessageHandling(messageID string) (string, error) {
+	if strings.TrimSpace(messageID) == "" {
+		return "", errEmptyMessageID
+	}
+
+	state := ""
+	err := br.update(func(tx *bolt.Tx) error {
+		entry, err := br.get(tx, boltBucketMessages, messageID, &state)
+		if err != nil || entry != nil {
+			return err
+		}
+
+		return br.put(tx, boltBucketMessages, messageID, messageStateHandling, br.expiresAt(messageHandlingTTL))
+	})
+
+	return state, err
+}
+
+func (br *boltRepo) markMessageHandled(messageID string) error {
+	if strings.TrimSpace(messageID) == "" {
+		return errEmptyMessageID
+	}
+
+	return br.update(func(tx *bolt.Tx) error {
+		return br.put(tx, boltBucketMessages, messageID, messageStateHandled, br.expiresAt(br.messageTTL))
+	})
+}
+
+func (br *boltRepo) forgetMessage(messageID string) error {
+	if strings.TrimSpace(messageID) == "" {
+		return errEmptyMessageID
+	}
+
+	return br.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucketMessages).Delete([]byte(messageID))
+	})
+}
+
+func (br *boltRepo) storeCycleRun(run *cycleRun) error {
+	if strings.TrimSpace(run.ASGName) == "" {
+		return errEmptyASGName
+	}
+
+	return br.update(func(tx *bolt.Tx) error {
+		return br.put(tx, boltBucketCycleRuns, run.ASGName, run, time.Time{})
+	})
+}
+
+func (br *boltRepo) fetchCycleRun(asgName string) (*cycleRun, error) {
+	if strings.TrimSpace(asgName) == "" {
+		return nil, errEmptyASGName
+	}
+
+	var run *cycleRun
+	err := br.db.View(func(tx *bolt.Tx) error {
+		found := &cycleRun{}
+		entry, err := br.get(tx, boltBucketCycleRuns, asgName, found)
+		if entry != nil {
+			run = found
+		}
+		return err
+	})
+
+	return run, err
+}
+
+func (br *boltRepo) fetchCycleRuns() ([]*cycleRun, error) {
+	runs := []*cycleRun{}
+
+	err := br.db.View(func(tx *bolt.Tx) error {
+		return br.each(tx, boltBucketCycleRuns, "", func(_ string, entryBytes []byte) error {
+			run := &cycleRun{}
+			_, err := br.decode(entryBytes, run)
+			if err != nil {
+				return err
+			}
+
+			runs = append(runs, run)
+			return nil
+		})
+	})
+
+	return runs, err
+}
+
+func (br *boltRepo) lockCycleRun(asgName, owner string, ttl time.Duration) (bool, error) {
+	if strings.TrimSpace(asgName) == "" {
+		return false, errEmptyASGName
+	}
+
+	locked := false
+	err := br.update(func(tx *bolt.Tx) error {
+		held := ""
+		entry, err := br.get(tx, boltBucketCycleLocks, asgName, &held)
+		if err != nil || (entry != nil && held != owner) {
+			return err
+		}
+
+		locked = true
+		return br.put(tx, boltBucketCycleLocks, asgName, owner, br.expiresAt(ttl))
+	})
+
+	return locked, err
+}
+
+func (br *boltRepo) unlockCycleRun(asgName, owner string) error {
+	if strings.TrimSpace(asgName) == "" {
+		return errEmptyASGName
+	}
+
+	return br.update(func(tx *bolt.Tx) error {
+		held := ""
+		entry, err := br.get(tx, boltBucketCycleLocks, asgName, &held)
+		if err != nil || entry == nil || held != owner {
+			return err
+		}
+
+		return tx.Bucket(boltBucketCycleLocks).Delete([]byte(asgName))
+	})
+}
@@ -0,0 +1,105 @@
+package cyclist
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+func newTestBoltRepo(t *testing.T, clock *testClock) (*boltRepo, func()) {
+	dir, err := ioutil.TempDir("", "cyclist-bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	br, err := newBoltRepo(filepath.Join(dir, "cyclist.db"),
+		time.Hour, time.Hour, time.Minute, 10*time.Minute, time.Hour)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	br.db.NoSync = true
+	br.now = clock.now
+
+	return br, func() {
+		_ = br.close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestBoltRepo(t *testing.T) {
+	runRepoBehaviourTests(t, func(clock *testClock) (repo, func()) {
+		return newTestBoltRepo(t, clock)
+	})
+}
+
+func TestBoltRepo_sweep(t *testing.T) {
+	clock := newTestClock()
+	br, cleanup := newTestBoltRepo(t, clock)
+	defer cleanup()
+
+	assert.Nil(t, br.storeInstanceEvent("i-fafafaf", "launching"))
+	assert.Nil(t, br.storeTempInstanceToken("i-fafafaf", "TEMPYTEMPTEMP"))
+	_, err := br.markMessageHandling("msg-1")
+	assert.Nil(t, err)
+
+	clock.advance(2 * time.Hour)
+	assert.Nil(t, br.storeInstanceEvent("i-bababab", "launching"))
+
+	assert.Nil(t, br.db.View(func(tx *bolt.Tx) error {
+		assert.Equal(t, 1, tx.Bucket(boltBucketEvents).Stats().KeyN)
+		assert.Equal(t, 0, tx.Bucket(boltBucketTempTokens).Stats().KeyN)
+		assert.Equal(t, 0, tx.Bucket(boltBucketMessages).Stats().KeyN)
+		return nil
+	}))
+}
+
+func TestNewBoltRepo_WithLockedDatabase(t *testing.T) {
+	br, cleanup := newTestBoltRepo(t, newTestClock())
+	defer cleanup()
+
+	defer func(timeout time.Duration) { boltRepoOpenTimeout = timeout }(boltRepoOpenTimeout)
+	boltRepoOpenTimeout = 100 * time.Millisecond
+
+	_, err := newBoltRepo(br.db.Path(), time.Hour, time.Hour, time.Minute, 10*time.Minute, time.Hour)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "file lock")
+}
+
+func TestBoltRepo_Reopen(t *testing.T) {
+	clock := newTestClock()
+	br, cleanup := newTestBoltRepo(t, clock)
+	defer cleanup()
+
+	assert.Nil(t, br.setInstanceState("i-fafafaf", "up"))
+	assert.Nil(t, br.storeInstanceEvent("i-fafafaf", "launching"))
+
+	path := br.db.Path()
+	assert.Nil(t, br.close())
+
+	reopened, err := newBoltRepo(path, time.Hour, time.Hour, time.Minute, 10*time.Minute, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened.now = clock.now
+	br.db = reopened.db
+
+	state, err := reopened.fetchInstanceState("i-fafafaf")
+	assert.Nil(t, err)
+	assert.Equal(t, "up", state)
+
+	events, err := reopened.fetchInstanceEvents("i-fafafaf")
+	assert.Nil(t, err)
+	assert.Len(t, events, 1)
+}
+
+func TestNewBoltRepo_WithBadPath(t *testing.T) {
+	_, err := newBoltRepo("/nonexistent/cyclist.db", time.Hour, time.Hour, time.Minute, time.Hour, time.Hour)
+	assert.NotNil(t, err)
+}
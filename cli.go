@@ -1,16 +1,22 @@
 package cyclist
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/sirupsen/logrus"
 
 	"gopkg.in/urfave/cli.v2"
@@ -37,10 +43,62 @@ func NewCLI() *cli.App {
 			&cli.StringFlag{
 				Name:    "redis-url",
 				Value:   "redis://localhost:6379/0",
-				Usage:   "the `REDIS_URL` used for cruddy fun",
+				Usage:   "the `REDIS_URL` used for cruddy fun, either redis:// or rediss:// for a single redis, or redis+sentinel:// or rediss+sentinel:// for sentinels such as redis+sentinel://:pass@host-a:26379,host-b:26379/primary/0",
 				Aliases: []string{"R"},
 				EnvVars: []string{"CYCLIST_REDIS_URL", "REDIS_URL"},
 			},
+			&cli.IntFlag{
+				Name:    "redis-max-idle",
+				Value:   3,
+				Usage:   "maximum number of idle redis connections kept in the pool",
+				EnvVars: []string{"CYCLIST_REDIS_MAX_IDLE", "REDIS_MAX_IDLE"},
+			},
+			&cli.IntFlag{
+				Name:    "redis-max-active",
+				Value:   0,
+				Usage:   "maximum number of redis connections open at once, waiting for one to be free when reached (0 is unlimited)",
+				EnvVars: []string{"CYCLIST_REDIS_MAX_ACTIVE", "REDIS_MAX_ACTIVE"},
+			},
+			&cli.DurationFlag{
+				Name:    "redis-idle-timeout",
+				Value:   time.Minute,
+				Usage:   "duration after which idle redis connections are closed",
+				EnvVars: []string{"CYCLIST_REDIS_IDLE_TIMEOUT", "REDIS_IDLE_TIMEOUT"},
+			},
+			&cli.DurationFlag{
+				Name:    "redis-connect-timeout",
+				Value:   5 * time.Second,
+				Usage:   "timeout for connecting to redis and sentinels (0 never times out)",
+				EnvVars: []string{"CYCLIST_REDIS_CONNECT_TIMEOUT", "REDIS_CONNECT_TIMEOUT"},
+			},
+			&cli.DurationFlag{
+				Name:    "redis-read-timeout",
+				Value:   10 * time.Second,
+				Usage:   "timeout for reading redis replies (0 never times out)",
+				EnvVars: []string{"CYCLIST_REDIS_READ_TIMEOUT", "REDIS_READ_TIMEOUT"},
+			},
+			&cli.DurationFlag{
+				Name:    "redis-write-timeout",
+				Value:   10 * time.Second,
+				Usage:   "timeout for writing redis commands (0 never times out)",
+				EnvVars: []string{"CYCLIST_REDIS_WRITE_TIMEOUT", "REDIS_WRITE_TIMEOUT"},
+			},
+			&cli.StringFlag{
+				Name:    "redis-tls-ca-file",
+				Usage:   "PEM `FILE` of the CAs trusted to verify rediss:// and rediss+sentinel:// servers, instead of the system CAs",
+				EnvVars: []string{"CYCLIST_REDIS_TLS_CA_FILE", "REDIS_TLS_CA_FILE"},
+			},
+			&cli.BoolFlag{
+				Name:    "redis-hash-tags",
+				Usage:   "put instance IDs in redis keys in hash tags so that each instance's keys share a Redis Cluster slot, which renames existing keys; as pending lifecycle actions are then scanned for on a single node, serve refuses to start unless --launch-timeout, --max-drain-time, --asg-max-drain-times and --reconcile-interval are 0",
+				EnvVars: []string{"CYCLIST_REDIS_HASH_TAGS", "REDIS_HASH_TAGS"},
+			},
+			&cli.StringFlag{
+				Name:    "storage",
+				Value:   "redis",
+				Usage:   "the `STORAGE` backend to use, one of \"redis\", \"memory\" or a bolt database URL such as \"bolt:///var/lib/cyclist.db\", which only one process may open at a time",
+				EnvVars: []string{"CYCLIST_STORAGE", "STORAGE"},
+			},
 			&cli.DurationFlag{
 				Name:    "event-ttl",
 				Value:   48 * time.Hour,
@@ -65,6 +123,12 @@ func NewCLI() *cli.App {
 				Usage:   "duration that lifecycle actions records will be kept",
 				EnvVars: []string{"CYCLIST_LIFECYCLE_ACTION_TTL", "LIFECYCLE_ACTION_TTL"},
 			},
+			&cli.DurationFlag{
+				Name:    "message-ttl",
+				Value:   24 * time.Hour,
+				Usage:   "duration that handled SNS and SQS message IDs will be kept for deduplication",
+				EnvVars: []string{"CYCLIST_MESSAGE_TTL", "MESSAGE_TTL"},
+			},
 			&cli.BoolFlag{
 				Name:    "debug",
 				Value:   false,
@@ -76,7 +140,7 @@ func NewCLI() *cli.App {
 		Commands: []*cli.Command{
 			{
 				Name: "serve",
-				Flags: []cli.Flag{
+				Flags: append([]cli.Flag{
 					&cli.StringFlag{
 						Name:    "port",
 						Value:   ":9753",
@@ -90,7 +154,80 @@ func NewCLI() *cli.App {
 						Aliases: []string{"T"},
 						EnvVars: []string{"CYCLIST_AUTH_TOKENS", "AUTH_TOKENS"},
 					},
-				},
+					&cli.IntFlag{
+						Name:    "sns-min-signature-version",
+						Value:   1,
+						Usage:   "the minimum SNS `SIGNATURE_VERSION` accepted, where 2 rejects SHA1 signatures",
+						EnvVars: []string{"CYCLIST_SNS_MIN_SIGNATURE_VERSION", "SNS_MIN_SIGNATURE_VERSION"},
+					},
+					&cli.DurationFlag{
+						Name:    "lifecycle-heartbeat-interval",
+						Value:   defaultLifecycleHeartbeatInterval,
+						Usage:   "the minimum duration between lifecycle action heartbeats recorded for each draining instance",
+						EnvVars: []string{"CYCLIST_LIFECYCLE_HEARTBEAT_INTERVAL", "LIFECYCLE_HEARTBEAT_INTERVAL"},
+					},
+					&cli.DurationFlag{
+						Name:    "max-drain-time",
+						Usage:   "the maximum duration that an instance may drain before its terminating lifecycle action is completed on its behalf, or 0 to wait for the lifecycle hook's own timeout",
+						EnvVars: []string{"CYCLIST_MAX_DRAIN_TIME", "MAX_DRAIN_TIME"},
+					},
+					&cli.StringSliceFlag{
+						Name:    "asg-max-drain-times",
+						Usage:   "max drain times per auto scaling group as `PATTERN=DURATION`, where the first matching name pattern wins over max-drain-time and 0 means no deadline",
+						EnvVars: []string{"CYCLIST_ASG_MAX_DRAIN_TIMES", "ASG_MAX_DRAIN_TIMES"},
+					},
+					&cli.DurationFlag{
+						Name:    "launch-timeout",
+						Usage:   "the duration after which launching instances that haven't reported their launch are completed with the launch timeout result, or 0 to wait for the lifecycle hook's own timeout",
+						EnvVars: []string{"CYCLIST_LAUNCH_TIMEOUT", "LAUNCH_TIMEOUT"},
+					},
+					&cli.StringFlag{
+						Name:    "launch-timeout-result",
+						Value:   lifecycleActionResultAbandon,
+						Usage:   "the `RESULT` used to complete timed out launches, either CONTINUE or ABANDON",
+						EnvVars: []string{"CYCLIST_LAUNCH_TIMEOUT_RESULT", "LAUNCH_TIMEOUT_RESULT"},
+					},
+					&cli.DurationFlag{
+						Name:    "protection-flush-interval",
+						Value:   defaultProtectionFlushInterval,
+						Usage:   "the interval at which scale-in protection requested by busy and idle instances is applied in batches, or 0 to disable",
+						EnvVars: []string{"CYCLIST_PROTECTION_FLUSH_INTERVAL", "PROTECTION_FLUSH_INTERVAL"},
+					},
+					&cli.DurationFlag{
+						Name:    "reconcile-interval",
+						Value:   defaultReconcileInterval,
+						Usage:   "the interval at which instances in allowed ASGs are reconciled with what cyclist knows of them, or 0 to disable",
+						EnvVars: []string{"CYCLIST_RECONCILE_INTERVAL", "RECONCILE_INTERVAL"},
+					},
+					&cli.DurationFlag{
+						Name:    "cycle-interval",
+						Value:   defaultCycleInterval,
+						Usage:   "the interval at which cycles started through the api check on their progress",
+						EnvVars: []string{"CYCLIST_CYCLE_INTERVAL", "CYCLE_INTERVAL"},
+					},
+					&cli.DurationFlag{
+						Name:    "sns-max-message-age",
+						Value:   time.Hour,
+						Usage:   "the maximum age of SNS messages by their signed timestamp, or 0 to accept any age",
+						EnvVars: []string{"CYCLIST_SNS_MAX_MESSAGE_AGE", "SNS_MAX_MESSAGE_AGE"},
+					},
+					&cli.DurationFlag{
+						Name:    "sns-cert-cache-ttl",
+						Value:   24 * time.Hour,
+						Usage:   "duration that fetched SNS signing certs will be cached",
+						EnvVars: []string{"CYCLIST_SNS_CERT_CACHE_TTL", "SNS_CERT_CACHE_TTL"},
+					},
+					&cli.StringFlag{
+						Name:    "sns-cert-ca-bundle",
+						Usage:   "the `CA_BUNDLE` file used to verify the TLS connection when fetching SNS signing certs",
+						EnvVars: []string{"CYCLIST_SNS_CERT_CA_BUNDLE", "SNS_CERT_CA_BUNDLE"},
+					},
+					&cli.StringFlag{
+						Name:    "sns-cert-dir",
+						Usage:   "the `DIR` from which to read SNS signing certs by file name instead of fetching them",
+						EnvVars: []string{"CYCLIST_SNS_CERT_DIR", "SNS_CERT_DIR"},
+					},
+				}, allowlistFlags()...),
 				Action: runServe,
 			},
 			{
@@ -105,10 +242,51 @@ func NewCLI() *cli.App {
 				},
 				Action: runSetDown,
 			},
-			/* TODO: #5
 			{
-				Name: "sqs",
+				Name:  "adopt",
+				Usage: "bring the in service instances of an ASG that cyclist has no state for under management",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "asg",
+						Aliases: []string{"A"},
+						Usage:   "the `ASG_NAME` of the auto scaling group whose instances will be adopted",
+						EnvVars: []string{"CYCLIST_ASG", "ASG"},
+					},
+				},
+				Action: runAdopt,
+			},
+			{
+				Name:  "cycle",
+				Usage: "gracefully replace the instances of an ASG a batch at a time",
 				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "asg",
+						Aliases: []string{"A"},
+						Usage:   "the `ASG_NAME` of the auto scaling group to cycle",
+						EnvVars: []string{"CYCLIST_ASG", "ASG"},
+					},
+					&cli.IntFlag{
+						Name:    "batch-size",
+						Usage:   "the number of instances marked down at a time (default 1, or that of the unfinished cycle resumed)",
+						EnvVars: []string{"CYCLIST_BATCH_SIZE", "BATCH_SIZE"},
+					},
+					&cli.DurationFlag{
+						Name:    "max-age",
+						Usage:   "only cycle instances launched longer ago than this, or 0 to cycle all of them",
+						EnvVars: []string{"CYCLIST_MAX_AGE", "MAX_AGE"},
+					},
+					&cli.DurationFlag{
+						Name:    "cycle-interval",
+						Value:   defaultCycleInterval,
+						Usage:   "the interval at which the cycle checks on its progress",
+						EnvVars: []string{"CYCLIST_CYCLE_INTERVAL", "CYCLE_INTERVAL"},
+					},
+				},
+				Action: runCycle,
+			},
+			{
+				Name: "sqs",
+				Flags: append([]cli.Flag{
 					&cli.StringFlag{
 						Name:    "queue-url",
 						Usage:   "the `QUEUE_URL` from which to receive messages",
@@ -122,10 +300,35 @@ func NewCLI() *cli.App {
 						Aliases: []string{"C"},
 						EnvVars: []string{"CYCLIST_CONCURRENCY", "CONCURRENCY"},
 					},
-				},
+					&cli.DurationFlag{
+						Name:    "visibility-timeout",
+						Value:   30 * time.Second,
+						Usage:   "duration that a received message is hidden from other consumers, extended while handling",
+						EnvVars: []string{"CYCLIST_VISIBILITY_TIMEOUT", "VISIBILITY_TIMEOUT"},
+					},
+				}, allowlistFlags()...),
 				Action: runSqs,
 			},
-			*/
+		},
+	}
+}
+
+func allowlistFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:    "allowed-topic-arns",
+			Usage:   "the SNS `TOPIC_ARNS` from which messages will be accepted (default all)",
+			EnvVars: []string{"CYCLIST_ALLOWED_TOPIC_ARNS", "ALLOWED_TOPIC_ARNS"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "allowed-account-ids",
+			Usage:   "the AWS `ACCOUNT_IDS` for which lifecycle actions will be accepted (default all)",
+			EnvVars: []string{"CYCLIST_ALLOWED_ACCOUNT_IDS", "ALLOWED_ACCOUNT_IDS"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "allowed-asg-names",
+			Usage:   "the ASG name `PATTERNS` (globs) for which lifecycle actions will be accepted (default all)",
+			EnvVars: []string{"CYCLIST_ALLOWED_ASG_NAMES", "ALLOWED_ASG_NAMES"},
 		},
 	}
 }
@@ -135,12 +338,21 @@ func runServe(ctx *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	return srv.Serve()
+	defer closeDb(srv.db, srv.log)
+
+	cntx, cancel := context.WithCancel(context.Background())
+	go runSignalHandler(srv.log, cancel)
+
+	return srv.Serve(cntx)
 }
 
 func runSetDown(ctx *cli.Context) error {
 	log := buildLog(ctx.Bool("debug"))
-	db := setupDbFromCtxAndLog(ctx, log)
+	db, err := setupSharedDbFromCtxAndLog(ctx, log)
+	if err != nil {
+		return err
+	}
+	defer closeDb(db, log)
 
 	for _, instanceID := range ctx.StringSlice("instances") {
 		err := db.setInstanceState(instanceID, "down")
@@ -156,6 +368,59 @@ func runSetDown(ctx *cli.Context) error {
 	return nil
 }
 
+func runAdopt(ctx *cli.Context) error {
+	log := buildLog(ctx.Bool("debug"))
+	db, err := setupSharedDbFromCtxAndLog(ctx, log)
+	if err != nil {
+		return err
+	}
+	defer closeDb(db, log)
+
+	asSvc := autoscaling.New(session.New(), &aws.Config{
+		Region: aws.String(ctx.String("aws-region")),
+	})
+
+	adopted, err := adoptInstances(db, log, asSvc, &uuidTokenGenerator{}, ctx.String("asg"))
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(logrus.Fields{
+		"asg":     ctx.String("asg"),
+		"adopted": len(adopted),
+	}).Info("adopted")
+	return nil
+}
+
+func runCycle(ctx *cli.Context) error {
+	log := buildLog(ctx.Bool("debug"))
+	db, err := setupSharedDbFromCtxAndLog(ctx, log)
+	if err != nil {
+		return err
+	}
+	defer closeDb(db, log)
+
+	asSvc := autoscaling.New(session.New(), &aws.Config{
+		Region: aws.String(ctx.String("aws-region")),
+	})
+
+	c := newCycler(db, log, asSvc, ctx.Duration("cycle-interval"))
+	run, err := c.start(ctx.String("asg"), ctx.Int("batch-size"), ctx.Duration("max-age"))
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(logrus.Fields{
+		"asg":    run.ASGName,
+		"queued": len(run.Queue),
+	}).Info("cycling")
+
+	cntx, cancel := context.WithCancel(context.Background())
+	go runSignalHandler(log, cancel)
+
+	return c.Run(cntx, run.ASGName)
+}
+
 func runServeSetup(ctx *cli.Context) (*server, error) {
 	port := ctx.String("port")
 	if !strings.Contains(port, ":") {
@@ -163,7 +428,10 @@ func runServeSetup(ctx *cli.Context) (*server, error) {
 	}
 
 	log := buildLog(ctx.Bool("debug"))
-	db := setupDbFromCtxAndLog(ctx, log)
+	db, err := setupDbFromCtxAndLog(ctx, log)
+	if err != nil {
+		return nil, err
+	}
 
 	snsSvc := sns.New(session.New(), &aws.Config{
 		Region: aws.String(ctx.String("aws-region")),
@@ -172,6 +440,67 @@ func runServeSetup(ctx *cli.Context) (*server, error) {
 		Region: aws.String(ctx.String("aws-region")),
 	})
 
+	allowlist, err := newLifecycleAllowlist(ctx.StringSlice("allowed-topic-arns"),
+		ctx.StringSlice("allowed-account-ids"), ctx.StringSlice("allowed-asg-names"))
+	if err != nil {
+		return nil, err
+	}
+
+	var certFetcher snsCertFetcher
+	if ctx.String("sns-cert-dir") != "" {
+		certFetcher = &dirSNSCertFetcher{dir: ctx.String("sns-cert-dir")}
+	} else {
+		httpCertFetcher, err := newHTTPSNSCertFetcher(ctx.String("sns-cert-ca-bundle"))
+		if err != nil {
+			return nil, err
+		}
+		certFetcher = httpCertFetcher
+	}
+
+	maxMessageAge := ctx.Duration("sns-max-message-age")
+	if maxMessageAge <= 0 || ctx.Duration("message-ttl") < maxMessageAge {
+		log.WithFields(logrus.Fields{
+			"sns_max_message_age": maxMessageAge.String(),
+			"message_ttl":         ctx.Duration("message-ttl").String(),
+		}).Warn("sns messages older than the message ttl are accepted, so replays may go undetected")
+	}
+
+	deadlines, err := newDrainDeadlines(ctx.Duration("max-drain-time"), ctx.StringSlice("asg-max-drain-times"))
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkRedisHashTagsScans(ctx, deadlines)
+	if err != nil {
+		return nil, err
+	}
+
+	var drainReaper *drainTimeoutReaper
+	if deadlines.enabled() {
+		drainReaper = newDrainTimeoutReaper(db, log, asSvc, deadlines)
+	}
+
+	var launchReaper *launchTimeoutReaper
+	if ctx.Duration("launch-timeout") > 0 {
+		launchReaper, err = newLaunchTimeoutReaper(db, log, asSvc, ctx.Duration("launch-timeout"),
+			strings.ToUpper(ctx.String("launch-timeout-result")))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var protector *instanceProtector
+	if ctx.Duration("protection-flush-interval") > 0 {
+		protector = newInstanceProtector(log, asSvc, ctx.Duration("protection-flush-interval"))
+	}
+
+	tokGen := &uuidTokenGenerator{}
+
+	var rc *reconciler
+	if ctx.Duration("reconcile-interval") > 0 {
+		rc = newReconciler(db, log, asSvc, tokGen, allowlist, ctx.Duration("reconcile-interval"))
+	}
+
 	authTokens := strings.Split(ctx.String("auth-tokens"), ",")
 	for i, tok := range authTokens {
 		authTokens[i] = strings.TrimSpace(tok)
@@ -185,30 +514,136 @@ func runServeSetup(ctx *cli.Context) (*server, error) {
 		log:    log,
 		asSvc:  asSvc,
 		snsSvc: snsSvc,
-		tokGen: &uuidTokenGenerator{},
+		tokGen: tokGen,
 
 		snsVerify: true,
+		snsVerifier: newSNSVerifier(certFetcher,
+			ctx.Duration("sns-cert-cache-ttl"), ctx.Int("sns-min-signature-version"), maxMessageAge),
+		allowlist: allowlist,
+		heartbeater: newLifecycleHeartbeater(ctx.Duration("lifecycle-heartbeat-interval"),
+			deadlines),
+
+		drainDeadlines: deadlines,
+		launchReaper:   launchReaper,
+		drainReaper:    drainReaper,
+		protector:      protector,
+		cycler:         newCycler(db, log, asSvc, ctx.Duration("cycle-interval")),
+		reconciler:     rc,
 	}, nil
 }
 
-func setupDbFromCtxAndLog(ctx *cli.Context, log logrus.FieldLogger) repo {
-	return &redisRepo{
-		cg:  buildRedisPool(ctx.String("redis-url")),
-		log: log,
+// checkRedisHashTagsScans refuses the background loops that scan for pending
+// lifecycle actions when redis keys are hash tagged for Redis Cluster, as a
+// scan only covers the node it is sent to and would silently miss the others
+func checkRedisHashTagsScans(ctx *cli.Context, deadlines *drainDeadlines) error {
+	if ctx.String("storage") != "redis" || !ctx.Bool("redis-hash-tags") {
+		return nil
+	}
+
+	flags := []string{}
+	if ctx.Duration("launch-timeout") > 0 {
+		flags = append(flags, "--launch-timeout")
+	}
+	if deadlines.enabled() {
+		flags = append(flags, "--max-drain-time", "--asg-max-drain-times")
+	}
+	if ctx.Duration("reconcile-interval") > 0 {
+		flags = append(flags, "--reconcile-interval")
+	}
+
+	if len(flags) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%s must be 0 with --redis-hash-tags, as pending lifecycle actions are scanned for on a single redis node",
+		strings.Join(flags, ", "))
+}
+
+// setupSharedDbFromCtxAndLog sets up storage for commands other than serve,
+// refusing memory storage as what they write to it would never reach the
+// server
+func setupSharedDbFromCtxAndLog(ctx *cli.Context, log logrus.FieldLogger) (repo, error) {
+	if ctx.String("storage") == "memory" {
+		return nil, errors.New("memory storage is only available to serve, as it is not shared with other processes")
+	}
+	return setupDbFromCtxAndLog(ctx, log)
+}
+
+func setupDbFromCtxAndLog(ctx *cli.Context, log logrus.FieldLogger) (repo, error) {
+	storage := ctx.String("storage")
+	if strings.HasPrefix(storage, "bolt:") {
+		storageURL, err := url.Parse(storage)
+		if err != nil {
+			return nil, err
+		}
+
+		if storageURL.Path == "" {
+			return nil, fmt.Errorf("missing path in storage '%s'", storage)
+		}
+
+		log.WithField("path", storageURL.Path).Debug("using bolt storage")
+		br, err := newBoltRepo(
+			storageURL.Path,
+			ctx.Duration("event-ttl"),
+			ctx.Duration("lifecycle-action-ttl"),
+			ctx.Duration("temp-token-ttl"),
+			ctx.Duration("token-ttl"),
+			ctx.Duration("message-ttl"),
+		)
+		if err != nil {
+			return nil, err
+		}
+		return br, nil
+	}
+
+	switch storage {
+	case "redis":
+		pool, err := buildRedisPool(&redisPoolOptions{
+			URL:            ctx.String("redis-url"),
+			MaxIdle:        ctx.Int("redis-max-idle"),
+			MaxActive:      ctx.Int("redis-max-active"),
+			IdleTimeout:    ctx.Duration("redis-idle-timeout"),
+			ConnectTimeout: ctx.Duration("redis-connect-timeout"),
+			ReadTimeout:    ctx.Duration("redis-read-timeout"),
+			WriteTimeout:   ctx.Duration("redis-write-timeout"),
+			TLSCAFile:      ctx.String("redis-tls-ca-file"),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return &redisRepo{
+			cg:  pool,
+			log: log,
+
+			instEventTTL:           uint(ctx.Duration("event-ttl").Seconds()),
+			instLifecycleActionTTL: uint(ctx.Duration("lifecycle-action-ttl").Seconds()),
+			instTempTokTTL:         uint(ctx.Duration("temp-token-ttl").Seconds()),
+			instTokTTL:             uint(ctx.Duration("token-ttl").Seconds()),
+			messageTTL:             uint(ctx.Duration("message-ttl").Seconds()),
 
-		instEventTTL:           uint(ctx.Duration("event-ttl").Seconds()),
-		instLifecycleActionTTL: uint(ctx.Duration("lifecycle-action-ttl").Seconds()),
-		instTempTokTTL:         uint(ctx.Duration("temp-token-ttl").Seconds()),
-		instTokTTL:             uint(ctx.Duration("token-ttl").Seconds()),
+			hashTags: ctx.Bool("redis-hash-tags"),
+		}, nil
+	case "memory":
+		log.Warn("using memory storage, which is not shared and is lost on exit")
+		return newMemoryRepo(
+			ctx.Duration("event-ttl"),
+			ctx.Duration("lifecycle-action-ttl"),
+			ctx.Duration("temp-token-ttl"),
+			ctx.Duration("token-ttl"),
+			ctx.Duration("message-ttl"),
+		), nil
+	default:
+		return nil, fmt.Errorf("unknown storage '%s'", storage)
 	}
 }
 
-/* TODO: #5
 func runSqs(ctx *cli.Context) error {
 	sh, cntx, err := runSqsSetup(ctx)
 	if err != nil {
 		return err
 	}
+	defer closeDb(sh.db, sh.log)
 
 	return sh.Run(cntx)
 }
@@ -219,18 +654,21 @@ func runSqsSetup(ctx *cli.Context) (*sqsHandler, context.Context, error) {
 		return nil, nil, errors.New("missing SQS queue URL")
 	}
 
-	log := buildLog(ctx.Bool("debug"))
-	db := &redisRepo{
-		cg:  buildRedisPool(ctx.String("redis-url")),
-		log: log,
+	allowlist, err := newLifecycleAllowlist(ctx.StringSlice("allowed-topic-arns"),
+		ctx.StringSlice("allowed-account-ids"), ctx.StringSlice("allowed-asg-names"))
+	if err != nil {
+		return nil, nil, err
+	}
 
-		instEventTTL:						uint(ctx.Duration("event-ttl").Seconds()),
-		instLifecycleActionTTL: uint(ctx.Duration("lifecycle-action-ttl").Seconds()),
-		instTempTokTTL:					uint(ctx.Duration("temp-token-ttl").Seconds()),
-		instTokTTL:							uint(ctx.Duration("token-ttl").Seconds()),
+	log := buildLog(ctx.Bool("debug"))
+	db, err := setupSharedDbFromCtxAndLog(ctx, log)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	sqsSvc := sqs.New(session.New())
+	sqsSvc := sqs.New(session.New(), &aws.Config{
+		Region: aws.String(ctx.String("aws-region")),
+	})
 	snsSvc := sns.New(session.New(), &aws.Config{
 		Region: aws.String(ctx.String("aws-region")),
 	})
@@ -239,33 +677,48 @@ func runSqsSetup(ctx *cli.Context) (*sqsHandler, context.Context, error) {
 	})
 
 	cntx, cancel := context.WithCancel(context.Background())
-	go runSignalHandler(cancel)
+	go runSignalHandler(log, cancel)
 
 	return &sqsHandler{
-		queueURL:    sqsQueueURL,
-		concurrency: ctx.Int("concurrency"),
+		queueURL:          sqsQueueURL,
+		concurrency:       ctx.Int("concurrency"),
+		visibilityTimeout: ctx.Duration("visibility-timeout"),
 
 		db:     db,
 		log:    log,
 		asSvc:  asSvc,
 		snsSvc: snsSvc,
 		sqsSvc: sqsSvc,
+		tokGen: &uuidTokenGenerator{},
+
+		allowlist: allowlist,
 	}, cntx, nil
 }
 
-func runSignalHandler(cancel context.CancelFunc) {
+func runSignalHandler(log logrus.FieldLogger, cancel context.CancelFunc) {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
 
-	for {
-		select {
-		case <-sigChan:
-			cancel()
-			os.Exit(0)
-		}
+	sig := <-sigChan
+	log.WithField("signal", sig).Info("shutting down")
+	cancel()
+}
+
+// closeDb closes storage holding resources of its own, such as the file lock
+// on a bolt database, so that other processes may open it
+func closeDb(db repo, log logrus.FieldLogger) {
+	closer, ok := db.(interface {
+		close() error
+	})
+	if !ok {
+		return
+	}
+
+	err := closer.close()
+	if err != nil {
+		log.WithField("err", err).Warn("failed to close storage")
 	}
 }
-*/
 
 func buildLog(debug bool) logrus.FieldLogger {
 	log := logrus.New()
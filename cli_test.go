@@ -2,11 +2,14 @@ package cyclist
 
 import (
 	"bytes"
+	"flag"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/urfave/cli.v2"
 )
 
 func TestBuildLog(t *testing.T) {
@@ -22,3 +25,38 @@ func TestBuildLog(t *testing.T) {
 	assert.NotNil(t, log)
 	assert.Equal(t, logrus.DebugLevel, log.(*logrus.Logger).Level)
 }
+
+func TestCheckRedisHashTagsScans(t *testing.T) {
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	set.String("storage", "redis", "")
+	set.Bool("redis-hash-tags", true, "")
+	set.Duration("launch-timeout", 0, "")
+	set.Duration("reconcile-interval", defaultReconcileInterval, "")
+	ctx := cli.NewContext(nil, set, nil)
+
+	err := checkRedisHashTagsScans(ctx, &drainDeadlines{defaultMaxDrainTime: time.Hour})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "--max-drain-time")
+	assert.Contains(t, err.Error(), "--reconcile-interval")
+	assert.NotContains(t, err.Error(), "--launch-timeout")
+
+	_ = set.Set("reconcile-interval", "0")
+	assert.Nil(t, checkRedisHashTagsScans(ctx, &drainDeadlines{}))
+
+	_ = set.Set("redis-hash-tags", "false")
+	_ = set.Set("reconcile-interval", "1m")
+	assert.Nil(t, checkRedisHashTagsScans(ctx, &drainDeadlines{defaultMaxDrainTime: time.Hour}))
+}
+
+func TestSetupSharedDbFromCtxAndLog_WithMemoryStorage(t *testing.T) {
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	set.String("storage", "memory", "")
+
+	db, err := setupSharedDbFromCtxAndLog(cli.NewContext(nil, set, nil), shushLog)
+	assert.NotNil(t, err)
+	assert.Nil(t, db)
+
+	db, err = setupDbFromCtxAndLog(cli.NewContext(nil, set, nil), shushLog)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+}
@@ -0,0 +1,554 @@
+package cyclist
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/gorilla/mux"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	cycleStateDraining  = "draining"
+	cycleStateReplacing = "replacing"
+	cycleStateDone      = "done"
+)
+
+var (
+	defaultCycleInterval = 30 * time.Second
+
+	// cycleLockTTL bounds how long a cycle run stays locked by a process that
+	// dies while stepping it
+	cycleLockTTL = time.Minute
+)
+
+// cycleRun is the progress of cycling an auto scaling group, stored after each
+// step so that it may be resumed. Instances in the queue are marked down a
+// batch at a time, terminated with replacement once they have imploded, and the
+// next batch is only started once their replacements are in service.
+type cycleRun struct {
+	ASGName    string    `json:"asg"`
+	BatchSize  int       `json:"batch_size"`
+	MaxAge     string    `json:"max_age,omitempty"`
+	State      string    `json:"state"`
+	Known      []string  `json:"known"`
+	Queue      []string  `json:"queue"`
+	Batch      []string  `json:"batch"`
+	Terminated []string  `json:"terminated"`
+	StartedAt  time.Time `json:"started_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// cycleSettingsError is returned when asked to start a cycle with other
+// settings than those of the unfinished run that it would resume
+type cycleSettingsError struct {
+	run *cycleRun
+}
+
+func (cse *cycleSettingsError) Error() string {
+	maxAge := cse.run.MaxAge
+	if maxAge == "" {
+		maxAge = "0s"
+	}
+	return fmt.Sprintf("unfinished cycle for auto scaling group '%s' has batch size %d and max age %s",
+		cse.run.ASGName, cse.run.BatchSize, maxAge)
+}
+
+func (cr *cycleRun) isKnown(instanceID string) bool {
+	for _, known := range cr.Known {
+		if known == instanceID {
+			return true
+		}
+	}
+	return false
+}
+
+type cycler struct {
+	db       repo
+	log      logrus.FieldLogger
+	asSvc    autoscalingiface.AutoScalingAPI
+	interval time.Duration
+
+	mutex sync.Mutex
+	// ctx stops runs started in the background, and is set by resume
+	ctx     context.Context
+	running map[string]bool
+}
+
+func newCycler(db repo, log logrus.FieldLogger, asSvc autoscalingiface.AutoScalingAPI, interval time.Duration) *cycler {
+	if interval <= 0 {
+		interval = defaultCycleInterval
+	}
+
+	return &cycler{
+		db:       db,
+		log:      log.WithField("self", "cycler"),
+		asSvc:    asSvc,
+		interval: interval,
+
+		ctx:     context.Background(),
+		running: map[string]bool{},
+	}
+}
+
+// start stores a new cycle run for the auto scaling group, queueing its in
+// service instances older than the max age, or all of them if the max age is
+// 0, oldest first, a batch size of 0 meaning 1. An unfinished run for the same
+// group is returned as-is so that it may be resumed, unless it was started
+// with another batch size or max age than those given.
+func (c *cycler) start(asgName string, batchSize int, maxAge time.Duration) (*cycleRun, error) {
+	if strings.TrimSpace(asgName) == "" {
+		return nil, errors.New("missing auto scaling group name")
+	}
+
+	if batchSize < 0 {
+		return nil, fmt.Errorf("invalid batch size %d", batchSize)
+	}
+
+	run, err := c.db.fetchCycleRun(asgName)
+	if err != nil {
+		return nil, err
+	}
+
+	if run != nil && run.State != cycleStateDone {
+		runMaxAge, _ := time.ParseDuration(run.MaxAge)
+		if (batchSize != 0 && batchSize != run.BatchSize) || (maxAge > 0 && maxAge != runMaxAge) {
+			return nil, &cycleSettingsError{run: run}
+		}
+
+		c.log.WithField("asg", asgName).Info("resuming unfinished cycle")
+		return run, nil
+	}
+
+	if batchSize == 0 {
+		batchSize = 1
+	}
+
+	asg, err := c.describeASG(asgName)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	run = &cycleRun{
+		ASGName:    asgName,
+		BatchSize:  batchSize,
+		Known:      []string{},
+		Queue:      []string{},
+		Batch:      []string{},
+		Terminated: []string{},
+		StartedAt:  now,
+		UpdatedAt:  now,
+	}
+	if maxAge > 0 {
+		run.MaxAge = maxAge.String()
+	}
+
+	launchedAt := map[string]time.Time{}
+	for _, inst := range asg.Instances {
+		instanceID := aws.StringValue(inst.InstanceId)
+		run.Known = append(run.Known, instanceID)
+
+		if aws.StringValue(inst.LifecycleState) != autoscaling.LifecycleStateInService {
+			continue
+		}
+
+		// instances without a launching event are older than the event ttl or
+		// were never launched through cyclist, so they are always cycled
+		if le, _ := c.db.fetchInstanceEvent(instanceID, "launching"); le != nil {
+			launchedAt[instanceID] = le.Timestamp
+			if maxAge > 0 && now.Sub(le.Timestamp) < maxAge {
+				continue
+			}
+		}
+
+		run.Queue = append(run.Queue, instanceID)
+	}
+
+	sort.Strings(run.Known)
+	sort.SliceStable(run.Queue, func(i, j int) bool {
+		return launchedAt[run.Queue[i]].Before(launchedAt[run.Queue[j]])
+	})
+
+	return run, c.db.storeCycleRun(run)
+}
+
+// resume runs every unfinished cycle in the background until ctx is done, as
+// after a restart, and has cycles started later run until then too
+func (c *cycler) resume(ctx context.Context) {
+	c.mutex.Lock()
+	c.ctx = ctx
+	c.mutex.Unlock()
+
+	runs, err := c.db.fetchCycleRuns()
+	if err != nil {
+		c.log.WithField("err", err).Error("failed to fetch cycles")
+		return
+	}
+
+	for _, run := range runs {
+		if run.State == cycleStateDone {
+			continue
+		}
+
+		c.runInBackground(run.ASGName)
+	}
+}
+
+// runInBackground runs the cycle for the auto scaling group in a goroutine,
+// unless this cycler is already running it, returning whether it was started
+func (c *cycler) runInBackground(asgName string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.running[asgName] {
+		return false
+	}
+	c.running[asgName] = true
+
+	go func(ctx context.Context) {
+		defer func() {
+			c.mutex.Lock()
+			delete(c.running, asgName)
+			c.mutex.Unlock()
+		}()
+
+		err := c.Run(ctx, asgName)
+		if err != nil {
+			c.log.WithFields(logrus.Fields{
+				"err": err,
+				"asg": asgName,
+			}).Error("cycle failed")
+		}
+	}(c.ctx)
+
+	return true
+}
+
+// Run steps through the stored cycle run for the auto scaling group every
+// interval until it is done. Each step is taken with the cycle run locked, so
+// that runs resumed or started by several processes are not stepped twice.
+func (c *cycler) Run(ctx context.Context, asgName string) error {
+	log := c.log.WithField("asg", asgName)
+	log.WithField("interval", c.interval.String()).Info("starting")
+
+	owner := uuid.NewRandom().String()
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		run, err := c.stepLocked(log, asgName, owner)
+		if err != nil {
+			log.WithField("err", err).Error("failed to step cycle")
+		} else if run == nil {
+			return fmt.Errorf("no cycle for auto scaling group '%s'", asgName)
+		} else if run.State == cycleStateDone {
+			log.WithField("terminated", len(run.Terminated)).Info("done")
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Info("stopping")
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// stepLocked fetches, steps and stores the cycle run with it locked by the
+// owner, only fetching it when another owner holds the lock
+func (c *cycler) stepLocked(log logrus.FieldLogger, asgName, owner string) (*cycleRun, error) {
+	locked, err := c.db.lockCycleRun(asgName, owner, cycleLockTTL)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to lock cycle")
+	}
+
+	if !locked {
+		log.Debug("cycle locked elsewhere")
+		return c.db.fetchCycleRun(asgName)
+	}
+
+	defer func() {
+		err := c.db.unlockCycleRun(asgName, owner)
+		if err != nil {
+			log.WithField("err", err).Warn("failed to unlock cycle")
+		}
+	}()
+
+	run, err := c.db.fetchCycleRun(asgName)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to fetch cycle")
+	}
+
+	if run == nil || run.State == cycleStateDone {
+		return run, nil
+	}
+
+	err = c.step(run)
+	if err != nil {
+		log.WithField("err", err).Error("failed to step cycle")
+	}
+
+	run.UpdatedAt = time.Now().UTC()
+	err = c.db.storeCycleRun(run)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to store cycle")
+	}
+
+	return run, nil
+}
+
+// step moves the cycle run along as far as it can without waiting, leaving it
+// to be stored by the caller
+func (c *cycler) step(run *cycleRun) error {
+	asg, err := c.describeASG(run.ASGName)
+	if err != nil {
+		return err
+	}
+
+	instances := map[string]*autoscaling.Instance{}
+	for _, inst := range asg.Instances {
+		instances[aws.StringValue(inst.InstanceId)] = inst
+	}
+
+	log := c.log.WithFields(logrus.Fields{
+		"asg":   run.ASGName,
+		"state": run.State,
+	})
+
+	if run.State == cycleStateDraining {
+		return c.terminateImploded(log, run, instances)
+	}
+
+	if run.State == cycleStateReplacing && !c.isReplaced(run, asg) {
+		log.Debug("waiting on replacements")
+		return nil
+	}
+
+	queue := []string{}
+	for _, instanceID := range run.Queue {
+		if _, ok := instances[instanceID]; ok {
+			queue = append(queue, instanceID)
+		}
+	}
+
+	if len(queue) == 0 {
+		run.Queue = []string{}
+		run.State = cycleStateDone
+		return nil
+	}
+
+	n := run.BatchSize
+	if n > len(queue) {
+		n = len(queue)
+	}
+	run.Batch = queue[:n]
+	run.Queue = queue[n:]
+	run.State = cycleStateDraining
+
+	for _, instanceID := range run.Batch {
+		log.WithField("instance", instanceID).Info("cycling instance")
+
+		err = c.db.setInstanceState(instanceID, "down")
+		if err != nil {
+			return err
+		}
+
+		err = c.db.storeInstanceEvent(instanceID, "cycling")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// terminateImploded terminates instances in the current batch once they have
+// imploded, unless they already asked to be removed when imploding
+func (c *cycler) terminateImploded(log logrus.FieldLogger, run *cycleRun, instances map[string]*autoscaling.Instance) error {
+	remaining := []string{}
+	for i, instanceID := range run.Batch {
+		inst, ok := instances[instanceID]
+		if !ok || strings.HasPrefix(aws.StringValue(inst.LifecycleState), "Terminating") {
+			run.Terminated = append(run.Terminated, instanceID)
+			continue
+		}
+
+		if le, _ := c.db.fetchInstanceEvent(instanceID, "implosion"); le == nil {
+			remaining = append(remaining, instanceID)
+			continue
+		}
+
+		if fetchImplosionAction(c.db, instanceID) == "" {
+			log.WithField("instance", instanceID).Info("terminating imploded instance")
+
+			err := removeImplodedInstance(c.asSvc, instanceID, implosionActionTerminate)
+			if err != nil {
+				run.Batch = append(remaining, run.Batch[i:]...)
+				return err
+			}
+
+			// only recorded once terminating, as an instance with an implosion
+			// action is otherwise taken to have been removed already
+			err = c.db.storeInstanceEvent(instanceID, fmt.Sprintf("implosion:%s", implosionActionTerminate))
+			if err != nil {
+				log.WithFields(logrus.Fields{
+					"err":      err,
+					"instance": instanceID,
+				}).Warn("failed to store implosion action event")
+			}
+		}
+
+		run.Terminated = append(run.Terminated, instanceID)
+	}
+
+	run.Batch = remaining
+	if len(remaining) == 0 {
+		run.State = cycleStateReplacing
+	}
+	return nil
+}
+
+// isReplaced is true once as many instances unknown to the run are in service
+// as have been terminated, or once the group is back at its desired capacity
+// with nothing pending
+func (c *cycler) isReplaced(run *cycleRun, asg *autoscaling.Group) bool {
+	replacements, inService, pending := 0, 0, 0
+	for _, inst := range asg.Instances {
+		state := aws.StringValue(inst.LifecycleState)
+		if strings.HasPrefix(state, "Pending") {
+			pending++
+		}
+
+		if state != autoscaling.LifecycleStateInService {
+			continue
+		}
+
+		inService++
+		if !run.isKnown(aws.StringValue(inst.InstanceId)) {
+			replacements++
+		}
+	}
+
+	if replacements >= len(run.Terminated) {
+		return true
+	}
+
+	return pending == 0 && int64(inService) >= aws.Int64Value(asg.DesiredCapacity)
+}
+
+func (c *cycler) describeASG(asgName string) (*autoscaling.Group, error) {
+	return describeAutoScalingGroup(c.asSvc, asgName)
+}
+
+func describeAutoScalingGroup(asSvc autoscalingiface.AutoScalingAPI, asgName string) (*autoscaling.Group, error) {
+	out, err := asSvc.DescribeAutoScalingGroups(&autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: aws.StringSlice([]string{asgName}),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(out.AutoScalingGroups) == 0 {
+		return nil, fmt.Errorf("no auto scaling group '%s'", asgName)
+	}
+
+	return out.AutoScalingGroups[0], nil
+}
+
+func newCyclesHandlerFunc(log logrus.FieldLogger, c *cycler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log = log.WithFields(logrus.Fields{
+			"path":   r.URL.Path,
+			"method": r.Method,
+		})
+
+		body := &jsonCycleRequest{}
+		err := json.NewDecoder(r.Body).Decode(body)
+		if err != nil {
+			log.WithField("err", err).Error("invalid json received")
+			jsonRespond(w, http.StatusBadRequest, &jsonErr{
+				Err: errors.Wrap(err, "invalid json received"),
+			})
+			return
+		}
+
+		maxAge := time.Duration(0)
+		if body.MaxAge != "" {
+			maxAge, err = time.ParseDuration(body.MaxAge)
+			if err != nil {
+				jsonRespond(w, http.StatusBadRequest, &jsonErr{
+					Err: errors.Wrap(err, "invalid max age"),
+				})
+				return
+			}
+		}
+
+		run, err := c.start(body.ASGName, body.BatchSize, maxAge)
+		if err != nil {
+			log.WithField("err", err).Error("starting cycle failed")
+			status := http.StatusBadRequest
+			if _, ok := err.(*cycleSettingsError); ok {
+				status = http.StatusConflict
+			}
+			jsonRespond(w, status, &jsonErr{
+				Err: errors.Wrap(err, "starting cycle failed"),
+			})
+			return
+		}
+
+		if !c.runInBackground(run.ASGName) {
+			log.WithField("asg", run.ASGName).Debug("cycle already running")
+		}
+
+		jsonRespond(w, http.StatusAccepted, run)
+	}
+}
+
+func newCycleHandlerFunc(db repo, log logrus.FieldLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		asgName := mux.Vars(r)["asg_name"]
+		log = log.WithFields(logrus.Fields{
+			"path":   r.URL.Path,
+			"method": r.Method,
+			"asg":    asgName,
+		})
+
+		run, err := db.fetchCycleRun(asgName)
+		if err != nil {
+			log.WithField("err", err).Error("fetching cycle failed")
+			jsonRespond(w, http.StatusInternalServerError, &jsonErr{
+				Err: errors.Wrap(err, "fetching cycle failed"),
+			})
+			return
+		}
+
+		if run == nil {
+			jsonRespond(w, http.StatusNotFound, &jsonErr{
+				Err: fmt.Errorf("no cycle for auto scaling group '%s'", asgName),
+			})
+			return
+		}
+
+		jsonRespond(w, http.StatusOK, run)
+	}
+}
+
+type jsonCycleRequest struct {
+	ASGName   string `json:"asg"`
+	BatchSize int    `json:"batch_size"`
+	MaxAge    string `json:"max_age"`
+}
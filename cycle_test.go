@@ -0,0 +1,280 @@
+package cyclist
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/stretchr/testify/assert"
+)
+
+type testCycleASG struct {
+	desired    int64
+	instances  map[string]string
+	terminated []string
+	decrements int
+	failures   int
+}
+
+func (tca *testCycleASG) handle(r *request.Request) {
+	switch v := r.Params.(type) {
+	case *autoscaling.DescribeAutoScalingGroupsInput:
+		group := &autoscaling.Group{
+			AutoScalingGroupName: v.AutoScalingGroupNames[0],
+			DesiredCapacity:      aws.Int64(tca.desired),
+		}
+		for instanceID, state := range tca.instances {
+			group.Instances = append(group.Instances, &autoscaling.Instance{
+				InstanceId:     aws.String(instanceID),
+				LifecycleState: aws.String(state),
+			})
+		}
+		out := r.Data.(*autoscaling.DescribeAutoScalingGroupsOutput)
+		out.AutoScalingGroups = []*autoscaling.Group{group}
+	case *autoscaling.TerminateInstanceInAutoScalingGroupInput:
+		if tca.failures > 0 {
+			tca.failures--
+			r.Error = errors.New("throttled, probably")
+			return
+		}
+		if *v.ShouldDecrementDesiredCapacity {
+			tca.decrements++
+		}
+		tca.instances[*v.InstanceId] = autoscaling.LifecycleStateTerminatingWait
+		tca.terminated = append(tca.terminated, *v.InstanceId)
+	}
+}
+
+func TestCycler(t *testing.T) {
+	db := newTestRepo()
+	tca := &testCycleASG{
+		desired: 2,
+		instances: map[string]string{
+			"i-fafafaf": autoscaling.LifecycleStateInService,
+			"i-bababab": autoscaling.LifecycleStateInService,
+			"i-cacacac": autoscaling.LifecycleStateInService,
+		},
+	}
+	_ = db.storeInstanceEvent("i-fafafaf", "launching")
+	_ = db.storeInstanceEvent("i-bababab", "launching")
+	_ = db.storeInstanceEvent("i-cacacac", "launching")
+	db.e["i-fafafaf"]["launching"].Timestamp = time.Now().Add(-3 * time.Hour)
+	db.e["i-bababab"]["launching"].Timestamp = time.Now().Add(-2 * time.Hour)
+
+	c := newCycler(db, shushLog, newTestAutoScalingService(tca.handle), time.Second)
+	run, err := c.start("cat-theatre-napkin-hose", 1, time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"i-fafafaf", "i-bababab"}, run.Queue)
+
+	assert.Nil(t, c.step(run))
+	assert.Equal(t, cycleStateDraining, run.State)
+	assert.Equal(t, []string{"i-fafafaf"}, run.Batch)
+	assert.Equal(t, "down", db.s["i-fafafaf"])
+	assert.NotNil(t, db.e["i-fafafaf"]["cycling"])
+
+	assert.Nil(t, c.step(run))
+	assert.Equal(t, cycleStateDraining, run.State)
+	assert.Len(t, tca.terminated, 0)
+
+	_, err = handleImplosion(db, shushLog, nil, "i-fafafaf", "")
+	assert.Nil(t, err)
+
+	assert.Nil(t, c.step(run))
+	assert.Equal(t, cycleStateReplacing, run.State)
+	assert.Equal(t, []string{"i-fafafaf"}, tca.terminated)
+	assert.Equal(t, "terminate", fetchImplosionAction(db, "i-fafafaf"))
+
+	tca.instances["i-dadadad"] = autoscaling.LifecycleStatePendingWait
+	assert.Nil(t, c.step(run))
+	assert.Equal(t, cycleStateReplacing, run.State)
+
+	delete(tca.instances, "i-fafafaf")
+	tca.instances["i-dadadad"] = autoscaling.LifecycleStateInService
+	assert.Nil(t, c.step(run))
+	assert.Equal(t, cycleStateDraining, run.State)
+	assert.Equal(t, []string{"i-bababab"}, run.Batch)
+
+	_, err = handleImplosion(db, shushLog, nil, "i-bababab", "")
+	assert.Nil(t, err)
+	assert.Nil(t, c.step(run))
+	assert.Equal(t, cycleStateReplacing, run.State)
+
+	delete(tca.instances, "i-bababab")
+	tca.instances["i-eaeaeae"] = autoscaling.LifecycleStateInService
+	assert.Nil(t, c.step(run))
+	assert.Equal(t, cycleStateDone, run.State)
+	assert.Equal(t, []string{"i-fafafaf", "i-bababab"}, run.Terminated)
+	assert.Equal(t, 0, tca.decrements)
+}
+
+func TestCycler_stepRetriesFailedTermination(t *testing.T) {
+	db := newTestRepo()
+	tca := &testCycleASG{
+		desired: 1,
+		instances: map[string]string{
+			"i-fafafaf": autoscaling.LifecycleStateInService,
+		},
+		failures: 1,
+	}
+
+	c := newCycler(db, shushLog, newTestAutoScalingService(tca.handle), time.Second)
+	run, err := c.start("cat-theatre-napkin-hose", 1, 0)
+	assert.Nil(t, err)
+
+	assert.Nil(t, c.step(run))
+	_, err = handleImplosion(db, shushLog, nil, "i-fafafaf", "")
+	assert.Nil(t, err)
+
+	assert.NotNil(t, c.step(run))
+	assert.Equal(t, cycleStateDraining, run.State)
+	assert.Equal(t, []string{"i-fafafaf"}, run.Batch)
+	assert.Len(t, run.Terminated, 0)
+	assert.Equal(t, "", fetchImplosionAction(db, "i-fafafaf"))
+
+	assert.Nil(t, c.step(run))
+	assert.Equal(t, cycleStateReplacing, run.State)
+	assert.Equal(t, []string{"i-fafafaf"}, tca.terminated)
+	assert.Equal(t, []string{"i-fafafaf"}, run.Terminated)
+	assert.Equal(t, "terminate", fetchImplosionAction(db, "i-fafafaf"))
+}
+
+func TestCycler_stepLocked_LockedElsewhere(t *testing.T) {
+	db := newTestRepo()
+	tca := &testCycleASG{
+		desired: 1,
+		instances: map[string]string{
+			"i-fafafaf": autoscaling.LifecycleStateInService,
+		},
+	}
+
+	c := newCycler(db, shushLog, newTestAutoScalingService(tca.handle), time.Second)
+	_, err := c.start("cat-theatre-napkin-hose", 1, 0)
+	assert.Nil(t, err)
+
+	db.cl["cat-theatre-napkin-hose"] = "owner-b"
+
+	run, err := c.stepLocked(shushLog, "cat-theatre-napkin-hose", "owner-a")
+	assert.Nil(t, err)
+	assert.Equal(t, "", run.State)
+	assert.Equal(t, []string{"i-fafafaf"}, run.Queue)
+	assert.Equal(t, "", db.s["i-fafafaf"])
+
+	delete(db.cl, "cat-theatre-napkin-hose")
+
+	run, err = c.stepLocked(shushLog, "cat-theatre-napkin-hose", "owner-a")
+	assert.Nil(t, err)
+	assert.Equal(t, cycleStateDraining, run.State)
+	assert.Equal(t, "down", db.s["i-fafafaf"])
+	assert.Len(t, db.cl, 0)
+}
+
+func TestNewCycler_WithInvalidInterval(t *testing.T) {
+	for _, interval := range []time.Duration{0, -time.Second} {
+		c := newCycler(newTestRepo(), shushLog, nil, interval)
+		assert.Equal(t, defaultCycleInterval, c.interval)
+	}
+}
+
+func TestCycler_startResumes(t *testing.T) {
+	db := newTestRepo()
+	_ = db.storeCycleRun(&cycleRun{
+		ASGName:   "cat-theatre-napkin-hose",
+		BatchSize: 3,
+		State:     cycleStateDraining,
+		Batch:     []string{"i-fafafaf"},
+	})
+
+	c := newCycler(db, shushLog, newTestAutoScalingService(nil), time.Second)
+	for _, batchSize := range []int{0, 3} {
+		run, err := c.start("cat-theatre-napkin-hose", batchSize, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, 3, run.BatchSize)
+		assert.Equal(t, []string{"i-fafafaf"}, run.Batch)
+	}
+
+	_, err := c.start("cat-theatre-napkin-hose", 1, 0)
+	assert.IsType(t, &cycleSettingsError{}, err)
+	assert.Contains(t, err.Error(), "batch size 3 and max age 0s")
+
+	_, err = c.start("cat-theatre-napkin-hose", 3, time.Hour)
+	assert.IsType(t, &cycleSettingsError{}, err)
+
+	_, err = c.start("cat-theatre-napkin-hose", -1, 0)
+	assert.NotNil(t, err)
+}
+
+func TestCycler_Run(t *testing.T) {
+	db := newTestRepo()
+	tca := &testCycleASG{desired: 1, instances: map[string]string{}}
+	c := newCycler(db, shushLog, newTestAutoScalingService(tca.handle), time.Millisecond)
+
+	_, err := c.start("cat-theatre-napkin-hose", 1, 0)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, c.Run(ctx, "cat-theatre-napkin-hose"))
+
+	run, err := db.fetchCycleRun("cat-theatre-napkin-hose")
+	assert.Nil(t, err)
+	assert.Equal(t, cycleStateDone, run.State)
+}
+
+func TestCycler_runInBackground(t *testing.T) {
+	db := newTestRepo()
+	_ = db.storeCycleRun(&cycleRun{
+		ASGName:   "cat-theatre-napkin-hose",
+		BatchSize: 1,
+		State:     cycleStateDraining,
+	})
+
+	c := newCycler(db, shushLog, newTestAutoScalingService(nil), time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	c.resume(ctx)
+
+	assert.False(t, c.runInBackground("cat-theatre-napkin-hose"))
+
+	cancel()
+
+	stopped := false
+	for i := 0; i < 100 && !stopped; i++ {
+		time.Sleep(10 * time.Millisecond)
+		c.mutex.Lock()
+		stopped = !c.running["cat-theatre-napkin-hose"]
+		c.mutex.Unlock()
+	}
+	assert.True(t, stopped)
+}
+
+func TestCyclesHandlerFunc_WithOtherSettings(t *testing.T) {
+	db := newTestRepo()
+	_ = db.storeCycleRun(&cycleRun{
+		ASGName:   "cat-theatre-napkin-hose",
+		BatchSize: 3,
+		State:     cycleStateDraining,
+	})
+
+	c := newCycler(db, shushLog, newTestAutoScalingService(nil), time.Hour)
+	c.running["cat-theatre-napkin-hose"] = true
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/cycles",
+		bytes.NewBufferString(`{"asg":"cat-theatre-napkin-hose","batch_size":2}`))
+	newCyclesHandlerFunc(shushLog, c)(w, r)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "batch size 3")
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/cycles",
+		bytes.NewBufferString(`{"asg":"cat-theatre-napkin-hose"}`))
+	newCyclesHandlerFunc(shushLog, c)(w, r)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Contains(t, w.Body.String(), `"batch_size": 3`)
+}
@@ -1,6 +1,7 @@
 package cyclist
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"sort"
@@ -16,6 +17,26 @@ var (
 	errEmptyInstanceID = errors.New("empty instance id")
 	errEmptyEvent      = errors.New("empty event")
 	errEmptyToken      = errors.New("empty token")
+	errEmptyTopicARN   = errors.New("empty topic arn")
+	errEmptyMessageID  = errors.New("empty message id")
+	errEmptyASGName    = errors.New("empty asg name")
+	errNoInstanceState = errors.New("no instance state")
+
+	// messageHandlingTTL bounds how long a message ID stays marked as being
+	// handled, so that redeliveries are not held off for the whole message
+	// TTL when the process handling it dies
+	messageHandlingTTL = 5 * time.Minute
+)
+
+const (
+	// redisUnlockScript deletes the lock at KEYS[1] only while it is still
+	// held by the owner in ARGV[1]
+	redisUnlockScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`
+)
+
+const (
+	messageStateHandling = "handling"
+	messageStateHandled  = "handled"
 )
 
 type redisConnGetter interface {
@@ -27,29 +48,89 @@ type repo interface {
 	fetchInstanceState(instanceID string) (string, error)
 	wipeInstanceState(instanceID string) error
 
+	storeInstanceProtection(instanceID string, protected bool) error
+	fetchInstanceProtection(instanceID string) (bool, error)
+
 	storeInstanceEvent(instanceID, event string) error
 	fetchInstanceEvent(instanceID, event string) (*lifecycleEvent, error)
 	fetchInstanceEvents(instanceID string) ([]*lifecycleEvent, error)
 	fetchAllInstanceEvents() (map[string][]*lifecycleEvent, error)
 
 	storeInstanceLifecycleAction(la *lifecycleAction) error
-	fetchInstanceLifecycleAction(transition, instanceID string) (*lifecycleAction, error)
-	completeInstanceLifecycleAction(transition, instanceID string) error
+	fetchInstanceLifecycleActions(transition, instanceID string) ([]*lifecycleAction, error)
+	completeInstanceLifecycleAction(transition, instanceID, hookName string) error
+	expireInstanceLifecycleAction(transition, instanceID, hookName string) error
+	fetchPendingLifecycleActions(transition string) ([]*lifecycleAction, error)
+
+	storeInstanceLastTransition(instanceID, transition string, ts time.Time) error
+	fetchInstanceLastTransition(instanceID string) (*instanceTransition, error)
 
 	storeInstanceToken(instanceID, token string) error
 	storeTempInstanceToken(instanceID, token string) error
 	fetchInstanceToken(instanceID string) (string, error)
 	fetchTempInstanceToken(instanceID string) (string, error)
+
+	storeSNSSubscriptionState(topicARN, state string) error
+	fetchSNSSubscriptions() ([]*snsSubscription, error)
+
+	markMessageHandling(messageID string) (string, error)
+	markMessageHandled(messageID string) error
+	forgetMessage(messageID string) error
+
+	storeCycleRun(run *cycleRun) error
+	fetchCycleRun(asgName string) (*cycleRun, error)
+	fetchCycleRuns() ([]*cycleRun, error)
+	lockCycleRun(asgName, owner string, ttl time.Duration) (bool, error)
+	unlockCycleRun(asgName, owner string) error
 }
 
 type redisRepo struct {
 	cg  redisConnGetter
 	log logrus.FieldLogger
 
+	// now stamps events and subscription states, and defaults to time.Now,
+	// while redis expires keys by its own clock
+	now func() time.Time
+
 	instEventTTL           uint
 	instLifecycleActionTTL uint
 	instTempTokTTL         uint
 	instTokTTL             uint
+	messageTTL             uint
+
+	// hashTags wraps instance IDs in keys in hash tags, and the namespace of
+	// keys written together that are not per instance, so that keys written
+	// in the same transaction share a Redis Cluster slot
+	hashTags bool
+}
+
+func (rr *redisRepo) timeNow() time.Time {
+	if rr.now == nil {
+		return time.Now()
+	}
+	return rr.now()
+}
+
+// tag wraps an instance ID in a hash tag when hash tags are enabled
+func (rr *redisRepo) tag(instanceID string) string {
+	if !rr.hashTags {
+		return instanceID
+	}
+	return fmt.Sprintf("{%s}", instanceID)
+}
+
+// untag returns the instance ID from a key part written with tag
+func (rr *redisRepo) untag(keyPart string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(keyPart, "{"), "}")
+}
+
+// namespace is the namespace of keys written together that are not per
+// instance, in a hash tag when hash tags are enabled
+func (rr *redisRepo) namespace() string {
+	if !rr.hashTags {
+		return RedisNamespace
+	}
+	return fmt.Sprintf("{%s}", RedisNamespace)
 }
 
 func (rr *redisRepo) setInstanceState(instanceID, state string) error {
@@ -57,7 +138,7 @@ func (rr *redisRepo) setInstanceState(instanceID, state string) error {
 		return errEmptyInstanceID
 	}
 
-	instanceStateKey := fmt.Sprintf("%s:instance:%s:state", RedisNamespace, instanceID)
+	instanceStateKey := fmt.Sprintf("%s:instance:%s:state", RedisNamespace, rr.tag(instanceID))
 	conn := rr.cg.Get()
 	defer rr.closeConn(conn)
 	_, err := conn.Do("SET", instanceStateKey, state)
@@ -71,8 +152,12 @@ func (rr *redisRepo) fetchInstanceState(instanceID string) (string, error) {
 
 	conn := rr.cg.Get()
 	defer rr.closeConn(conn)
-	return redis.String(conn.Do("GET",
-		fmt.Sprintf("%s:instance:%s:state", RedisNamespace, instanceID)))
+	state, err := redis.String(conn.Do("GET",
+		fmt.Sprintf("%s:instance:%s:state", RedisNamespace, rr.tag(instanceID))))
+	if err == redis.ErrNil {
+		return "", errNoInstanceState
+	}
+	return state, err
 }
 
 func (rr *redisRepo) wipeInstanceState(instanceID string) error {
@@ -83,10 +168,38 @@ func (rr *redisRepo) wipeInstanceState(instanceID string) error {
 	conn := rr.cg.Get()
 	defer rr.closeConn(conn)
 	_, err := conn.Do("DEL",
-		fmt.Sprintf("%s:instance:%s:state", RedisNamespace, instanceID))
+		fmt.Sprintf("%s:instance:%s:state", RedisNamespace, rr.tag(instanceID)),
+		fmt.Sprintf("%s:instance:%s:protected", RedisNamespace, rr.tag(instanceID)))
+	return err
+}
+
+func (rr *redisRepo) storeInstanceProtection(instanceID string, protected bool) error {
+	if strings.TrimSpace(instanceID) == "" {
+		return errEmptyInstanceID
+	}
+
+	conn := rr.cg.Get()
+	defer rr.closeConn(conn)
+	_, err := conn.Do("SET",
+		fmt.Sprintf("%s:instance:%s:protected", RedisNamespace, rr.tag(instanceID)), protected)
 	return err
 }
 
+func (rr *redisRepo) fetchInstanceProtection(instanceID string) (bool, error) {
+	if strings.TrimSpace(instanceID) == "" {
+		return false, errEmptyInstanceID
+	}
+
+	conn := rr.cg.Get()
+	defer rr.closeConn(conn)
+	protected, err := redis.Bool(conn.Do("GET",
+		fmt.Sprintf("%s:instance:%s:protected", RedisNamespace, rr.tag(instanceID))))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	return protected, err
+}
+
 func (rr *redisRepo) storeInstanceEvent(instanceID, event string) error {
 	if strings.TrimSpace(instanceID) == "" {
 		return errEmptyInstanceID
@@ -96,15 +209,15 @@ func (rr *redisRepo) storeInstanceEvent(instanceID, event string) error {
 		return errEmptyEvent
 	}
 
-	return rr.hsetex(fmt.Sprintf("%s:instance:%s:events", RedisNamespace, instanceID),
-		event, time.Now().UTC().Format(time.RFC3339Nano), rr.instEventTTL)
+	return rr.hsetex(fmt.Sprintf("%s:instance:%s:events", RedisNamespace, rr.tag(instanceID)),
+		event, rr.timeNow().UTC().Format(time.RFC3339Nano), rr.instEventTTL)
 }
 
 func (rr *redisRepo) fetchInstanceEvent(instanceID, event string) (*lifecycleEvent, error) {
 	conn := rr.cg.Get()
 	defer rr.closeConn(conn)
 
-	ts, err := redis.String(conn.Do("HGET", fmt.Sprintf("%s:instance:%s:events", RedisNamespace, instanceID), event))
+	ts, err := redis.String(conn.Do("HGET", fmt.Sprintf("%s:instance:%s:events", RedisNamespace, rr.tag(instanceID)), event))
 	if err != nil {
 		return nil, err
 	}
@@ -128,7 +241,7 @@ func (rr *redisRepo) fetchInstanceEventsWithConn(conn redis.Conn, instanceID str
 		return nil, errEmptyInstanceID
 	}
 
-	raw, err := redis.StringMap(conn.Do("HGETALL", fmt.Sprintf("%s:instance:%s:events", RedisNamespace, instanceID)))
+	raw, err := redis.StringMap(conn.Do("HGETALL", fmt.Sprintf("%s:instance:%s:events", RedisNamespace, rr.tag(instanceID))))
 	if err != nil {
 		return nil, err
 	}
@@ -170,7 +283,7 @@ func (rr *redisRepo) fetchAllInstanceEvents() (map[string][]*lifecycleEvent, err
 			return nil, fmt.Errorf("invalid events key %q", key)
 		}
 
-		instanceID := keyParts[2]
+		instanceID := rr.untag(keyParts[2])
 		events, err := rr.fetchInstanceEventsWithConn(conn, instanceID)
 		if err != nil {
 			return nil, err
@@ -239,8 +352,7 @@ func (rr *redisRepo) scanKeysPattern(pattern string) ([]string, error) {
 
 func (rr *redisRepo) storeInstanceLifecycleAction(a *lifecycleAction) error {
 	if a.LifecycleTransition == "" || a.EC2InstanceID == "" ||
-		a.LifecycleActionToken == "" || a.AutoScalingGroupName == "" ||
-		a.LifecycleHookName == "" {
+		a.AutoScalingGroupName == "" || a.LifecycleHookName == "" {
 		return fmt.Errorf("missing required fields in lifecycle action: %+v", a)
 	}
 
@@ -253,7 +365,14 @@ func (rr *redisRepo) storeInstanceLifecycleAction(a *lifecycleAction) error {
 	}
 
 	transition := a.Transition()
-	hashKey := fmt.Sprintf("%s:instance_%s:%s", RedisNamespace, transition, a.EC2InstanceID)
+	hashKey := fmt.Sprintf("%s:instance_%s:%s:%s", RedisNamespace, transition, rr.tag(a.EC2InstanceID), a.LifecycleHookName)
+	hooksKey := fmt.Sprintf("%s:instance_%s_hooks:%s", RedisNamespace, transition, rr.tag(a.EC2InstanceID))
+
+	err = conn.Send("DEL", hashKey)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
 
 	hmSet := []interface{}{
 		hashKey,
@@ -262,6 +381,14 @@ func (rr *redisRepo) storeInstanceLifecycleAction(a *lifecycleAction) error {
 		"lifecycle_hook_name", a.LifecycleHookName,
 	}
 
+	if a.Origin != "" {
+		hmSet = append(hmSet, "origin", a.Origin)
+	}
+
+	if a.Destination != "" {
+		hmSet = append(hmSet, "destination", a.Destination)
+	}
+
 	err = conn.Send("HMSET", hmSet...)
 	if err != nil {
 		conn.Do("DISCARD")
@@ -274,11 +401,26 @@ func (rr *redisRepo) storeInstanceLifecycleAction(a *lifecycleAction) error {
 		return err
 	}
 
+	err = conn.Send("SADD", hooksKey, a.LifecycleHookName)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	err = conn.Send("EXPIRE", hooksKey, rr.instLifecycleActionTTL)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
 	_, err = conn.Do("EXEC")
 	return err
 }
 
-func (rr *redisRepo) fetchInstanceLifecycleAction(transition, instanceID string) (*lifecycleAction, error) {
+// fetchInstanceLifecycleActions returns the lifecycle actions of every hook
+// for the transition, falling back to the single action per transition stored
+// by earlier versions
+func (rr *redisRepo) fetchInstanceLifecycleActions(transition, instanceID string) ([]*lifecycleAction, error) {
 	if strings.TrimSpace(instanceID) == "" {
 		return nil, errEmptyInstanceID
 	}
@@ -286,7 +428,42 @@ func (rr *redisRepo) fetchInstanceLifecycleAction(transition, instanceID string)
 	conn := rr.cg.Get()
 	defer rr.closeConn(conn)
 
-	attrs, err := redis.Values(conn.Do("HGETALL", fmt.Sprintf("%s:instance_%s:%s", RedisNamespace, transition, instanceID)))
+	hookNames, err := redis.Strings(conn.Do("SMEMBERS",
+		fmt.Sprintf("%s:instance_%s_hooks:%s", RedisNamespace, transition, rr.tag(instanceID))))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(hookNames)
+
+	hashKeys := []string{}
+	for _, hookName := range hookNames {
+		hashKeys = append(hashKeys,
+			fmt.Sprintf("%s:instance_%s:%s:%s", RedisNamespace, transition, rr.tag(instanceID), hookName))
+	}
+
+	if len(hashKeys) == 0 {
+		hashKeys = append(hashKeys,
+			fmt.Sprintf("%s:instance_%s:%s", RedisNamespace, transition, rr.tag(instanceID)))
+	}
+
+	res := []*lifecycleAction{}
+	for _, hashKey := range hashKeys {
+		la, err := rr.fetchLifecycleActionWithConn(conn, hashKey, transition, instanceID)
+		if err != nil {
+			return nil, err
+		}
+
+		if la != nil {
+			res = append(res, la)
+		}
+	}
+
+	return res, nil
+}
+
+func (rr *redisRepo) fetchLifecycleActionWithConn(conn redis.Conn, hashKey, transition, instanceID string) (*lifecycleAction, error) {
+	attrs, err := redis.Values(conn.Do("HGETALL", hashKey))
 	if err != nil {
 		return nil, err
 	}
@@ -306,7 +483,15 @@ func (rr *redisRepo) fetchInstanceLifecycleAction(transition, instanceID string)
 	return ala, nil
 }
 
-func (rr *redisRepo) completeInstanceLifecycleAction(transition, instanceID string) error {
+func (rr *redisRepo) completeInstanceLifecycleAction(transition, instanceID, hookName string) error {
+	return rr.setInstanceLifecycleActionBits(transition, instanceID, hookName, "completed")
+}
+
+func (rr *redisRepo) expireInstanceLifecycleAction(transition, instanceID, hookName string) error {
+	return rr.setInstanceLifecycleActionBits(transition, instanceID, hookName, "completed", "expired")
+}
+
+func (rr *redisRepo) setInstanceLifecycleActionBits(transition, instanceID, hookName string, bits ...string) error {
 	if strings.TrimSpace(instanceID) == "" {
 		return errEmptyInstanceID
 	}
@@ -314,12 +499,124 @@ func (rr *redisRepo) completeInstanceLifecycleAction(transition, instanceID stri
 	conn := rr.cg.Get()
 	defer rr.closeConn(conn)
 
-	_, err := conn.Do("HSET",
-		fmt.Sprintf("%s:instance_%s:%s", RedisNamespace, transition, instanceID),
-		"completed", true)
+	for _, hashKey := range []string{
+		fmt.Sprintf("%s:instance_%s:%s:%s", RedisNamespace, transition, rr.tag(instanceID), hookName),
+		fmt.Sprintf("%s:instance_%s:%s", RedisNamespace, transition, rr.tag(instanceID)),
+	} {
+		exists, err := redis.Bool(conn.Do("EXISTS", hashKey))
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			continue
+		}
+
+		hSet := []interface{}{hashKey}
+		for _, bit := range bits {
+			hSet = append(hSet, bit, true)
+		}
+
+		_, err = conn.Do("HMSET", hSet...)
+		return err
+	}
+
+	return fmt.Errorf("no lifecycle action found for transition '%s', instance ID '%s', hook '%s'",
+		transition, instanceID, hookName)
+}
+
+func (rr *redisRepo) fetchPendingLifecycleActions(transition string) ([]*lifecycleAction, error) {
+	keys, err := rr.scanKeysPattern(fmt.Sprintf("%s:instance_%s:*", RedisNamespace, transition))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(keys)
+
+	conn := rr.cg.Get()
+	defer rr.closeConn(conn)
+
+	res := []*lifecycleAction{}
+	for _, key := range keys {
+		keyParts := strings.Split(key, ":")
+		if len(keyParts) != 3 && len(keyParts) != 4 {
+			return nil, fmt.Errorf("invalid lifecycle action key %q", key)
+		}
+
+		la, err := rr.fetchLifecycleActionWithConn(conn, key, transition, rr.untag(keyParts[2]))
+		if err != nil {
+			return nil, err
+		}
+
+		if la == nil || la.Completed {
+			continue
+		}
+
+		res = append(res, la)
+	}
+
+	return res, nil
+}
+
+func (rr *redisRepo) storeInstanceLastTransition(instanceID, transition string, ts time.Time) error {
+	if strings.TrimSpace(instanceID) == "" {
+		return errEmptyInstanceID
+	}
+
+	conn := rr.cg.Get()
+	defer rr.closeConn(conn)
+
+	err := conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+
+	hashKey := fmt.Sprintf("%s:instance:%s:last_transition", RedisNamespace, rr.tag(instanceID))
+
+	err = conn.Send("HMSET", hashKey,
+		"transition", transition,
+		"time", ts.UTC().Format(time.RFC3339Nano))
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	err = conn.Send("EXPIRE", hashKey, rr.instLifecycleActionTTL)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	_, err = conn.Do("EXEC")
 	return err
 }
 
+func (rr *redisRepo) fetchInstanceLastTransition(instanceID string) (*instanceTransition, error) {
+	if strings.TrimSpace(instanceID) == "" {
+		return nil, errEmptyInstanceID
+	}
+
+	conn := rr.cg.Get()
+	defer rr.closeConn(conn)
+
+	raw, err := redis.StringMap(conn.Do("HGETALL",
+		fmt.Sprintf("%s:instance:%s:last_transition", RedisNamespace, rr.tag(instanceID))))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	ts, err := time.Parse(time.RFC3339Nano, raw["time"])
+	if err != nil {
+		return nil, err
+	}
+
+	return &instanceTransition{Transition: raw["transition"], Time: ts}, nil
+}
+
 func (rr *redisRepo) storeInstanceToken(instanceID, token string) error {
 	return rr.storeInstanceTokenfTTL("%s:instance:%s:token", instanceID, token, rr.instTokTTL)
 }
@@ -343,7 +640,7 @@ func (rr *redisRepo) storeInstanceTokenfTTL(fmtString, instanceID, token string,
 	defer rr.closeConn(conn)
 
 	_, err := conn.Do("SETEX",
-		fmt.Sprintf(fmtString, RedisNamespace, instanceID), ttl, token)
+		fmt.Sprintf(fmtString, RedisNamespace, rr.tag(instanceID)), ttl, token)
 	return err
 }
 
@@ -363,7 +660,7 @@ func (rr *redisRepo) fetchInstanceTokenfTTL(fmtString, instanceID string, ttl ui
 	conn := rr.cg.Get()
 	defer rr.closeConn(conn)
 
-	key := fmt.Sprintf(fmtString, RedisNamespace, instanceID)
+	key := fmt.Sprintf(fmtString, RedisNamespace, rr.tag(instanceID))
 	token, err := redis.String(conn.Do("GET", key))
 	if err != nil {
 		return "", err
@@ -383,6 +680,259 @@ func (rr *redisRepo) fetchInstanceTokenfTTL(fmtString, instanceID string, ttl ui
 	return token, nil
 }
 
+func (rr *redisRepo) storeSNSSubscriptionState(topicARN, state string) error {
+	if strings.TrimSpace(topicARN) == "" {
+		return errEmptyTopicARN
+	}
+
+	conn := rr.cg.Get()
+	defer rr.closeConn(conn)
+
+	err := conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+
+	err = conn.Send("HMSET", fmt.Sprintf("%s:sns_subscription:%s", rr.namespace(), topicARN),
+		"topic_arn", topicARN,
+		"state", state,
+		"updated_at", rr.timeNow().UTC().Format(time.RFC3339Nano))
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	err = conn.Send("SADD", fmt.Sprintf("%s:sns_subscriptions", rr.namespace()), topicARN)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func (rr *redisRepo) fetchSNSSubscriptions() ([]*snsSubscription, error) {
+	conn := rr.cg.Get()
+	defer rr.closeConn(conn)
+
+	topicARNs, err := redis.Strings(conn.Do("SMEMBERS", fmt.Sprintf("%s:sns_subscriptions", rr.namespace())))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(topicARNs)
+
+	subs := []*snsSubscription{}
+	for _, topicARN := range topicARNs {
+		attrs, err := redis.Values(conn.Do("HGETALL", fmt.Sprintf("%s:sns_subscription:%s", rr.namespace(), topicARN)))
+		if err != nil {
+			return nil, err
+		}
+
+		if len(attrs) == 0 {
+			continue
+		}
+
+		sub := &snsSubscription{}
+		err = redis.ScanStruct(attrs, sub)
+		if err != nil {
+			return nil, err
+		}
+
+		subs = append(subs, sub)
+	}
+
+	return subs, nil
+}
+
+func (rr *redisRepo) storeCycleRun(run *cycleRun) error {
+	if strings.TrimSpace(run.ASGName) == "" {
+		return errEmptyASGName
+	}
+
+	runBytes, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+
+	conn := rr.cg.Get()
+	defer rr.closeConn(conn)
+
+	err = conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+
+	err = conn.Send("SET", fmt.Sprintf("%s:cycle:%s", rr.namespace(), run.ASGName), string(runBytes))
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	err = conn.Send("SADD", fmt.Sprintf("%s:cycles", rr.namespace()), run.ASGName)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func (rr *redisRepo) fetchCycleRun(asgName string) (*cycleRun, error) {
+	if strings.TrimSpace(asgName) == "" {
+		return nil, errEmptyASGName
+	}
+
+	conn := rr.cg.Get()
+	defer rr.closeConn(conn)
+
+	return rr.fetchCycleRunWithConn(conn, asgName)
+}
+
+func (rr *redisRepo) fetchCycleRuns() ([]*cycleRun, error) {
+	conn := rr.cg.Get()
+	defer rr.closeConn(conn)
+
+	asgNames, err := redis.Strings(conn.Do("SMEMBERS", fmt.Sprintf("%s:cycles", rr.namespace())))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(asgNames)
+
+	runs := []*cycleRun{}
+	for _, asgName := range asgNames {
+		run, err := rr.fetchCycleRunWithConn(conn, asgName)
+		if err != nil {
+			return nil, err
+		}
+
+		if run == nil {
+			continue
+		}
+
+		runs = append(runs, run)
+	}
+
+	return runs, nil
+}
+
+func (rr *redisRepo) fetchCycleRunWithConn(conn redis.Conn, asgName string) (*cycleRun, error) {
+	runBytes, err := redis.Bytes(conn.Do("GET", fmt.Sprintf("%s:cycle:%s", rr.namespace(), asgName)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	run := &cycleRun{}
+	return run, json.Unmarshal(runBytes, run)
+}
+
+// lockCycleRun takes the lock on stepping the cycle run of the auto scaling
+// group for the owner, returning false if another owner holds it. The lock
+// expires after the TTL, in case its owner dies while holding it.
+func (rr *redisRepo) lockCycleRun(asgName, owner string, ttl time.Duration) (bool, error) {
+	if strings.TrimSpace(asgName) == "" {
+		return false, errEmptyASGName
+	}
+
+	conn := rr.cg.Get()
+	defer rr.closeConn(conn)
+
+	reply, err := conn.Do("SET", fmt.Sprintf("%s:cycle_lock:%s", RedisNamespace, asgName), owner,
+		"EX", uint(ttl.Seconds()), "NX")
+	if err != nil {
+		return false, err
+	}
+
+	return reply != nil, nil
+}
+
+// unlockCycleRun releases the lock on stepping the cycle run of the auto
+// scaling group, unless another owner has taken it since it expired
+func (rr *redisRepo) unlockCycleRun(asgName, owner string) error {
+	if strings.TrimSpace(asgName) == "" {
+		return errEmptyASGName
+	}
+
+	conn := rr.cg.Get()
+	defer rr.closeConn(conn)
+
+	_, err := conn.Do("EVAL", redisUnlockScript, 1,
+		fmt.Sprintf("%s:cycle_lock:%s", RedisNamespace, asgName), owner)
+	return err
+}
+
+// markMessageHandling records the message ID as being handled, unless it has
+// already been recorded, returning the state it had already been recorded in
+// or an empty string if it had not.
+func (rr *redisRepo) markMessageHandling(messageID string) (string, error) {
+	if strings.TrimSpace(messageID) == "" {
+		return "", errEmptyMessageID
+	}
+
+	conn := rr.cg.Get()
+	defer rr.closeConn(conn)
+
+	messageKey := fmt.Sprintf("%s:message:%s", RedisNamespace, messageID)
+
+	reply, err := conn.Do("SET", messageKey, messageStateHandling,
+		"EX", uint(messageHandlingTTL.Seconds()), "NX")
+	if err != nil {
+		return "", err
+	}
+
+	if reply != nil {
+		return "", nil
+	}
+
+	state, err := redis.String(conn.Do("GET", messageKey))
+	if err == redis.ErrNil {
+		// forgotten since, so redeliver rather than race the forgetter
+		return messageStateHandling, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if state != messageStateHandling {
+		// message IDs used to be recorded with the time they were seen
+		return messageStateHandled, nil
+	}
+
+	return state, nil
+}
+
+// markMessageHandled records the message ID as handled within the message TTL.
+func (rr *redisRepo) markMessageHandled(messageID string) error {
+	if strings.TrimSpace(messageID) == "" {
+		return errEmptyMessageID
+	}
+
+	conn := rr.cg.Get()
+	defer rr.closeConn(conn)
+
+	_, err := conn.Do("SET", fmt.Sprintf("%s:message:%s", RedisNamespace, messageID),
+		messageStateHandled, "EX", rr.messageTTL)
+	return err
+}
+
+func (rr *redisRepo) forgetMessage(messageID string) error {
+	if strings.TrimSpace(messageID) == "" {
+		return errEmptyMessageID
+	}
+
+	conn := rr.cg.Get()
+	defer rr.closeConn(conn)
+
+	_, err := conn.Do("DEL", fmt.Sprintf("%s:message:%s", RedisNamespace, messageID))
+	return err
+}
+
 func (rr *redisRepo) closeConn(conn redis.Conn) {
 	err := conn.Close()
 	if err != nil && rr.log != nil {
@@ -414,20 +964,3 @@ func (rr *redisRepo) hsetex(hashKey, key, value string, ttl uint) error {
 	_, err = conn.Do("EXEC")
 	return err
 }
-
-func buildRedisPool(redisURL string) redisConnGetter {
-	return &redis.Pool{
-		MaxIdle:     3,
-		IdleTimeout: time.Minute,
-		Dial: func() (redis.Conn, error) {
-			return redis.DialURL(redisURL)
-		},
-		TestOnBorrow: func(c redis.Conn, t time.Time) error {
-			if time.Since(t) < time.Minute {
-				return nil
-			}
-			_, err := c.Do("PING")
-			return err
-		},
-	}
-}
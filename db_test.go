@@ -2,8 +2,12 @@ package cyclist
 
 import (
 	"errors"
+	"fmt"
+	"os"
 	"testing"
+	"time"
 
+	"github.com/garyburd/redigo/redis"
 	"github.com/rafaeljusto/redigomock"
 	"github.com/stretchr/testify/assert"
 )
@@ -14,6 +18,89 @@ func TestRedisRepo(t *testing.T) {
 	assert.NotNil(t, conn)
 }
 
+// TestRedisRepo_Behaviours runs the shared repo behaviours against the redis
+// at CYCLIST_TEST_REDIS_URL, flushing its database, and is skipped without it
+func TestRedisRepo_Behaviours(t *testing.T) {
+	redisURL := os.Getenv("CYCLIST_TEST_REDIS_URL")
+	if redisURL == "" {
+		t.Skip("CYCLIST_TEST_REDIS_URL is not set")
+	}
+
+	pool, err := buildRedisPool(&redisPoolOptions{URL: redisURL, MaxIdle: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	for _, hashTags := range []bool{false, true} {
+		hashTags := hashTags
+		t.Run(fmt.Sprintf("hashTags=%v", hashTags), func(t *testing.T) {
+			runRepoBehaviourTests(t, func(clock *testClock) (repo, func()) {
+				flushTestRedis(t, pool)
+				clock.onAdvance = func(d time.Duration) {
+					advanceTestRedis(t, pool, d)
+				}
+
+				return &redisRepo{
+					cg:  pool,
+					now: clock.now,
+
+					instEventTTL:           uint(time.Hour.Seconds()),
+					instLifecycleActionTTL: uint(time.Hour.Seconds()),
+					instTempTokTTL:         uint(time.Minute.Seconds()),
+					instTokTTL:             uint((10 * time.Minute).Seconds()),
+					messageTTL:             uint(time.Hour.Seconds()),
+
+					hashTags: hashTags,
+				}, func() { flushTestRedis(t, pool) }
+			})
+		})
+	}
+}
+
+func flushTestRedis(t *testing.T, pool *redis.Pool) {
+	conn := pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("FLUSHDB")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// advanceTestRedis takes d off the TTL of every key, deleting those that run
+// out, as redis expires keys by its own clock rather than the test clock
+func advanceTestRedis(t *testing.T, pool *redis.Pool, d time.Duration) {
+	conn := pool.Get()
+	defer conn.Close()
+
+	keys, err := redis.Strings(conn.Do("KEYS", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range keys {
+		ttl, err := redis.Int64(conn.Do("PTTL", key))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ttl < 0 {
+			continue
+		}
+
+		ttl -= int64(d / time.Millisecond)
+		if ttl <= 0 {
+			_, err = conn.Do("DEL", key)
+		} else {
+			_, err = conn.Do("PEXPIRE", key, ttl)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
 func TestRedisRepo_setInstanceState(t *testing.T) {
 	rr := &redisRepo{cg: &testRedisConnGetter{}}
 
@@ -42,6 +129,16 @@ func TestRedisRepo_fetchInstanceState(t *testing.T) {
 	assert.Equal(t, "catatonia", state)
 }
 
+func TestRedisRepo_fetchInstanceState_WithNoState(t *testing.T) {
+	rr := &redisRepo{cg: &testRedisConnGetter{}}
+
+	conn := rr.cg.Get().(*redigomock.Conn)
+	conn.Command("GET", "cyclist:instance:i-fafafaf:state").Expect(nil)
+
+	_, err := rr.fetchInstanceState("i-fafafaf")
+	assert.Equal(t, errNoInstanceState, err)
+}
+
 func TestRedisRepo_fetchInstanceState_WithEmptyInstanceID(t *testing.T) {
 	rr := &redisRepo{cg: &testRedisConnGetter{}}
 
@@ -54,12 +151,34 @@ func TestRedisRepo_wipeInstanceState(t *testing.T) {
 	rr := &redisRepo{cg: &testRedisConnGetter{}}
 
 	conn := rr.cg.Get().(*redigomock.Conn)
-	conn.Command("DEL", "cyclist:instance:i-fafafaf:state").Expect("OK!")
+	conn.Command("DEL", "cyclist:instance:i-fafafaf:state",
+		"cyclist:instance:i-fafafaf:protected").Expect("OK!")
 
 	err := rr.wipeInstanceState("i-fafafaf")
 	assert.Nil(t, err)
 }
 
+func TestRedisRepo_storeInstanceProtection(t *testing.T) {
+	rr := &redisRepo{cg: &testRedisConnGetter{}}
+
+	conn := rr.cg.Get().(*redigomock.Conn)
+	conn.Command("SET", "cyclist:instance:i-fafafaf:protected", true).Expect("OK!")
+
+	err := rr.storeInstanceProtection("i-fafafaf", true)
+	assert.Nil(t, err)
+}
+
+func TestRedisRepo_fetchInstanceProtection(t *testing.T) {
+	rr := &redisRepo{cg: &testRedisConnGetter{}}
+
+	conn := rr.cg.Get().(*redigomock.Conn)
+	conn.Command("GET", "cyclist:instance:i-fafafaf:protected").Expect([]byte("1"))
+
+	protected, err := rr.fetchInstanceProtection("i-fafafaf")
+	assert.Nil(t, err)
+	assert.True(t, protected)
+}
+
 func TestRedisRepo_wipeInstanceState_WithEmptyInstanceID(t *testing.T) {
 	rr := &redisRepo{cg: &testRedisConnGetter{}}
 
@@ -125,11 +244,14 @@ func TestRedisRepo_storeInstanceLifecycleAction(t *testing.T) {
 
 	conn := rr.cg.Get().(*redigomock.Conn)
 	conn.Command("MULTI").Expect("OK!")
-	conn.Command("HMSET", "cyclist:instance_loathing:i-fafafaf",
+	conn.Command("DEL", "cyclist:instance_loathing:i-fafafaf:frazzled-top-zipper").Expect(int64(1))
+	conn.Command("HMSET", "cyclist:instance_loathing:i-fafafaf:frazzled-top-zipper",
 		"lifecycle_action_token", "TOKEYTOKETOK",
 		"auto_scaling_group_name", "menial-jar-legs",
 		"lifecycle_hook_name", "frazzled-top-zipper").Expect("OK!")
-	conn.Command("EXPIRE", "cyclist:instance_loathing:i-fafafaf", uint(42)).Expect("OK!")
+	conn.Command("EXPIRE", "cyclist:instance_loathing:i-fafafaf:frazzled-top-zipper", uint(42)).Expect("OK!")
+	conn.Command("SADD", "cyclist:instance_loathing_hooks:i-fafafaf", "frazzled-top-zipper").Expect(int64(1))
+	conn.Command("EXPIRE", "cyclist:instance_loathing_hooks:i-fafafaf", uint(42)).Expect("OK!")
 	conn.Command("EXEC").Expect("OK!")
 
 	err := rr.storeInstanceLifecycleAction(&lifecycleAction{
@@ -143,6 +265,36 @@ func TestRedisRepo_storeInstanceLifecycleAction(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestRedisRepo_storeInstanceLifecycleAction_WithWarmPool(t *testing.T) {
+	rr := &redisRepo{cg: &testRedisConnGetter{}, instLifecycleActionTTL: uint(42)}
+
+	conn := rr.cg.Get().(*redigomock.Conn)
+	conn.Command("MULTI").Expect("OK!")
+	conn.Command("DEL", "cyclist:instance_launching:i-fafafaf:frazzled-top-zipper").Expect(int64(1))
+	conn.Command("HMSET", "cyclist:instance_launching:i-fafafaf:frazzled-top-zipper",
+		"lifecycle_action_token", "TOKEYTOKETOK",
+		"auto_scaling_group_name", "menial-jar-legs",
+		"lifecycle_hook_name", "frazzled-top-zipper",
+		"origin", "EC2",
+		"destination", "WarmPool").Expect("OK!")
+	conn.Command("EXPIRE", "cyclist:instance_launching:i-fafafaf:frazzled-top-zipper", uint(42)).Expect("OK!")
+	conn.Command("SADD", "cyclist:instance_launching_hooks:i-fafafaf", "frazzled-top-zipper").Expect(int64(1))
+	conn.Command("EXPIRE", "cyclist:instance_launching_hooks:i-fafafaf", uint(42)).Expect("OK!")
+	conn.Command("EXEC").Expect("OK!")
+
+	err := rr.storeInstanceLifecycleAction(&lifecycleAction{
+		LifecycleTransition:  "autoscaling:EC2_INSTANCE_LAUNCHING",
+		EC2InstanceID:        "i-fafafaf",
+		LifecycleActionToken: "TOKEYTOKETOK",
+		AutoScalingGroupName: "menial-jar-legs",
+		LifecycleHookName:    "frazzled-top-zipper",
+		Origin:               "EC2",
+		Destination:          "WarmPool",
+	})
+
+	assert.Nil(t, err)
+}
+
 func TestRedisRepo_storeInstanceLifecycleAction_WithInvalidLifecycleAction(t *testing.T) {
 	rr := &redisRepo{cg: &testRedisConnGetter{}}
 	err := rr.storeInstanceLifecycleAction(&lifecycleAction{})
@@ -172,11 +324,12 @@ func TestRedisRepo_storeInstanceLifecycleAction_WithFailedHmset(t *testing.T) {
 
 	conn := rr.cg.Get().(*redigomock.Conn)
 	conn.Command("MULTI").Expect("OK!")
-	conn.Command("HMSET", "cyclist:instance_loathing:i-fafafaf",
+	conn.Command("DEL", "cyclist:instance_loathing:i-fafafaf:frazzled-top-zipper").Expect(int64(1))
+	conn.Command("HMSET", "cyclist:instance_loathing:i-fafafaf:frazzled-top-zipper",
 		"lifecycle_action_token", "TOKEYTOKETOK",
 		"auto_scaling_group_name", "menial-jar-legs",
 		"lifecycle_hook_name", "frazzled-top-zipper").ExpectError(errors.New("no hmm sets"))
-	conn.Command("EXPIRE", "cyclist:instance_loathing:i-fafafaf", uint(42)).Expect("OK!")
+	conn.Command("EXPIRE", "cyclist:instance_loathing:i-fafafaf:frazzled-top-zipper", uint(42)).Expect("OK!")
 	conn.Command("DISCARD").Expect("OK!")
 
 	err := rr.storeInstanceLifecycleAction(&lifecycleAction{
@@ -196,11 +349,14 @@ func TestRedisRepo_storeInstanceLifecycleAction_WithFailedExec(t *testing.T) {
 
 	conn := rr.cg.Get().(*redigomock.Conn)
 	conn.Command("MULTI").Expect("OK!")
-	conn.Command("HMSET", "cyclist:instance_loathing:i-fafafaf",
+	conn.Command("DEL", "cyclist:instance_loathing:i-fafafaf:frazzled-top-zipper").Expect(int64(1))
+	conn.Command("HMSET", "cyclist:instance_loathing:i-fafafaf:frazzled-top-zipper",
 		"lifecycle_action_token", "TOKEYTOKETOK",
 		"auto_scaling_group_name", "menial-jar-legs",
 		"lifecycle_hook_name", "frazzled-top-zipper").Expect("OK!")
-	conn.Command("EXPIRE", "cyclist:instance_loathing:i-fafafaf", uint(42)).Expect("OK!")
+	conn.Command("EXPIRE", "cyclist:instance_loathing:i-fafafaf:frazzled-top-zipper", uint(42)).Expect("OK!")
+	conn.Command("SADD", "cyclist:instance_loathing_hooks:i-fafafaf", "frazzled-top-zipper").Expect(int64(1))
+	conn.Command("EXPIRE", "cyclist:instance_loathing_hooks:i-fafafaf", uint(42)).Expect("OK!")
 	conn.Command("EXEC").ExpectError(errors.New("not exectly"))
 
 	err := rr.storeInstanceLifecycleAction(&lifecycleAction{
@@ -215,45 +371,90 @@ func TestRedisRepo_storeInstanceLifecycleAction_WithFailedExec(t *testing.T) {
 	assert.Equal(t, "not exectly", err.Error())
 }
 
-func TestRedisRepo_fetchInstanceLifecycleAction(t *testing.T) {
+func TestRedisRepo_fetchInstanceLifecycleActions(t *testing.T) {
 	rr := &redisRepo{cg: &testRedisConnGetter{}}
 
 	conn := rr.cg.Get().(*redigomock.Conn)
-	conn.Command("SISMEMBER", "cyclist:instance_larping", "i-fafafaf").Expect(int64(1))
+	conn.Command("SMEMBERS", "cyclist:instance_larping_hooks:i-fafafaf").Expect([]interface{}{
+		[]byte("frazzled-top-zipper"),
+		[]byte("bedazzled-pants-button"),
+	})
+	conn.Command("HGETALL", "cyclist:instance_larping:i-fafafaf:frazzled-top-zipper").ExpectMap(map[string]string{
+		"lifecycle_action_token":  "TOKEYTOKETOK",
+		"auto_scaling_group_name": "menial-jar-legs",
+		"lifecycle_hook_name":     "frazzled-top-zipper",
+	})
+	conn.Command("HGETALL", "cyclist:instance_larping:i-fafafaf:bedazzled-pants-button").ExpectMap(map[string]string{
+		"lifecycle_action_token":  "TOKEYTOKETOKEN",
+		"auto_scaling_group_name": "menial-jar-legs",
+		"lifecycle_hook_name":     "bedazzled-pants-button",
+		"completed":               "1",
+	})
+
+	las, err := rr.fetchInstanceLifecycleActions("larping", "i-fafafaf")
+	assert.Nil(t, err)
+	assert.Equal(t, []*lifecycleAction{
+		{
+			LifecycleTransition:  "autoscaling:EC2_INSTANCE_LARPING",
+			EC2InstanceID:        "i-fafafaf",
+			LifecycleActionToken: "TOKEYTOKETOKEN",
+			AutoScalingGroupName: "menial-jar-legs",
+			LifecycleHookName:    "bedazzled-pants-button",
+			Completed:            true,
+		},
+		{
+			LifecycleTransition:  "autoscaling:EC2_INSTANCE_LARPING",
+			EC2InstanceID:        "i-fafafaf",
+			LifecycleActionToken: "TOKEYTOKETOK",
+			AutoScalingGroupName: "menial-jar-legs",
+			LifecycleHookName:    "frazzled-top-zipper",
+		},
+	}, las)
+}
+
+func TestRedisRepo_fetchInstanceLifecycleActions_WithLegacyKey(t *testing.T) {
+	rr := &redisRepo{cg: &testRedisConnGetter{}}
+
+	conn := rr.cg.Get().(*redigomock.Conn)
+	conn.Command("SMEMBERS", "cyclist:instance_larping_hooks:i-fafafaf").Expect([]interface{}{})
 	conn.Command("HGETALL", "cyclist:instance_larping:i-fafafaf").ExpectMap(map[string]string{
 		"lifecycle_action_token":  "TOKEYTOKETOK",
 		"auto_scaling_group_name": "menial-jar-legs",
 		"lifecycle_hook_name":     "frazzled-top-zipper",
 	})
 
-	la, err := rr.fetchInstanceLifecycleAction("larping", "i-fafafaf")
+	las, err := rr.fetchInstanceLifecycleActions("larping", "i-fafafaf")
 	assert.Nil(t, err)
-	assert.Equal(t, &lifecycleAction{
-		LifecycleTransition:  "autoscaling:EC2_INSTANCE_LARPING",
-		EC2InstanceID:        "i-fafafaf",
-		LifecycleActionToken: "TOKEYTOKETOK",
-		AutoScalingGroupName: "menial-jar-legs",
-		LifecycleHookName:    "frazzled-top-zipper",
-	}, la)
+	assert.Equal(t, []*lifecycleAction{
+		{
+			LifecycleTransition:  "autoscaling:EC2_INSTANCE_LARPING",
+			EC2InstanceID:        "i-fafafaf",
+			LifecycleActionToken: "TOKEYTOKETOK",
+			AutoScalingGroupName: "menial-jar-legs",
+			LifecycleHookName:    "frazzled-top-zipper",
+		},
+	}, las)
 }
 
-func TestRedisRepo_fetchInstanceLifecycleAction_WithEmptyInstanceID(t *testing.T) {
+func TestRedisRepo_fetchInstanceLifecycleActions_WithEmptyInstanceID(t *testing.T) {
 	rr := &redisRepo{cg: &testRedisConnGetter{}}
 
-	la, err := rr.fetchInstanceLifecycleAction("looming", "")
+	las, err := rr.fetchInstanceLifecycleActions("looming", "")
 	assert.NotNil(t, err)
-	assert.Nil(t, la)
+	assert.Nil(t, las)
 }
 
-func TestRedisRepo_fetchInstanceLifecycleAction_WithFailedHgetall(t *testing.T) {
+func TestRedisRepo_fetchInstanceLifecycleActions_WithFailedHgetall(t *testing.T) {
 	rr := &redisRepo{cg: &testRedisConnGetter{}}
 
 	conn := rr.cg.Get().(*redigomock.Conn)
-	conn.Command("SISMEMBER", "cyclist:instance_larping", "i-fafafaf").Expect(int64(1))
-	conn.Command("HGETALL", "cyclist:instance_larping:i-fafafaf").ExpectError(errors.New("not so getall"))
+	conn.Command("SMEMBERS", "cyclist:instance_larping_hooks:i-fafafaf").Expect([]interface{}{
+		[]byte("frazzled-top-zipper"),
+	})
+	conn.Command("HGETALL", "cyclist:instance_larping:i-fafafaf:frazzled-top-zipper").ExpectError(errors.New("not so getall"))
 
-	la, err := rr.fetchInstanceLifecycleAction("larping", "i-fafafaf")
-	assert.Nil(t, la)
+	las, err := rr.fetchInstanceLifecycleActions("larping", "i-fafafaf")
+	assert.Nil(t, las)
 	assert.NotNil(t, err)
 	assert.Equal(t, "not so getall", err.Error())
 }
@@ -262,16 +463,52 @@ func TestRedisRepo_completeInstanceLifecycleAction(t *testing.T) {
 	rr := &redisRepo{cg: &testRedisConnGetter{}}
 
 	conn := rr.cg.Get().(*redigomock.Conn)
-	conn.Command("HSET", "cyclist:instance_fuming:i-fafafaf", "completed", true).Expect("OK!")
+	conn.Command("EXISTS", "cyclist:instance_fuming:i-fafafaf:frazzled-top-zipper").Expect(int64(1))
+	conn.Command("HMSET", "cyclist:instance_fuming:i-fafafaf:frazzled-top-zipper", "completed", true).Expect("OK!")
+
+	err := rr.completeInstanceLifecycleAction("fuming", "i-fafafaf", "frazzled-top-zipper")
+	assert.Nil(t, err)
+}
+
+func TestRedisRepo_completeInstanceLifecycleAction_WithLegacyKey(t *testing.T) {
+	rr := &redisRepo{cg: &testRedisConnGetter{}}
+
+	conn := rr.cg.Get().(*redigomock.Conn)
+	conn.Command("EXISTS", "cyclist:instance_fuming:i-fafafaf:frazzled-top-zipper").Expect(int64(0))
+	conn.Command("EXISTS", "cyclist:instance_fuming:i-fafafaf").Expect(int64(1))
+	conn.Command("HMSET", "cyclist:instance_fuming:i-fafafaf", "completed", true).Expect("OK!")
+
+	err := rr.completeInstanceLifecycleAction("fuming", "i-fafafaf", "frazzled-top-zipper")
+	assert.Nil(t, err)
+}
+
+func TestRedisRepo_completeInstanceLifecycleAction_WithMissingAction(t *testing.T) {
+	rr := &redisRepo{cg: &testRedisConnGetter{}}
+
+	conn := rr.cg.Get().(*redigomock.Conn)
+	conn.Command("EXISTS", "cyclist:instance_fuming:i-fafafaf:frazzled-top-zipper").Expect(int64(0))
+	conn.Command("EXISTS", "cyclist:instance_fuming:i-fafafaf").Expect(int64(0))
+
+	err := rr.completeInstanceLifecycleAction("fuming", "i-fafafaf", "frazzled-top-zipper")
+	assert.NotNil(t, err)
+}
+
+func TestRedisRepo_expireInstanceLifecycleAction(t *testing.T) {
+	rr := &redisRepo{cg: &testRedisConnGetter{}}
+
+	conn := rr.cg.Get().(*redigomock.Conn)
+	conn.Command("EXISTS", "cyclist:instance_fuming:i-fafafaf:frazzled-top-zipper").Expect(int64(1))
+	conn.Command("HMSET", "cyclist:instance_fuming:i-fafafaf:frazzled-top-zipper",
+		"completed", true, "expired", true).Expect("OK!")
 
-	err := rr.completeInstanceLifecycleAction("fuming", "i-fafafaf")
+	err := rr.expireInstanceLifecycleAction("fuming", "i-fafafaf", "frazzled-top-zipper")
 	assert.Nil(t, err)
 }
 
 func TestRedisRepo_completeInstanceLifecycleAction_WithEmptyInstanceID(t *testing.T) {
 	rr := &redisRepo{cg: &testRedisConnGetter{}}
 
-	err := rr.completeInstanceLifecycleAction("fuming", "")
+	err := rr.completeInstanceLifecycleAction("fuming", "", "frazzled-top-zipper")
 	assert.NotNil(t, err)
 	assert.Equal(t, errEmptyInstanceID, err)
 }
@@ -280,9 +517,10 @@ func TestRedisRepo_completeInstanceLifecycleAction_WithFailedDel(t *testing.T) {
 	rr := &redisRepo{cg: &testRedisConnGetter{}}
 
 	conn := rr.cg.Get().(*redigomock.Conn)
-	conn.Command("HSET", "cyclist:instance_fuming:i-fafafaf", "completed", true).ExpectError(errors.New("control alt"))
+	conn.Command("EXISTS", "cyclist:instance_fuming:i-fafafaf:frazzled-top-zipper").Expect(int64(1))
+	conn.Command("HMSET", "cyclist:instance_fuming:i-fafafaf:frazzled-top-zipper", "completed", true).ExpectError(errors.New("control alt"))
 
-	err := rr.completeInstanceLifecycleAction("fuming", "i-fafafaf")
+	err := rr.completeInstanceLifecycleAction("fuming", "i-fafafaf", "frazzled-top-zipper")
 	assert.NotNil(t, err)
 	assert.Equal(t, "control alt", err.Error())
 }
@@ -329,3 +567,368 @@ func TestRedisRepo_fetchTempInstanceToken(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, "much-secret-so-token", tok)
 }
+
+func TestRedisRepo_storeSNSSubscriptionState(t *testing.T) {
+	rr := &redisRepo{cg: &testRedisConnGetter{}}
+
+	conn := rr.cg.Get().(*redigomock.Conn)
+	conn.Command("MULTI").Expect("OK!")
+	conn.Command("HMSET", "cyclist:sns_subscription:arn:aws:sns:nz-isengard-1:999999999999:toaster-pastries",
+		"topic_arn", "arn:aws:sns:nz-isengard-1:999999999999:toaster-pastries",
+		"state", "confirmed",
+		"updated_at", redigomock.NewAnyData()).Expect("OK!")
+	conn.Command("SADD", "cyclist:sns_subscriptions",
+		"arn:aws:sns:nz-isengard-1:999999999999:toaster-pastries").Expect(int64(1))
+	conn.Command("EXEC").Expect("OK!")
+
+	err := rr.storeSNSSubscriptionState("arn:aws:sns:nz-isengard-1:999999999999:toaster-pastries", "confirmed")
+	assert.Nil(t, err)
+}
+
+func TestRedisRepo_storeSNSSubscriptionState_WithEmptyTopicARN(t *testing.T) {
+	rr := &redisRepo{cg: &testRedisConnGetter{}}
+
+	err := rr.storeSNSSubscriptionState("", "confirmed")
+	assert.Equal(t, errEmptyTopicARN, err)
+}
+
+func TestRedisRepo_fetchSNSSubscriptions(t *testing.T) {
+	rr := &redisRepo{cg: &testRedisConnGetter{}}
+
+	conn := rr.cg.Get().(*redigomock.Conn)
+	conn.Command("SMEMBERS", "cyclist:sns_subscriptions").Expect([]interface{}{
+		[]byte("arn:aws:sns:nz-isengard-1:999999999999:toaster-pastries"),
+	})
+	conn.Command("HGETALL", "cyclist:sns_subscription:arn:aws:sns:nz-isengard-1:999999999999:toaster-pastries").ExpectMap(map[string]string{
+		"topic_arn":  "arn:aws:sns:nz-isengard-1:999999999999:toaster-pastries",
+		"state":      "confirmed",
+		"updated_at": "2010-09-16T09:18:23.999999999-04:00",
+	})
+
+	subs, err := rr.fetchSNSSubscriptions()
+	assert.Nil(t, err)
+	assert.Equal(t, []*snsSubscription{
+		{
+			TopicARN:  "arn:aws:sns:nz-isengard-1:999999999999:toaster-pastries",
+			State:     "confirmed",
+			UpdatedAt: "2010-09-16T09:18:23.999999999-04:00",
+		},
+	}, subs)
+}
+
+func TestRedisRepo_markMessageHandling(t *testing.T) {
+	rr := &redisRepo{cg: &testRedisConnGetter{}, messageTTL: uint(60)}
+
+	conn := rr.cg.Get().(*redigomock.Conn)
+	conn.Command("SET", "cyclist:message:c0ffee", "handling", "EX", uint(300), "NX").Expect("OK")
+
+	state, err := rr.markMessageHandling("c0ffee")
+	assert.Nil(t, err)
+	assert.Equal(t, "", state)
+}
+
+func TestRedisRepo_markMessageHandling_AlreadyHandling(t *testing.T) {
+	rr := &redisRepo{cg: &testRedisConnGetter{}, messageTTL: uint(60)}
+
+	conn := rr.cg.Get().(*redigomock.Conn)
+	conn.Command("SET", "cyclist:message:c0ffee", "handling", "EX", uint(300), "NX").Expect(nil)
+	conn.Command("GET", "cyclist:message:c0ffee").Expect([]byte("handling"))
+
+	state, err := rr.markMessageHandling("c0ffee")
+	assert.Nil(t, err)
+	assert.Equal(t, messageStateHandling, state)
+}
+
+func TestRedisRepo_markMessageHandling_AlreadyHandled(t *testing.T) {
+	for _, value := range []string{"handled", "2017-12-01T00:00:00Z"} {
+		rr := &redisRepo{cg: &testRedisConnGetter{}, messageTTL: uint(60)}
+
+		conn := rr.cg.Get().(*redigomock.Conn)
+		conn.Command("SET", "cyclist:message:c0ffee", "handling", "EX", uint(300), "NX").Expect(nil)
+		conn.Command("GET", "cyclist:message:c0ffee").Expect([]byte(value))
+
+		state, err := rr.markMessageHandling("c0ffee")
+		assert.Nil(t, err)
+		assert.Equal(t, messageStateHandled, state, value)
+	}
+}
+
+func TestRedisRepo_markMessageHandling_WithEmptyMessageID(t *testing.T) {
+	rr := &redisRepo{cg: &testRedisConnGetter{}}
+
+	_, err := rr.markMessageHandling("")
+	assert.Equal(t, errEmptyMessageID, err)
+}
+
+func TestRedisRepo_markMessageHandled(t *testing.T) {
+	rr := &redisRepo{cg: &testRedisConnGetter{}, messageTTL: uint(60)}
+
+	conn := rr.cg.Get().(*redigomock.Conn)
+	conn.Command("SET", "cyclist:message:c0ffee", "handled", "EX", uint(60)).Expect("OK")
+
+	err := rr.markMessageHandled("c0ffee")
+	assert.Nil(t, err)
+}
+
+func TestRedisRepo_forgetMessage(t *testing.T) {
+	rr := &redisRepo{cg: &testRedisConnGetter{}}
+
+	conn := rr.cg.Get().(*redigomock.Conn)
+	conn.Command("DEL", "cyclist:message:c0ffee").Expect(int64(1))
+
+	err := rr.forgetMessage("c0ffee")
+	assert.Nil(t, err)
+}
+
+func TestRedisRepo_storeInstanceLastTransition(t *testing.T) {
+	rr := &redisRepo{cg: &testRedisConnGetter{}, instLifecycleActionTTL: uint(60)}
+
+	conn := rr.cg.Get().(*redigomock.Conn)
+	conn.Command("MULTI").Expect("OK!")
+	conn.Command("HMSET", "cyclist:instance:i-fafafaf:last_transition",
+		"transition", "launching",
+		"time", "2018-01-09T19:40:50.123Z").Expect("OK!")
+	conn.Command("EXPIRE", "cyclist:instance:i-fafafaf:last_transition", uint(60)).Expect(int64(1))
+	conn.Command("EXEC").Expect("OK!")
+
+	err := rr.storeInstanceLastTransition("i-fafafaf", "launching",
+		time.Date(2018, 1, 9, 19, 40, 50, 123000000, time.UTC))
+	assert.Nil(t, err)
+}
+
+func TestRedisRepo_fetchInstanceLastTransition(t *testing.T) {
+	rr := &redisRepo{cg: &testRedisConnGetter{}}
+
+	conn := rr.cg.Get().(*redigomock.Conn)
+	conn.Command("HGETALL", "cyclist:instance:i-fafafaf:last_transition").ExpectMap(map[string]string{
+		"transition": "launching",
+		"time":       "2018-01-09T19:40:50.123Z",
+	})
+
+	it, err := rr.fetchInstanceLastTransition("i-fafafaf")
+	assert.Nil(t, err)
+	assert.Equal(t, &instanceTransition{
+		Transition: "launching",
+		Time:       time.Date(2018, 1, 9, 19, 40, 50, 123000000, time.UTC),
+	}, it)
+}
+
+func TestRedisRepo_fetchInstanceLastTransition_Missing(t *testing.T) {
+	rr := &redisRepo{cg: &testRedisConnGetter{}}
+
+	conn := rr.cg.Get().(*redigomock.Conn)
+	conn.Command("HGETALL", "cyclist:instance:i-fafafaf:last_transition").ExpectMap(map[string]string{})
+
+	it, err := rr.fetchInstanceLastTransition("i-fafafaf")
+	assert.Nil(t, err)
+	assert.Nil(t, it)
+}
+
+func TestRedisRepo_fetchPendingLifecycleActions(t *testing.T) {
+	rr := &redisRepo{cg: &testRedisConnGetter{}}
+
+	conn := rr.cg.Get().(*redigomock.Conn)
+	conn.Command("SCAN", uint64(0), "MATCH", "cyclist:instance_launching:*").Expect([]interface{}{
+		[]byte("0"),
+		[]interface{}{
+			[]byte("cyclist:instance_launching:i-fafafaf:frazzled-top-zipper"),
+			[]byte("cyclist:instance_launching:i-bebebeb"),
+		},
+	})
+	conn.Command("HGETALL", "cyclist:instance_launching:i-fafafaf:frazzled-top-zipper").ExpectMap(map[string]string{
+		"lifecycle_action_token":  "TOKEYTOKETOK",
+		"auto_scaling_group_name": "cat-theatre-napkin-hose",
+		"lifecycle_hook_name":     "huzzah-9001",
+	})
+	conn.Command("HGETALL", "cyclist:instance_launching:i-bebebeb").ExpectMap(map[string]string{
+		"lifecycle_action_token":  "TOKEYTOKETOK",
+		"auto_scaling_group_name": "cat-theatre-napkin-hose",
+		"lifecycle_hook_name":     "huzzah-9001",
+		"completed":               "1",
+	})
+
+	actions, err := rr.fetchPendingLifecycleActions("launching")
+	assert.Nil(t, err)
+	assert.Len(t, actions, 1)
+	assert.Equal(t, "i-fafafaf", actions[0].EC2InstanceID)
+	assert.Equal(t, "autoscaling:EC2_INSTANCE_LAUNCHING", actions[0].LifecycleTransition)
+}
+
+func TestRedisRepo_storeCycleRun(t *testing.T) {
+	rr := &redisRepo{cg: &testRedisConnGetter{}}
+
+	conn := rr.cg.Get().(*redigomock.Conn)
+	conn.Command("MULTI").Expect("OK!")
+	conn.Command("SET", "cyclist:cycle:cat-theatre-napkin-hose", redigomock.NewAnyData()).Expect("QUEUED")
+	conn.Command("SADD", "cyclist:cycles", "cat-theatre-napkin-hose").Expect("QUEUED")
+	conn.Command("EXEC").Expect([]interface{}{"OK!", int64(1)})
+
+	err := rr.storeCycleRun(&cycleRun{ASGName: "cat-theatre-napkin-hose", State: cycleStateDraining})
+	assert.Nil(t, err)
+}
+
+func TestRedisRepo_fetchCycleRuns(t *testing.T) {
+	rr := &redisRepo{cg: &testRedisConnGetter{}}
+
+	conn := rr.cg.Get().(*redigomock.Conn)
+	conn.Command("SMEMBERS", "cyclist:cycles").Expect([]interface{}{
+		[]byte("cat-theatre-napkin-hose"), []byte("whimsical-mime-headphone"),
+	})
+	conn.Command("GET", "cyclist:cycle:cat-theatre-napkin-hose").
+		Expect([]byte(`{"asg":"cat-theatre-napkin-hose","batch_size":2,"state":"draining"}`))
+	conn.Command("GET", "cyclist:cycle:whimsical-mime-headphone").Expect(nil)
+
+	runs, err := rr.fetchCycleRuns()
+	assert.Nil(t, err)
+	assert.Len(t, runs, 1)
+	assert.Equal(t, "cat-theatre-napkin-hose", runs[0].ASGName)
+	assert.Equal(t, 2, runs[0].BatchSize)
+	assert.Equal(t, cycleStateDraining, runs[0].State)
+}
+
+func TestRedisRepo_lockCycleRun(t *testing.T) {
+	rr := &redisRepo{cg: &testRedisConnGetter{}}
+
+	conn := rr.cg.Get().(*redigomock.Conn)
+	conn.Command("SET", "cyclist:cycle_lock:cat-theatre-napkin-hose", "owner-a", "EX", uint(60), "NX").Expect("OK")
+
+	locked, err := rr.lockCycleRun("cat-theatre-napkin-hose", "owner-a", time.Minute)
+	assert.Nil(t, err)
+	assert.True(t, locked)
+}
+
+func TestRedisRepo_lockCycleRun_AlreadyLocked(t *testing.T) {
+	rr := &redisRepo{cg: &testRedisConnGetter{}}
+
+	conn := rr.cg.Get().(*redigomock.Conn)
+	conn.Command("SET", "cyclist:cycle_lock:cat-theatre-napkin-hose", "owner-b", "EX", uint(60), "NX").Expect(nil)
+
+	locked, err := rr.lockCycleRun("cat-theatre-napkin-hose", "owner-b", time.Minute)
+	assert.Nil(t, err)
+	assert.False(t, locked)
+}
+
+func TestRedisRepo_unlockCycleRun(t *testing.T) {
+	rr := &redisRepo{cg: &testRedisConnGetter{}}
+
+	conn := rr.cg.Get().(*redigomock.Conn)
+	conn.Command("EVAL", redisUnlockScript, 1, "cyclist:cycle_lock:cat-theatre-napkin-hose", "owner-a").Expect(int64(1))
+
+	err := rr.unlockCycleRun("cat-theatre-napkin-hose", "owner-a")
+	assert.Nil(t, err)
+}
+
+func TestRedisRepo_WithHashTags_wipeInstanceState(t *testing.T) {
+	rr := &redisRepo{cg: &testRedisConnGetter{}, hashTags: true}
+
+	conn := rr.cg.Get().(*redigomock.Conn)
+	conn.Command("DEL", "cyclist:instance:{i-fafafaf}:state", "cyclist:instance:{i-fafafaf}:protected").Expect(int64(2))
+
+	err := rr.wipeInstanceState("i-fafafaf")
+	assert.Nil(t, err)
+}
+
+func TestRedisRepo_WithHashTags_storeInstanceLifecycleAction(t *testing.T) {
+	rr := &redisRepo{cg: &testRedisConnGetter{}, instLifecycleActionTTL: uint(42), hashTags: true}
+
+	conn := rr.cg.Get().(*redigomock.Conn)
+	conn.Command("MULTI").Expect("OK!")
+	conn.Command("DEL", "cyclist:instance_loathing:{i-fafafaf}:frazzled-top-zipper").Expect(int64(1))
+	conn.Command("HMSET", "cyclist:instance_loathing:{i-fafafaf}:frazzled-top-zipper",
+		"lifecycle_action_token", "TOKEYTOKETOK",
+		"auto_scaling_group_name", "menial-jar-legs",
+		"lifecycle_hook_name", "frazzled-top-zipper").Expect("OK!")
+	conn.Command("EXPIRE", "cyclist:instance_loathing:{i-fafafaf}:frazzled-top-zipper", uint(42)).Expect("OK!")
+	conn.Command("SADD", "cyclist:instance_loathing_hooks:{i-fafafaf}", "frazzled-top-zipper").Expect(int64(1))
+	conn.Command("EXPIRE", "cyclist:instance_loathing_hooks:{i-fafafaf}", uint(42)).Expect("OK!")
+	conn.Command("EXEC").Expect("OK!")
+
+	err := rr.storeInstanceLifecycleAction(&lifecycleAction{
+		LifecycleTransition:  "autoscaling:EC2_INSTANCE_LOATHING",
+		EC2InstanceID:        "i-fafafaf",
+		LifecycleActionToken: "TOKEYTOKETOK",
+		AutoScalingGroupName: "menial-jar-legs",
+		LifecycleHookName:    "frazzled-top-zipper",
+	})
+
+	assert.Nil(t, err)
+}
+
+func TestRedisRepo_WithHashTags_fetchInstanceToken(t *testing.T) {
+	rr := &redisRepo{cg: &testRedisConnGetter{}, instTokTTL: uint(42), hashTags: true}
+
+	conn := rr.cg.Get().(*redigomock.Conn)
+	conn.Command("GET", "cyclist:instance:{i-fafafaf}:token").Expect("TOKEYTOKETOK")
+	conn.Command("EXPIRE", "cyclist:instance:{i-fafafaf}:token", uint(42)).Expect(int64(1))
+
+	tok, err := rr.fetchInstanceToken("i-fafafaf")
+	assert.Nil(t, err)
+	assert.Equal(t, "TOKEYTOKETOK", tok)
+}
+
+func TestRedisRepo_WithHashTags_fetchAllInstanceEvents(t *testing.T) {
+	rr := &redisRepo{cg: &testRedisConnGetter{}, hashTags: true}
+
+	conn := rr.cg.Get().(*redigomock.Conn)
+	conn.Command("SCAN", uint64(0), "MATCH", "cyclist:instance:*:events").Expect([]interface{}{
+		[]byte("0"),
+		[]interface{}{[]byte("cyclist:instance:{i-fafafaf}:events")},
+	})
+	conn.Command("HGETALL", "cyclist:instance:{i-fafafaf}:events").ExpectMap(map[string]string{
+		"launching": "2017-12-01T00:00:00Z",
+	})
+
+	events, err := rr.fetchAllInstanceEvents()
+	assert.Nil(t, err)
+	assert.Len(t, events["i-fafafaf"], 1)
+}
+
+func TestRedisRepo_WithHashTags_fetchPendingLifecycleActions(t *testing.T) {
+	rr := &redisRepo{cg: &testRedisConnGetter{}, hashTags: true}
+
+	conn := rr.cg.Get().(*redigomock.Conn)
+	conn.Command("SCAN", uint64(0), "MATCH", "cyclist:instance_launching:*").Expect([]interface{}{
+		[]byte("0"),
+		[]interface{}{[]byte("cyclist:instance_launching:{i-fafafaf}:frazzled-top-zipper")},
+	})
+	conn.Command("HGETALL", "cyclist:instance_launching:{i-fafafaf}:frazzled-top-zipper").ExpectMap(map[string]string{
+		"lifecycle_action_token":  "TOKEYTOKETOK",
+		"auto_scaling_group_name": "cat-theatre-napkin-hose",
+		"lifecycle_hook_name":     "frazzled-top-zipper",
+	})
+
+	actions, err := rr.fetchPendingLifecycleActions("launching")
+	assert.Nil(t, err)
+	assert.Len(t, actions, 1)
+	assert.Equal(t, "i-fafafaf", actions[0].EC2InstanceID)
+}
+
+func TestRedisRepo_WithHashTags_storeSNSSubscriptionState(t *testing.T) {
+	rr := &redisRepo{cg: &testRedisConnGetter{}, hashTags: true}
+
+	conn := rr.cg.Get().(*redigomock.Conn)
+	conn.Command("MULTI").Expect("OK!")
+	conn.Command("HMSET", "{cyclist}:sns_subscription:arn:aws:sns:nz-isengard-1:999999999999:toaster-pastries",
+		"topic_arn", "arn:aws:sns:nz-isengard-1:999999999999:toaster-pastries",
+		"state", "confirmed",
+		"updated_at", redigomock.NewAnyData()).Expect("OK!")
+	conn.Command("SADD", "{cyclist}:sns_subscriptions",
+		"arn:aws:sns:nz-isengard-1:999999999999:toaster-pastries").Expect(int64(1))
+	conn.Command("EXEC").Expect("OK!")
+
+	err := rr.storeSNSSubscriptionState("arn:aws:sns:nz-isengard-1:999999999999:toaster-pastries", "confirmed")
+	assert.Nil(t, err)
+}
+
+func TestRedisRepo_WithHashTags_storeCycleRun(t *testing.T) {
+	rr := &redisRepo{cg: &testRedisConnGetter{}, hashTags: true}
+
+	conn := rr.cg.Get().(*redigomock.Conn)
+	conn.Command("MULTI").Expect("OK!")
+	conn.Command("SET", "{cyclist}:cycle:cat-theatre-napkin-hose", redigomock.NewAnyData()).Expect("QUEUED")
+	conn.Command("SADD", "{cyclist}:cycles", "cat-theatre-napkin-hose").Expect("QUEUED")
+	conn.Command("EXEC").Expect([]interface{}{"OK!", int64(1)})
+
+	err := rr.storeCycleRun(&cycleRun{ASGName: "cat-theatre-napkin-hose", State: cycleStateDraining})
+	assert.Nil(t, err)
+}
@@ -0,0 +1,281 @@
+package cyclist
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	defaultDrainReaperInterval = time.Minute
+	defaultDrainsWithin        = 15 * time.Minute
+)
+
+// drainDeadlines holds the maximum drain time per auto scaling group name
+// pattern, falling back to a default, where 0 means no deadline.  A nil
+// *drainDeadlines has no deadline for any group.
+type drainDeadlines struct {
+	defaultMaxDrainTime time.Duration
+	patterns            []string
+	maxDrainTimes       []time.Duration
+}
+
+// newDrainDeadlines accepts per-group max drain times as "pattern=duration",
+// where the first matching pattern wins
+func newDrainDeadlines(maxDrainTime time.Duration, asgMaxDrainTimes []string) (*drainDeadlines, error) {
+	if maxDrainTime < 0 {
+		maxDrainTime = 0
+	}
+
+	dd := &drainDeadlines{defaultMaxDrainTime: maxDrainTime}
+
+	for _, entry := range cleanAllowlistEntries(asgMaxDrainTimes) {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid asg max drain time %q", entry)
+		}
+
+		pattern := strings.TrimSpace(parts[0])
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid asg name pattern %q: %v", pattern, err)
+		}
+
+		maxDrainTime, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid asg max drain time %q", entry)
+		}
+
+		if maxDrainTime < 0 {
+			maxDrainTime = 0
+		}
+
+		dd.patterns = append(dd.patterns, pattern)
+		dd.maxDrainTimes = append(dd.maxDrainTimes, maxDrainTime)
+	}
+
+	return dd, nil
+}
+
+// enabled is whether any group has a deadline
+func (dd *drainDeadlines) enabled() bool {
+	if dd == nil {
+		return false
+	}
+
+	if dd.defaultMaxDrainTime > 0 {
+		return true
+	}
+
+	for _, maxDrainTime := range dd.maxDrainTimes {
+		if maxDrainTime > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (dd *drainDeadlines) maxDrainTime(asgName string) time.Duration {
+	if dd == nil {
+		return 0
+	}
+
+	for i, pattern := range dd.patterns {
+		if ok, _ := path.Match(pattern, asgName); ok {
+			return dd.maxDrainTimes[i]
+		}
+	}
+
+	return dd.defaultMaxDrainTime
+}
+
+// drainStartedAt is when the terminating lifecycle action was received, if
+// known
+func drainStartedAt(db repo, la *lifecycleAction) (time.Time, bool) {
+	if le, _ := db.fetchInstanceEvent(la.EC2InstanceID, "preterminating"); le != nil {
+		return le.Timestamp, true
+	}
+	return la.Timestamp()
+}
+
+type drainingInstance struct {
+	InstanceID           string    `json:"instance_id"`
+	AutoScalingGroupName string    `json:"auto_scaling_group_name"`
+	LifecycleHookName    string    `json:"lifecycle_hook_name"`
+	StartedAt            time.Time `json:"started_at"`
+	Deadline             time.Time `json:"deadline"`
+	Remaining            string    `json:"remaining"`
+
+	action *lifecycleAction
+}
+
+func fetchDrainingInstances(db repo, dd *drainDeadlines, now time.Time) ([]*drainingInstance, error) {
+	actions, err := db.fetchPendingLifecycleActions("terminating")
+	if err != nil {
+		return nil, err
+	}
+
+	res := []*drainingInstance{}
+	for _, la := range actions {
+		maxDrainTime := dd.maxDrainTime(la.AutoScalingGroupName)
+		if maxDrainTime <= 0 {
+			continue
+		}
+
+		startedAt, ok := drainStartedAt(db, la)
+		if !ok {
+			continue
+		}
+
+		deadline := startedAt.Add(maxDrainTime)
+		res = append(res, &drainingInstance{
+			InstanceID:           la.EC2InstanceID,
+			AutoScalingGroupName: la.AutoScalingGroupName,
+			LifecycleHookName:    la.LifecycleHookName,
+			StartedAt:            startedAt,
+			Deadline:             deadline,
+			Remaining:            deadline.Sub(now).String(),
+
+			action: la,
+		})
+	}
+
+	return res, nil
+}
+
+// drainTimeoutReaper completes terminating lifecycle actions on behalf of
+// instances that haven't reported their termination by their drain deadline.
+type drainTimeoutReaper struct {
+	db        repo
+	log       logrus.FieldLogger
+	asSvc     autoscalingiface.AutoScalingAPI
+	deadlines *drainDeadlines
+
+	interval time.Duration
+}
+
+func newDrainTimeoutReaper(db repo, log logrus.FieldLogger, asSvc autoscalingiface.AutoScalingAPI, deadlines *drainDeadlines) *drainTimeoutReaper {
+	return &drainTimeoutReaper{
+		db:        db,
+		log:       log.WithField("self", "drain_timeout_reaper"),
+		asSvc:     asSvc,
+		deadlines: deadlines,
+
+		interval: defaultDrainReaperInterval,
+	}
+}
+
+func (dtr *drainTimeoutReaper) Run(ctx context.Context) {
+	dtr.log.Info("starting")
+
+	ticker := time.NewTicker(dtr.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			dtr.log.Info("stopping")
+			return
+		case <-ticker.C:
+			err := dtr.reap()
+			if err != nil {
+				dtr.log.WithField("err", err).Error("failed to reap drain timeouts")
+			}
+		}
+	}
+}
+
+func (dtr *drainTimeoutReaper) reap() error {
+	draining, err := fetchDrainingInstances(dtr.db, dtr.deadlines, time.Now())
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	for _, di := range draining {
+		if now.Before(di.Deadline) {
+			continue
+		}
+
+		log := dtr.log.WithFields(logrus.Fields{
+			"instance":  di.InstanceID,
+			"hook_name": di.LifecycleHookName,
+			"deadline":  di.Deadline.Format(time.RFC3339),
+		})
+		log.Warn("drain timed out")
+
+		err = handleLifecycleTransition(dtr.db, log, dtr.asSvc, "terminating", di.InstanceID, di.LifecycleHookName)
+		if isLifecycleActionExpired(err) {
+			continue
+		}
+		if err != nil {
+			log.WithField("err", err).Error("failed to complete timed out lifecycle action")
+			continue
+		}
+
+		err = dtr.db.storeInstanceEvent(di.InstanceID, "drain_timeout")
+		if err != nil {
+			log.WithField("err", err).Warn("failed to store drain timeout event")
+		}
+	}
+
+	return nil
+}
+
+func newDrainsHandlerFunc(db repo, log logrus.FieldLogger, dd *drainDeadlines) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log = log.WithFields(logrus.Fields{
+			"path":   r.URL.Path,
+			"method": r.Method,
+		})
+
+		within := defaultDrainsWithin
+		if v := r.URL.Query().Get("within"); v != "" {
+			var err error
+			within, err = time.ParseDuration(v)
+			if err != nil {
+				jsonRespond(w, http.StatusBadRequest, &jsonErr{
+					Err: errors.Wrap(err, "invalid within duration"),
+				})
+				return
+			}
+		}
+
+		now := time.Now()
+		draining, err := fetchDrainingInstances(db, dd, now)
+		if err != nil {
+			log.WithField("err", err).Error("fetching draining instances failed")
+			jsonRespond(w, http.StatusInternalServerError, &jsonErr{
+				Err: errors.Wrap(err, "fetching draining instances failed"),
+			})
+			return
+		}
+
+		near := []*drainingInstance{}
+		for _, di := range draining {
+			if di.Deadline.Sub(now) <= within {
+				near = append(near, di)
+			}
+		}
+
+		jsonRespond(w, http.StatusOK, &jsonDrainingInstances{
+			Instances: near,
+			Within:    within.String(),
+			Total:     len(near),
+		})
+	}
+}
+
+type jsonDrainingInstances struct {
+	Instances []*drainingInstance `json:"instances"`
+	Within    string              `json:"@within"`
+	Total     int                 `json:"@total"`
+}
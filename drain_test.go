@@ -0,0 +1,148 @@
+package cyclist
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewDrainDeadlines(t *testing.T) {
+	dd, err := newDrainDeadlines(time.Hour, []string{"workers-*=3h, cat-theatre-*=30m", "cat-*=2h"})
+	assert.Nil(t, err)
+	assert.Equal(t, 3*time.Hour, dd.maxDrainTime("workers-linux"))
+	assert.Equal(t, 30*time.Minute, dd.maxDrainTime("cat-theatre-napkin-hose"))
+	assert.Equal(t, 2*time.Hour, dd.maxDrainTime("cat-flap"))
+	assert.Equal(t, time.Hour, dd.maxDrainTime("whimsical-mime-headphone"))
+
+	assert.True(t, dd.enabled())
+
+	dd, err = newDrainDeadlines(0, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), dd.maxDrainTime("cat-flap"))
+	assert.False(t, dd.enabled())
+
+	dd, err = newDrainDeadlines(0, []string{"cat-*=2h"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2*time.Hour, dd.maxDrainTime("cat-flap"))
+	assert.Equal(t, time.Duration(0), dd.maxDrainTime("whimsical-mime-headphone"))
+	assert.True(t, dd.enabled())
+
+	var nilDD *drainDeadlines
+	assert.Equal(t, time.Duration(0), nilDD.maxDrainTime("cat-flap"))
+	assert.False(t, nilDD.enabled())
+}
+
+func TestNewDrainDeadlines_Invalid(t *testing.T) {
+	for _, entry := range []string{"workers-*", "workers-*=soon", "[=1h"} {
+		dd, err := newDrainDeadlines(time.Hour, []string{entry})
+		assert.Nil(t, dd, entry)
+		assert.NotNil(t, err, entry)
+	}
+}
+
+func TestDrainTimeoutReaper_reap(t *testing.T) {
+	db := newTestDrainingRepo()
+	db.e["i-fafafaf"]["preterminating"].Timestamp = time.Now().Add(-2 * time.Hour)
+	results := []string{}
+	asSvc := newTestAutoScalingService(func(r *request.Request) {
+		v, ok := r.Params.(*autoscaling.CompleteLifecycleActionInput)
+		if !ok {
+			r.Error = errors.New("unexpected request")
+			return
+		}
+		results = append(results, *v.LifecycleActionResult)
+	})
+
+	dtr := newDrainTimeoutReaper(db, shushLog, asSvc, &drainDeadlines{defaultMaxDrainTime: time.Hour})
+
+	assert.Nil(t, dtr.reap())
+	assert.Equal(t, []string{"CONTINUE"}, results)
+	assert.True(t, db.la["terminating:i-fafafaf:huzzah-9001"].Completed)
+	assert.Equal(t, "", db.s["i-fafafaf"])
+	assert.NotNil(t, db.e["i-fafafaf"]["terminating"])
+	assert.NotNil(t, db.e["i-fafafaf"]["drain_timeout"])
+
+	assert.Nil(t, dtr.reap())
+	assert.Len(t, results, 1)
+}
+
+func TestDrainTimeoutReaper_reap_WithRemainingHooks(t *testing.T) {
+	db := newTestDrainingRepo()
+	db.e["i-fafafaf"]["preterminating"].Timestamp = time.Now().Add(-2 * time.Hour)
+	_ = db.storeInstanceLifecycleAction(&lifecycleAction{
+		LifecycleTransition:  "autoscaling:EC2_INSTANCE_TERMINATING",
+		EC2InstanceID:        "i-fafafaf",
+		AutoScalingGroupName: "cat-theatre-napkin-hose",
+		LifecycleHookName:    "huzzah-9002",
+	})
+	asSvc := newTestAutoScalingService(func(r *request.Request) {
+		v, ok := r.Params.(*autoscaling.CompleteLifecycleActionInput)
+		if !ok || *v.LifecycleHookName == "huzzah-9002" {
+			r.Error = errors.New("no way")
+		}
+	})
+
+	dtr := newDrainTimeoutReaper(db, shushLog, asSvc, &drainDeadlines{defaultMaxDrainTime: time.Hour})
+
+	assert.Nil(t, dtr.reap())
+	assert.True(t, db.la["terminating:i-fafafaf:huzzah-9001"].Completed)
+	assert.False(t, db.la["terminating:i-fafafaf:huzzah-9002"].Completed)
+	assert.Equal(t, "down", db.s["i-fafafaf"])
+	assert.Nil(t, db.e["i-fafafaf"]["terminating"])
+}
+
+func TestDrainTimeoutReaper_reap_NotYet(t *testing.T) {
+	db := newTestDrainingRepo()
+	asSvc := newTestAutoScalingService(func(r *request.Request) {
+		r.Error = errors.New("should not be called")
+	})
+
+	dtr := newDrainTimeoutReaper(db, shushLog, asSvc, &drainDeadlines{defaultMaxDrainTime: time.Hour})
+
+	assert.Nil(t, dtr.reap())
+	assert.False(t, db.la["terminating:i-fafafaf:huzzah-9001"].Completed)
+	assert.Equal(t, "down", db.s["i-fafafaf"])
+}
+
+func TestServer_GET_drains(t *testing.T) {
+	srv := newTestServer()
+	srv.db = newTestDrainingRepo()
+	srv.db.(*testRepo).e["i-fafafaf"]["preterminating"].Timestamp = time.Now().Add(-50 * time.Minute)
+	srv.drainDeadlines = &drainDeadlines{defaultMaxDrainTime: time.Hour}
+	srv.setupRouter()
+	ts := httptest.NewServer(srv.router)
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		within string
+		total  int
+	}{
+		{within: "", total: 1},
+		{within: "5m", total: 0},
+	} {
+		req, err := http.NewRequest("GET", fmt.Sprintf("%s/drains?within=%s", ts.URL, tc.within), nil)
+		assert.Nil(t, err)
+		req.Header.Set("Authorization", "token mysteriously")
+
+		res, err := (&http.Client{}).Do(req)
+		assert.Nil(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+
+		body := &jsonDrainingInstances{}
+		err = json.NewDecoder(res.Body).Decode(body)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.total, body.Total)
+		if tc.total > 0 {
+			assert.Equal(t, "i-fafafaf", body.Instances[0].InstanceID)
+			assert.Equal(t, "cat-theatre-napkin-hose", body.Instances[0].AutoScalingGroupName)
+		}
+	}
+}
@@ -138,6 +138,12 @@ func (f *fullLifecycleManagementHTTP) autoScalingCallback(req *request.Request)
 		f.vars[fmt.Sprintf("instance_%s_state", f.vars["lifecycle_action"])] = "completed"
 		return
 	}
+	if v, ok := req.Params.(*autoscaling.RecordLifecycleActionHeartbeatInput); ok {
+		assert.Equal(f.t, *v.InstanceId, f.vars["instance_id"])
+		assert.Equal(f.t, *v.LifecycleActionToken, f.vars["instance_terminating_token"])
+		f.vars["instance_terminating_heartbeat"] = "recorded"
+		return
+	}
 	req.Error = errors.New("is not good")
 }
 
@@ -218,9 +224,9 @@ func (f *fullLifecycleManagementHTTP) stepInstanceLaunchingNotification() {
 	assert.NotNil(f.t, res)
 	assert.Equal(f.t, 200, res.StatusCode)
 
-	la, err := f.db.fetchInstanceLifecycleAction("launching", f.vars["instance_id"])
+	las, err := f.db.fetchInstanceLifecycleActions("launching", f.vars["instance_id"])
 	assert.Nil(f.t, err)
-	assert.NotNil(f.t, la)
+	assert.Len(f.t, las, 1)
 	assert.Equal(f.t, "pending", f.vars["instance_launching_state"])
 
 	state, err := f.db.fetchInstanceState(f.vars["instance_id"])
@@ -274,10 +280,10 @@ func (f *fullLifecycleManagementHTTP) stepInstanceLaunchingConfirmation() {
 	assert.JSONEq(f.t, `{"message": "instance launch complete"}`, string(body))
 	assert.Equal(f.t, 200, res.StatusCode)
 
-	la, err := f.db.fetchInstanceLifecycleAction("launching", f.vars["instance_id"])
-	assert.NotNil(f.t, la)
+	las, err := f.db.fetchInstanceLifecycleActions("launching", f.vars["instance_id"])
+	assert.Len(f.t, las, 1)
 	assert.Nil(f.t, err)
-	assert.True(f.t, la.Completed)
+	assert.True(f.t, las[0].Completed)
 
 	state, err := f.db.fetchInstanceState(f.vars["instance_id"])
 	assert.Nil(f.t, err)
@@ -346,9 +352,9 @@ func (f *fullLifecycleManagementHTTP) stepInstanceTerminatingNotification() {
 	assert.NotNil(f.t, res)
 	assert.Equal(f.t, 200, res.StatusCode)
 
-	la, err := f.db.fetchInstanceLifecycleAction("terminating", f.vars["instance_id"])
+	las, err := f.db.fetchInstanceLifecycleActions("terminating", f.vars["instance_id"])
 	assert.Nil(f.t, err)
-	assert.NotNil(f.t, la)
+	assert.Len(f.t, las, 1)
 
 	state, err := f.db.fetchInstanceState(f.vars["instance_id"])
 	assert.Nil(f.t, err)
@@ -373,6 +379,7 @@ func (f *fullLifecycleManagementHTTP) stepHeartbeatWhileDown() {
 	assert.Nil(f.t, err)
 	assert.JSONEq(f.t, `{"state": "down"}`, string(body))
 	assert.Equal(f.t, 200, res.StatusCode)
+	assert.Equal(f.t, "recorded", f.vars["instance_terminating_heartbeat"])
 
 	state, err := f.db.fetchInstanceState(f.vars["instance_id"])
 	assert.Nil(f.t, err)
@@ -398,10 +405,10 @@ func (f *fullLifecycleManagementHTTP) stepInstanceTerminatingConfirmation() {
 	assert.JSONEq(f.t, `{"message": "instance termination complete"}`, string(body))
 	assert.Equal(f.t, 200, res.StatusCode)
 
-	la, err := f.db.fetchInstanceLifecycleAction("terminating", f.vars["instance_id"])
-	assert.NotNil(f.t, la)
+	las, err := f.db.fetchInstanceLifecycleActions("terminating", f.vars["instance_id"])
+	assert.Len(f.t, las, 1)
 	assert.Nil(f.t, err)
-	assert.True(f.t, la.Completed)
+	assert.True(f.t, las[0].Completed)
 
 	state, err := f.db.fetchInstanceState(f.vars["instance_id"])
 	assert.NotNil(f.t, err)
@@ -2,12 +2,21 @@ package cyclist
 
 import (
 	"net/http"
+	"sync"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 )
 
-func newHeartbeatHandlerFunc(db repo, log logrus.FieldLogger) http.HandlerFunc {
+var (
+	defaultLifecycleHeartbeatInterval = 5 * time.Minute
+)
+
+func newHeartbeatHandlerFunc(db repo, log logrus.FieldLogger, asSvc autoscalingiface.AutoScalingAPI, lhb *lifecycleHeartbeater) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		instanceID := vars["instance_id"]
@@ -24,6 +33,13 @@ func newHeartbeatHandlerFunc(db repo, log logrus.FieldLogger) http.HandlerFunc {
 			jsonRespond(w, http.StatusInternalServerError, &jsonErr{Err: err})
 		}
 
+		if state == "down" {
+			err = lhb.record(db, log.WithField("instance_id", instanceID), asSvc, instanceID)
+			if err != nil {
+				log.WithField("err", err).Warn("failed to record lifecycle action heartbeat")
+			}
+		}
+
 		jsonRespond(w, http.StatusOK, &jsonInstanceState{State: state})
 	}
 }
@@ -31,3 +47,110 @@ func newHeartbeatHandlerFunc(db repo, log logrus.FieldLogger) http.HandlerFunc {
 type jsonInstanceState struct {
 	State string `json:"state"`
 }
+
+// lifecycleHeartbeater extends the terminating lifecycle action of instances
+// that are still draining, as told by their heartbeats, at most once per
+// interval per instance and no longer than their drain deadline.  A nil
+// *lifecycleHeartbeater records nothing.
+type lifecycleHeartbeater struct {
+	interval  time.Duration
+	deadlines *drainDeadlines
+
+	lastMutex sync.Mutex
+	last      map[string]time.Time
+}
+
+func newLifecycleHeartbeater(interval time.Duration, deadlines *drainDeadlines) *lifecycleHeartbeater {
+	if interval <= 0 {
+		interval = defaultLifecycleHeartbeatInterval
+	}
+
+	return &lifecycleHeartbeater{
+		interval:  interval,
+		deadlines: deadlines,
+
+		last: map[string]time.Time{},
+	}
+}
+
+func (lhb *lifecycleHeartbeater) record(db repo, log logrus.FieldLogger, asSvc autoscalingiface.AutoScalingAPI, instanceID string) error {
+	if lhb == nil {
+		return nil
+	}
+
+	now := time.Now()
+
+	lhb.lastMutex.Lock()
+	last, ok := lhb.last[instanceID]
+	if ok && now.Sub(last) < lhb.interval {
+		lhb.lastMutex.Unlock()
+		return nil
+	}
+	lhb.prune(now)
+	lhb.last[instanceID] = now
+	lhb.lastMutex.Unlock()
+
+	actions, err := db.fetchInstanceLifecycleActions("terminating", instanceID)
+	if err != nil {
+		return err
+	}
+
+	pending := []*lifecycleAction{}
+	for _, la := range actions {
+		if !la.Completed {
+			pending = append(pending, la)
+		}
+	}
+
+	if len(pending) == 0 {
+		lhb.forget(instanceID)
+		return nil
+	}
+
+	maxDrainTime := lhb.deadlines.maxDrainTime(pending[0].AutoScalingGroupName)
+	if startedAt, ok := drainStartedAt(db, pending[0]); ok && maxDrainTime > 0 && now.Sub(startedAt) > maxDrainTime {
+		log.WithField("max_drain_time", maxDrainTime.String()).Warn("max drain time reached, no longer recording lifecycle action heartbeats")
+		lhb.forget(instanceID)
+		if exhausted, _ := db.fetchInstanceEvent(instanceID, "drain_exhausted"); exhausted == nil {
+			return db.storeInstanceEvent(instanceID, "drain_exhausted")
+		}
+		return nil
+	}
+
+	for _, la := range pending {
+		log.WithFields(logrus.Fields{
+			"asg":       la.AutoScalingGroupName,
+			"hook_name": la.LifecycleHookName,
+		}).Debug("recording lifecycle action heartbeat")
+
+		_, err = asSvc.RecordLifecycleActionHeartbeat(&autoscaling.RecordLifecycleActionHeartbeatInput{
+			AutoScalingGroupName: aws.String(la.AutoScalingGroupName),
+			InstanceId:           aws.String(la.EC2InstanceID),
+			LifecycleActionToken: la.token(),
+			LifecycleHookName:    aws.String(la.LifecycleHookName),
+		})
+		if err != nil {
+			lhb.forget(instanceID)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// prune deletes the last heartbeats of instances that have not been recorded
+// within the interval, such as those terminated mid drain, and must be called
+// with the last mutex held
+func (lhb *lifecycleHeartbeater) prune(now time.Time) {
+	for instanceID, last := range lhb.last {
+		if now.Sub(last) >= lhb.interval {
+			delete(lhb.last, instanceID)
+		}
+	}
+}
+
+func (lhb *lifecycleHeartbeater) forget(instanceID string) {
+	lhb.lastMutex.Lock()
+	delete(lhb.last, instanceID)
+	lhb.lastMutex.Unlock()
+}
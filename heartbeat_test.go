@@ -0,0 +1,96 @@
+package cyclist
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDrainingRepo() *testRepo {
+	db := newTestRepo()
+	_ = db.setInstanceState("i-fafafaf", "down")
+	_ = db.storeInstanceLifecycleAction(&lifecycleAction{
+		LifecycleTransition:  "autoscaling:EC2_INSTANCE_TERMINATING",
+		EC2InstanceID:        "i-fafafaf",
+		LifecycleActionToken: "TOKEYTOKETOK",
+		AutoScalingGroupName: "cat-theatre-napkin-hose",
+		LifecycleHookName:    "huzzah-9001",
+	})
+	_ = db.storeInstanceEvent("i-fafafaf", "preterminating")
+	return db
+}
+
+func TestLifecycleHeartbeater_record(t *testing.T) {
+	db := newTestDrainingRepo()
+	recorded := 0
+	asSvc := newTestAutoScalingService(func(r *request.Request) {
+		v, ok := r.Params.(*autoscaling.RecordLifecycleActionHeartbeatInput)
+		if !ok {
+			r.Error = errors.New("unexpected request")
+			return
+		}
+		assert.Equal(t, "TOKEYTOKETOK", *v.LifecycleActionToken)
+		assert.Equal(t, "huzzah-9001", *v.LifecycleHookName)
+		recorded++
+	})
+
+	lhb := newLifecycleHeartbeater(time.Hour, &drainDeadlines{defaultMaxDrainTime: time.Hour})
+
+	assert.Nil(t, lhb.record(db, shushLog, asSvc, "i-fafafaf"))
+	assert.Nil(t, lhb.record(db, shushLog, asSvc, "i-fafafaf"))
+	assert.Equal(t, 1, recorded)
+
+	lhb.last["i-fafafaf"] = time.Now().Add(-2 * time.Hour)
+	assert.Nil(t, lhb.record(db, shushLog, asSvc, "i-fafafaf"))
+	assert.Equal(t, 2, recorded)
+}
+
+func TestLifecycleHeartbeater_record_MaxDrainTime(t *testing.T) {
+	db := newTestDrainingRepo()
+	db.e["i-fafafaf"]["preterminating"].Timestamp = time.Now().Add(-2 * time.Hour)
+	asSvc := newTestAutoScalingService(func(r *request.Request) {
+		r.Error = errors.New("should not be called")
+	})
+
+	lhb := newLifecycleHeartbeater(time.Minute, &drainDeadlines{defaultMaxDrainTime: time.Hour})
+
+	assert.Nil(t, lhb.record(db, shushLog, asSvc, "i-fafafaf"))
+	assert.NotNil(t, db.e["i-fafafaf"]["drain_exhausted"])
+	assert.Len(t, lhb.last, 0)
+}
+
+func TestLifecycleHeartbeater_record_PrunesGoneInstances(t *testing.T) {
+	db := newTestDrainingRepo()
+	asSvc := newTestAutoScalingService(nil)
+
+	lhb := newLifecycleHeartbeater(time.Hour, &drainDeadlines{defaultMaxDrainTime: 2 * time.Hour})
+	lhb.last["i-bababab"] = time.Now().Add(-2 * time.Hour)
+	lhb.last["i-cacacac"] = time.Now().Add(-time.Minute)
+
+	assert.Nil(t, lhb.record(db, shushLog, asSvc, "i-fafafaf"))
+	assert.Len(t, lhb.last, 2)
+	assert.Contains(t, lhb.last, "i-fafafaf")
+	assert.Contains(t, lhb.last, "i-cacacac")
+}
+
+func TestLifecycleHeartbeater_record_Completed(t *testing.T) {
+	db := newTestDrainingRepo()
+	_ = db.completeInstanceLifecycleAction("terminating", "i-fafafaf", "huzzah-9001")
+	asSvc := newTestAutoScalingService(func(r *request.Request) {
+		r.Error = errors.New("should not be called")
+	})
+
+	lhb := newLifecycleHeartbeater(time.Minute, &drainDeadlines{defaultMaxDrainTime: time.Hour})
+
+	assert.Nil(t, lhb.record(db, shushLog, asSvc, "i-fafafaf"))
+	assert.Len(t, lhb.last, 0)
+}
+
+func TestLifecycleHeartbeater_record_Nil(t *testing.T) {
+	var lhb *lifecycleHeartbeater
+	assert.Nil(t, lhb.record(newTestDrainingRepo(), shushLog, nil, "i-fafafaf"))
+}
@@ -0,0 +1,125 @@
+package cyclist
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	defaultLaunchReaperInterval = time.Minute
+)
+
+// launchTimeoutReaper completes launching lifecycle actions for instances that
+// haven't reported their launch within the launch timeout, rather than leaving
+// them in Pending:Wait until the hook's own timeout.
+type launchTimeoutReaper struct {
+	db     repo
+	log    logrus.FieldLogger
+	asSvc  autoscalingiface.AutoScalingAPI
+	result string
+
+	launchTimeout time.Duration
+	interval      time.Duration
+}
+
+func newLaunchTimeoutReaper(db repo, log logrus.FieldLogger, asSvc autoscalingiface.AutoScalingAPI, launchTimeout time.Duration, result string) (*launchTimeoutReaper, error) {
+	if result != lifecycleActionResultContinue && result != lifecycleActionResultAbandon {
+		return nil, fmt.Errorf("invalid launch timeout result %q", result)
+	}
+
+	return &launchTimeoutReaper{
+		db:     db,
+		log:    log.WithField("self", "launch_timeout_reaper"),
+		asSvc:  asSvc,
+		result: result,
+
+		launchTimeout: launchTimeout,
+		interval:      defaultLaunchReaperInterval,
+	}, nil
+}
+
+func (ltr *launchTimeoutReaper) Run(ctx context.Context) {
+	ltr.log.WithFields(logrus.Fields{
+		"launch_timeout": ltr.launchTimeout.String(),
+		"result":         ltr.result,
+	}).Info("starting")
+
+	ticker := time.NewTicker(ltr.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			ltr.log.Info("stopping")
+			return
+		case <-ticker.C:
+			err := ltr.reap()
+			if err != nil {
+				ltr.log.WithField("err", err).Error("failed to reap launch timeouts")
+			}
+		}
+	}
+}
+
+func (ltr *launchTimeoutReaper) reap() error {
+	actions, err := ltr.db.fetchPendingLifecycleActions("launching")
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	for _, la := range actions {
+		log := ltr.log.WithFields(logrus.Fields{
+			"instance":  la.EC2InstanceID,
+			"hook_name": la.LifecycleHookName,
+		})
+
+		launchedAt, ok := la.Timestamp()
+		if le, _ := ltr.db.fetchInstanceEvent(la.EC2InstanceID, "prelaunching"); le != nil {
+			launchedAt, ok = le.Timestamp, true
+		}
+
+		if !ok || now.Sub(launchedAt) < ltr.launchTimeout {
+			continue
+		}
+
+		log.WithField("age", now.Sub(launchedAt).String()).Warn("launch timed out")
+
+		err = completeLifecycleAction(la, ltr.result, log, ltr.asSvc)
+		if isLifecycleActionExpired(err) {
+			err = expireLifecycleAction(ltr.db, log, "launching", la)
+			if err != nil {
+				log.WithField("err", err).Warn("failed to expire lifecycle action")
+			}
+			continue
+		}
+		if err != nil {
+			log.WithField("err", err).Error("failed to complete timed out lifecycle action")
+			continue
+		}
+
+		err = ltr.db.completeInstanceLifecycleAction("launching", la.EC2InstanceID, la.LifecycleHookName)
+		if err != nil {
+			log.WithField("err", err).Warn("failed to set lifecycle action bits")
+		}
+
+		if ltr.result == lifecycleActionResultAbandon {
+			err = ltr.db.setInstanceState(la.EC2InstanceID, "down")
+			if err != nil {
+				log.WithField("err", err).Warn("failed to set instance state down")
+			}
+		}
+
+		err = ltr.db.storeInstanceEvent(la.EC2InstanceID, "launch_timeout")
+		if err != nil {
+			log.WithField("err", err).Warn("failed to store launch timeout event")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+package cyclist
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestLaunchingRepo(age time.Duration) *testRepo {
+	db := newTestRepo()
+	_ = db.setInstanceState("i-fafafaf", "up")
+	_ = db.storeInstanceLifecycleAction(&lifecycleAction{
+		LifecycleTransition:  "autoscaling:EC2_INSTANCE_LAUNCHING",
+		EC2InstanceID:        "i-fafafaf",
+		LifecycleActionToken: "TOKEYTOKETOK",
+		AutoScalingGroupName: "cat-theatre-napkin-hose",
+		LifecycleHookName:    "huzzah-9001",
+	})
+	_ = db.storeInstanceEvent("i-fafafaf", "prelaunching")
+	db.e["i-fafafaf"]["prelaunching"].Timestamp = time.Now().Add(-age)
+	return db
+}
+
+func TestNewLaunchTimeoutReaper_InvalidResult(t *testing.T) {
+	ltr, err := newLaunchTimeoutReaper(newTestRepo(), shushLog, nil, time.Minute, "SHRUG")
+	assert.Nil(t, ltr)
+	assert.NotNil(t, err)
+}
+
+func TestLaunchTimeoutReaper_reap(t *testing.T) {
+	db := newTestLaunchingRepo(time.Hour)
+	results := []string{}
+	asSvc := newTestAutoScalingService(func(r *request.Request) {
+		v, ok := r.Params.(*autoscaling.CompleteLifecycleActionInput)
+		if !ok {
+			r.Error = errors.New("unexpected request")
+			return
+		}
+		results = append(results, *v.LifecycleActionResult)
+	})
+
+	ltr, err := newLaunchTimeoutReaper(db, shushLog, asSvc, 10*time.Minute, lifecycleActionResultAbandon)
+	assert.Nil(t, err)
+
+	assert.Nil(t, ltr.reap())
+	assert.Equal(t, []string{"ABANDON"}, results)
+	assert.True(t, db.la["launching:i-fafafaf:huzzah-9001"].Completed)
+	assert.Equal(t, "down", db.s["i-fafafaf"])
+	assert.NotNil(t, db.e["i-fafafaf"]["launch_timeout"])
+
+	assert.Nil(t, ltr.reap())
+	assert.Len(t, results, 1)
+}
+
+func TestLaunchTimeoutReaper_reap_Continue(t *testing.T) {
+	db := newTestLaunchingRepo(time.Hour)
+	ltr, err := newLaunchTimeoutReaper(db, shushLog, newTestAutoScalingService(nil),
+		10*time.Minute, lifecycleActionResultContinue)
+	assert.Nil(t, err)
+
+	assert.Nil(t, ltr.reap())
+	assert.Equal(t, "up", db.s["i-fafafaf"])
+	assert.NotNil(t, db.e["i-fafafaf"]["launch_timeout"])
+}
+
+func TestLaunchTimeoutReaper_reap_Expired(t *testing.T) {
+	db := newTestLaunchingRepo(time.Hour)
+	asSvc := newTestAutoScalingService(func(r *request.Request) {
+		r.Error = awserr.New("ValidationError", "No active Lifecycle Action found", nil)
+	})
+
+	ltr, err := newLaunchTimeoutReaper(db, shushLog, asSvc, 10*time.Minute, lifecycleActionResultAbandon)
+	assert.Nil(t, err)
+
+	assert.Nil(t, ltr.reap())
+	assert.True(t, db.la["launching:i-fafafaf:huzzah-9001"].Expired)
+	assert.NotNil(t, db.e["i-fafafaf"]["launching_expired"])
+	assert.Nil(t, db.e["i-fafafaf"]["launch_timeout"])
+}
+
+func TestLaunchTimeoutReaper_reap_NotYet(t *testing.T) {
+	db := newTestLaunchingRepo(time.Minute)
+	asSvc := newTestAutoScalingService(func(r *request.Request) {
+		r.Error = errors.New("should not be called")
+	})
+
+	ltr, err := newLaunchTimeoutReaper(db, shushLog, asSvc, 10*time.Minute, lifecycleActionResultAbandon)
+	assert.Nil(t, err)
+
+	assert.Nil(t, ltr.reap())
+	assert.False(t, db.la["launching:i-fafafaf:huzzah-9001"].Completed)
+	assert.Nil(t, db.e["i-fafafaf"]["launch_timeout"])
+}
+
+func TestLaunchTimeoutReaper_Run(t *testing.T) {
+	db := newTestLaunchingRepo(time.Hour)
+	ltr, err := newLaunchTimeoutReaper(db, shushLog, newTestAutoScalingService(nil),
+		10*time.Minute, lifecycleActionResultAbandon)
+	assert.Nil(t, err)
+	ltr.interval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	ltr.Run(ctx)
+	assert.True(t, db.la["launching:i-fafafaf:huzzah-9001"].Completed)
+}
@@ -1,10 +1,17 @@
 package cyclist
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
 	"github.com/gorilla/mux"
@@ -12,6 +19,52 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	lifecycleActionResultContinue = "CONTINUE"
+	lifecycleActionResultAbandon  = "ABANDON"
+
+	implosionActionTerminate             = "terminate"
+	implosionActionTerminateAndDecrement = "terminate_and_decrement"
+	implosionActionReplace               = "replace"
+
+	lifecycleActionErrCodeExpired     = "lifecycle_action_expired"
+	lifecycleActionErrCodeUnavailable = "lifecycle_action_unavailable"
+)
+
+var (
+	abandonReasonRegexp  = regexp.MustCompile(`[^a-z0-9_-]+`)
+	maxAbandonReasonSize = 64
+
+	// completing lifecycle actions is retried on top of the SDK's own retries,
+	// and within HTTP handlers, so these are kept short
+	completeLifecycleActionAttempts = 3
+	completeLifecycleActionBackoff  = 200 * time.Millisecond
+)
+
+// lifecycleActionError is returned when completing a lifecycle action has
+// failed in a way that retrying it will not fix, with a stable code that
+// instances may use to decide to stop trying
+type lifecycleActionError struct {
+	Code string
+	Err  error
+}
+
+func (lae *lifecycleActionError) Error() string {
+	return lae.Err.Error()
+}
+
+func (lae *lifecycleActionError) status() int {
+	if lae.Code == lifecycleActionErrCodeExpired {
+		return http.StatusGone
+	}
+	return http.StatusServiceUnavailable
+}
+
+func isLifecycleActionExpired(err error) bool {
+	lae, ok := errors.Cause(err).(*lifecycleActionError)
+	return ok && lae.Code == lifecycleActionErrCodeExpired
+}
+
 func handleLaunchingLifecycleTransition(db repo, instanceID string) error {
 	err := db.setInstanceState(instanceID, "up")
 	if err != nil {
@@ -21,6 +74,17 @@ func handleLaunchingLifecycleTransition(db repo, instanceID string) error {
 	return db.storeInstanceEvent(instanceID, "launching")
 }
 
+// handleWarmedLifecycleTransition keeps instances that have been launched into
+// or returned to a warm pool down until they are launched into service
+func handleWarmedLifecycleTransition(db repo, instanceID, event string) error {
+	err := db.setInstanceState(instanceID, "down")
+	if err != nil {
+		return err
+	}
+
+	return db.storeInstanceEvent(instanceID, event)
+}
+
 func handleTerminatingLifecycleTransition(db repo, instanceID string) error {
 	err := db.wipeInstanceState(instanceID)
 	if err != nil {
@@ -30,76 +94,257 @@ func handleTerminatingLifecycleTransition(db repo, instanceID string) error {
 	return db.storeInstanceEvent(instanceID, "terminating")
 }
 
+// handleLifecycleTransition completes the pending lifecycle actions of every
+// hook for the transition, or only those of the named hook, and hands the
+// instance to the transition handler once no hooks remain pending. Hooks whose
+// lifecycle action has expired are marked expired while the others are still
+// completed, and the expiry is returned once all of them were attempted.
 func handleLifecycleTransition(db repo, log logrus.FieldLogger,
-	asSvc autoscalingiface.AutoScalingAPI, transition, instanceID string) error {
+	asSvc autoscalingiface.AutoScalingAPI, transition, instanceID, hookName string) error {
 
 	log = log.WithFields(logrus.Fields{
 		"transition": transition,
 	})
 
-	action, err := db.fetchInstanceLifecycleAction(transition, instanceID)
+	actions, err := db.fetchInstanceLifecycleActions(transition, instanceID)
 	if err != nil {
 		return err
 	}
 
-	if action == nil {
+	if len(actions) == 0 {
 		return fmt.Errorf("no lifecycle transition '%s' for instance '%s'",
 			transition, instanceID)
 	}
 
-	if action.Completed {
+	pending := []*lifecycleAction{}
+	remaining := 0
+	for _, action := range actions {
+		if action.Completed {
+			continue
+		}
+
+		if hookName != "" && action.LifecycleHookName != hookName {
+			remaining++
+			continue
+		}
+
+		pending = append(pending, action)
+	}
+
+	if len(pending) == 0 {
+		if hookName != "" && remaining > 0 {
+			return fmt.Errorf("no pending lifecycle hook '%s' for transition '%s' for instance '%s'",
+				hookName, transition, instanceID)
+		}
 		log.Info("already completed")
 		return nil
 	}
 
-	err = completeLifecycleAction(action, log, asSvc)
+	h, ok := lifecycleTransitions.handler(transition, pending[0].AutoScalingGroupName)
+	if !ok {
+		return fmt.Errorf("unknown lifecycle transition '%s'", transition)
+	}
+
+	var expiredErr error
+	for _, action := range pending {
+		hookLog := log.WithField("hook_name", action.LifecycleHookName)
+
+		result, err := h.OnInstanceConfirmation(db, hookLog, action)
+		if err != nil {
+			return err
+		}
+
+		err = completeLifecycleAction(action, result, hookLog, asSvc)
+		if isLifecycleActionExpired(err) {
+			if expErr := expireLifecycleAction(db, hookLog, transition, action); expErr != nil {
+				hookLog.WithField("err", expErr).Warn("failed to expire lifecycle action")
+			}
+			expiredErr = err
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		err = db.completeInstanceLifecycleAction(transition, instanceID, action.LifecycleHookName)
+		if err != nil {
+			hookLog.WithField("err", err).Warn("failed to set lifecycle action bits")
+		}
+	}
+
+	if remaining > 0 {
+		log.WithField("remaining", remaining).Info("waiting on remaining lifecycle hooks")
+		return expiredErr
+	}
+
+	log.Info("sending to transition handler")
+	err = h.OnComplete(db, log, pending[0])
 	if err != nil {
 		return err
 	}
+	return expiredErr
+}
+
+func handleAbandonedLaunchingLifecycleTransition(db repo, log logrus.FieldLogger,
+	asSvc autoscalingiface.AutoScalingAPI, instanceID, reason string) (int, error) {
 
-	err = db.completeInstanceLifecycleAction(transition, instanceID)
+	actions, err := db.fetchInstanceLifecycleActions("launching", instanceID)
 	if err != nil {
-		log.WithField("err", err).Warn("failed to set lifecycle action bits")
+		return http.StatusInternalServerError, err
 	}
 
-	switch transition {
-	case "launching":
-		log.Info("sending to transition handler")
-		return handleLaunchingLifecycleTransition(db, instanceID)
-	case "terminating":
-		log.Info("sending to transition handler")
-		return handleTerminatingLifecycleTransition(db, instanceID)
-	default:
-		return fmt.Errorf("unknown lifecycle transition '%s'", transition)
+	if len(actions) == 0 {
+		return http.StatusBadRequest, fmt.Errorf("no lifecycle transition 'launching' for instance '%s'",
+			instanceID)
+	}
+
+	pending := []*lifecycleAction{}
+	for _, action := range actions {
+		if !action.Completed {
+			pending = append(pending, action)
+		}
+	}
+
+	if len(pending) == 0 {
+		return http.StatusConflict, fmt.Errorf("lifecycle transition 'launching' for instance '%s' already completed",
+			instanceID)
 	}
+
+	var expiredErr *lifecycleActionError
+	for _, action := range pending {
+		hookLog := log.WithField("hook_name", action.LifecycleHookName)
+
+		err = completeLifecycleAction(action, lifecycleActionResultAbandon, hookLog, asSvc)
+		if isLifecycleActionExpired(err) {
+			if expErr := expireLifecycleAction(db, hookLog, "launching", action); expErr != nil {
+				hookLog.WithField("err", expErr).Warn("failed to expire lifecycle action")
+			}
+			expiredErr = err.(*lifecycleActionError)
+			continue
+		}
+		if lae, ok := err.(*lifecycleActionError); ok {
+			return lae.status(), err
+		}
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+
+		err = db.completeInstanceLifecycleAction("launching", instanceID, action.LifecycleHookName)
+		if err != nil {
+			hookLog.WithField("err", err).Warn("failed to set lifecycle action bits")
+		}
+	}
+
+	err = db.setInstanceState(instanceID, "down")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	event := "abandoned"
+	if reason != "" {
+		event = fmt.Sprintf("abandoned:%s", reason)
+	}
+
+	err = db.storeInstanceEvent(instanceID, event)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if expiredErr != nil {
+		return expiredErr.status(), expiredErr
+	}
+	return http.StatusOK, nil
 }
 
-func completeLifecycleAction(la *lifecycleAction, log logrus.FieldLogger, asSvc autoscalingiface.AutoScalingAPI) error {
+// cleanAbandonReason reduces a free-form reason to something suitable for use
+// in an event name
+func cleanAbandonReason(reason string) string {
+	reason = abandonReasonRegexp.ReplaceAllString(strings.ToLower(strings.TrimSpace(reason)), "_")
+	reason = strings.Trim(reason, "_")
+	if len(reason) > maxAbandonReasonSize {
+		reason = reason[:maxAbandonReasonSize]
+	}
+	return reason
+}
+
+// completeLifecycleAction completes the lifecycle action with the given result,
+// retrying with backoff when throttled or on server errors, and classifying
+// failures due to an expired token or missing instance
+func completeLifecycleAction(la *lifecycleAction, result string, log logrus.FieldLogger, asSvc autoscalingiface.AutoScalingAPI) error {
 	log.WithFields(logrus.Fields{
 		"asg":       la.AutoScalingGroupName,
 		"hook_name": la.LifecycleHookName,
+		"result":    result,
 	}).Info("completing lifecycle action")
 
 	input := &autoscaling.CompleteLifecycleActionInput{
 		AutoScalingGroupName:  aws.String(la.AutoScalingGroupName),
 		InstanceId:            aws.String(la.EC2InstanceID),
-		LifecycleActionResult: aws.String("CONTINUE"),
-		LifecycleActionToken:  aws.String(la.LifecycleActionToken),
+		LifecycleActionResult: aws.String(result),
+		LifecycleActionToken:  la.token(),
 		LifecycleHookName:     aws.String(la.LifecycleHookName),
 	}
-	_, err := asSvc.CompleteLifecycleAction(input)
-	return err
+
+	var err error
+	for attempt := 0; attempt < completeLifecycleActionAttempts; attempt++ {
+		if attempt > 0 {
+			backoff := completeLifecycleActionBackoff * time.Duration(1<<uint(attempt-1))
+			log.WithFields(logrus.Fields{
+				"err":     err,
+				"attempt": attempt,
+				"backoff": backoff.String(),
+			}).Warn("retrying completing lifecycle action")
+			time.Sleep(backoff)
+		}
+
+		_, err = asSvc.CompleteLifecycleAction(input)
+		if err == nil {
+			return nil
+		}
+
+		if isLifecycleActionErrorRetryable(err) {
+			continue
+		}
+
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "ValidationError" {
+			return &lifecycleActionError{Code: lifecycleActionErrCodeExpired, Err: err}
+		}
+
+		return err
+	}
+
+	return &lifecycleActionError{Code: lifecycleActionErrCodeUnavailable, Err: err}
 }
 
-func newLifecycleHandlerFunc(transition string, db repo,
+func isLifecycleActionErrorRetryable(err error) bool {
+	if request.IsErrorThrottle(err) {
+		return true
+	}
+
+	if rerr, ok := err.(awserr.RequestFailure); ok && rerr.StatusCode() >= 500 {
+		return true
+	}
+
+	return false
+}
+
+// expireLifecycleAction marks a lifecycle action that can no longer be
+// completed as completed and expired, so that nothing tries it again
+func expireLifecycleAction(db repo, log logrus.FieldLogger, transition string, la *lifecycleAction) error {
+	log.Warn("lifecycle action expired")
+
+	err := db.expireInstanceLifecycleAction(transition, la.EC2InstanceID, la.LifecycleHookName)
+	if err != nil {
+		return err
+	}
+
+	return db.storeInstanceEvent(la.EC2InstanceID, fmt.Sprintf("%s_expired", transition))
+}
+
+func newLifecycleHandlerFunc(lt *lifecycleTransition, db repo,
 	log logrus.FieldLogger,
 	asSvc autoscalingiface.AutoScalingAPI) http.HandlerFunc {
 
-	gerund := (map[string]string{
-		"launch":      "launching",
-		"termination": "terminating",
-	})[transition]
-
 	return func(w http.ResponseWriter, r *http.Request) {
 		instanceID := mux.Vars(r)["instance_id"]
 		log = log.WithFields(logrus.Fields{
@@ -108,7 +353,18 @@ func newLifecycleHandlerFunc(transition string, db repo,
 			"instance": instanceID,
 		})
 		err := handleLifecycleTransition(
-			db, log, asSvc, gerund, instanceID)
+			db, log, asSvc, lt.Name, instanceID, r.URL.Query().Get("hook_name"))
+		if lae, ok := errors.Cause(err).(*lifecycleActionError); ok {
+			log.WithFields(logrus.Fields{
+				"err":  err,
+				"code": lae.Code,
+			}).Error("handling lifecycle transition failed")
+			jsonRespond(w, lae.status(), &jsonErr{
+				Err:  errors.Wrap(err, "handling lifecycle transition failed"),
+				Code: lae.Code,
+			})
+			return
+		}
 		if err != nil {
 			log.WithField("err", err).Error("handling lifecycle transition failed")
 			jsonRespond(w, http.StatusBadRequest, &jsonErr{
@@ -118,33 +374,160 @@ func newLifecycleHandlerFunc(transition string, db repo,
 		}
 
 		jsonRespond(w, http.StatusOK, &jsonMsg{
-			Message: fmt.Sprintf("instance %s complete", transition),
+			Message: fmt.Sprintf("instance %s complete", lt.Noun),
 		})
 	}
 }
 
-func newImplosionsHandlerFunc(db repo, log logrus.FieldLogger) http.HandlerFunc {
+func newAbandonmentsHandlerFunc(db repo, log logrus.FieldLogger,
+	asSvc autoscalingiface.AutoScalingAPI) http.HandlerFunc {
+
 	return func(w http.ResponseWriter, r *http.Request) {
 		instanceID := mux.Vars(r)["instance_id"]
-		log = log.WithField("instance", instanceID)
-		err := db.setInstanceState(instanceID, "down")
-		if err != nil {
-			log.WithField("err", err).Error("setting instance state down failed")
-			jsonRespond(w, http.StatusInternalServerError, &jsonErr{
-				Err: errors.Wrap(err, "setting instance state down failed"),
+		log = log.WithFields(logrus.Fields{
+			"path":     r.URL.Path,
+			"method":   r.Method,
+			"instance": instanceID,
+		})
+
+		body := &jsonAbandonment{}
+		err := json.NewDecoder(r.Body).Decode(body)
+		if err != nil && err != io.EOF {
+			log.WithField("err", err).Error("invalid json received")
+			jsonRespond(w, http.StatusBadRequest, &jsonErr{
+				Err: errors.Wrap(err, "invalid json received"),
 			})
 			return
 		}
-		err = db.storeInstanceEvent(instanceID, "implosion")
+
+		reason := cleanAbandonReason(body.Reason)
+		log = log.WithField("reason", reason)
+
+		status, err := handleAbandonedLaunchingLifecycleTransition(
+			db, log, asSvc, instanceID, reason)
 		if err != nil {
-			log.WithField("err", err).Error("storing implosion event failed")
-			jsonRespond(w, http.StatusInternalServerError, &jsonErr{
-				Err: errors.Wrap(err, "storing implosion event failed"),
+			log.WithField("err", err).Error("abandoning launch failed")
+			code := ""
+			if lae, ok := err.(*lifecycleActionError); ok {
+				code = lae.Code
+			}
+			jsonRespond(w, status, &jsonErr{
+				Err:  errors.Wrap(err, "abandoning launch failed"),
+				Code: code,
 			})
 			return
 		}
 
-		jsonRespond(w, http.StatusOK, &jsonMsg{
+		jsonRespond(w, status, &jsonMsg{
+			Message: "instance launch abandoned",
+		})
+	}
+}
+
+// handleImplosion sets the instance down and records the implosion, then asks
+// the auto scaling group to get rid of the instance if an action was chosen.
+// The implosion is recorded first so that the terminating lifecycle action
+// that follows is completed right away, while the action is only recorded once
+// the auto scaling group has accepted it, as a recorded action is taken to mean
+// that the instance is on its way out.
+func handleImplosion(db repo, log logrus.FieldLogger,
+	asSvc autoscalingiface.AutoScalingAPI, instanceID, action string) (int, error) {
+
+	switch action {
+	case "", implosionActionTerminate, implosionActionTerminateAndDecrement, implosionActionReplace:
+	default:
+		return http.StatusBadRequest, fmt.Errorf("unknown implosion action '%s'", action)
+	}
+
+	err := db.setInstanceState(instanceID, "down")
+	if err != nil {
+		return http.StatusInternalServerError, errors.Wrap(err, "setting instance state down failed")
+	}
+
+	err = db.storeInstanceEvent(instanceID, "implosion")
+	if err != nil {
+		return http.StatusInternalServerError, errors.Wrap(err, "storing implosion event failed")
+	}
+
+	if action == "" {
+		return http.StatusOK, nil
+	}
+
+	log.WithField("action", action).Info("removing imploded instance")
+
+	err = removeImplodedInstance(asSvc, instanceID, action)
+	if err != nil {
+		return http.StatusInternalServerError, errors.Wrap(err, "removing imploded instance failed")
+	}
+
+	err = db.storeInstanceEvent(instanceID, fmt.Sprintf("implosion:%s", action))
+	if err != nil {
+		return http.StatusInternalServerError, errors.Wrap(err, "storing implosion action event failed")
+	}
+
+	return http.StatusOK, nil
+}
+
+// removeImplodedInstance asks the auto scaling group to terminate the instance,
+// or to replace it by marking it unhealthy, according to the implosion action
+func removeImplodedInstance(asSvc autoscalingiface.AutoScalingAPI, instanceID, action string) error {
+	if action == implosionActionReplace {
+		_, err := asSvc.SetInstanceHealth(&autoscaling.SetInstanceHealthInput{
+			InstanceId:               aws.String(instanceID),
+			HealthStatus:             aws.String("Unhealthy"),
+			ShouldRespectGracePeriod: aws.Bool(false),
+		})
+		return err
+	}
+
+	_, err := asSvc.TerminateInstanceInAutoScalingGroup(&autoscaling.TerminateInstanceInAutoScalingGroupInput{
+		InstanceId:                     aws.String(instanceID),
+		ShouldDecrementDesiredCapacity: aws.Bool(action == implosionActionTerminateAndDecrement),
+	})
+	return err
+}
+
+// fetchImplosionAction returns the action chosen when the instance imploded,
+// if any
+func fetchImplosionAction(db repo, instanceID string) string {
+	events, err := db.fetchInstanceEvents(instanceID)
+	if err != nil {
+		return ""
+	}
+
+	for _, le := range events {
+		if strings.HasPrefix(le.Event, "implosion:") {
+			return strings.TrimPrefix(le.Event, "implosion:")
+		}
+	}
+	return ""
+}
+
+func newImplosionsHandlerFunc(db repo, log logrus.FieldLogger,
+	asSvc autoscalingiface.AutoScalingAPI) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		instanceID := mux.Vars(r)["instance_id"]
+		log = log.WithField("instance", instanceID)
+
+		body := &jsonImplosion{}
+		err := json.NewDecoder(r.Body).Decode(body)
+		if err != nil && err != io.EOF {
+			log.WithField("err", err).Error("invalid json received")
+			jsonRespond(w, http.StatusBadRequest, &jsonErr{
+				Err: errors.Wrap(err, "invalid json received"),
+			})
+			return
+		}
+
+		status, err := handleImplosion(db, log, asSvc, instanceID, body.Action)
+		if err != nil {
+			log.WithField("err", err).Error("handling implosion failed")
+			jsonRespond(w, status, &jsonErr{Err: err})
+			return
+		}
+
+		jsonRespond(w, status, &jsonMsg{
 			Message: fmt.Sprintf("instance implosion recorded"),
 		})
 	}
@@ -198,6 +581,14 @@ func newAllLifecycleEventsHandlerFunc(db repo, log logrus.FieldLogger) http.Hand
 	}
 }
 
+type jsonAbandonment struct {
+	Reason string `json:"reason"`
+}
+
+type jsonImplosion struct {
+	Action string `json:"action"`
+}
+
 type jsonLifecycleEvents struct {
 	Events     []*lifecycleEvent `json:"events"`
 	InstanceID string            `json:"@instance_id"`
@@ -1,6 +1,14 @@
 package cyclist
 
-import "strings"
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	lifecycleLocationWarmPool = "WarmPool"
+)
 
 type lifecycleAction struct {
 	Event                string
@@ -13,10 +21,55 @@ type lifecycleAction struct {
 	LifecycleActionToken string `redis:"lifecycle_action_token"`
 	EC2InstanceID        string `json:"EC2InstanceId"`
 	LifecycleHookName    string `redis:"lifecycle_hook_name"`
+	Origin               string `redis:"origin"`
+	Destination          string `redis:"destination"`
 
 	Completed bool `redis:"completed"`
+	Expired   bool `redis:"expired"`
+}
+
+// token is nil for lifecycle actions without a token, such as those made up by
+// the reconciler, in which case AWS identifies them by their instance ID
+func (la *lifecycleAction) token() *string {
+	if la.LifecycleActionToken == "" {
+		return nil
+	}
+	return &la.LifecycleActionToken
+}
+
+// lifecycleActionKey identifies a lifecycle action in the repos that keep them
+// in a single keyspace, such that the actions of a transition and instance
+// share a prefix
+func lifecycleActionKey(transition, instanceID, hookName string) string {
+	return fmt.Sprintf("%s:%s:%s", transition, instanceID, hookName)
 }
 
 func (la *lifecycleAction) Transition() string {
 	return strings.ToLower(strings.Replace(la.LifecycleTransition, "autoscaling:EC2_INSTANCE_", "", -1))
 }
+
+// toWarmPool is true for instances being launched into or returned to a warm
+// pool rather than entering or leaving service
+func (la *lifecycleAction) toWarmPool() bool {
+	return la.Destination == lifecycleLocationWarmPool
+}
+
+// fromWarmPool is true for instances leaving a warm pool
+func (la *lifecycleAction) fromWarmPool() bool {
+	return la.Origin == lifecycleLocationWarmPool
+}
+
+// Timestamp returns the parsed Time of the lifecycle action, if any
+func (la *lifecycleAction) Timestamp() (time.Time, bool) {
+	ts, err := time.Parse(time.RFC3339Nano, la.Time)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return ts, true
+}
+
+// instanceTransition is the last lifecycle transition applied to an instance
+type instanceTransition struct {
+	Transition string
+	Time       time.Time
+}
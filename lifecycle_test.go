@@ -0,0 +1,264 @@
+package cyclist
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/stretchr/testify/assert"
+)
+
+func withTestCompleteLifecycleActionBackoff(t *testing.T, f func()) {
+	origBackoff := completeLifecycleActionBackoff
+	completeLifecycleActionBackoff = time.Millisecond
+	defer func() { completeLifecycleActionBackoff = origBackoff }()
+	f()
+}
+
+func newTestFailingAutoScalingService(calls *int, errs ...error) func(*request.Request) {
+	return func(r *request.Request) {
+		if *calls < len(errs) {
+			r.Error = errs[*calls]
+		}
+		*calls++
+	}
+}
+
+func TestCompleteLifecycleAction_RetriesThrottled(t *testing.T) {
+	withTestCompleteLifecycleActionBackoff(t, func() {
+		calls := 0
+		asSvc := newTestAutoScalingService(newTestFailingAutoScalingService(&calls,
+			awserr.New("Throttling", "Rate exceeded", nil),
+			awserr.NewRequestFailure(awserr.New("InternalFailure", "oh no", nil), 500, "req-1"),
+		))
+
+		err := completeLifecycleAction(&lifecycleAction{
+			EC2InstanceID:     "i-fafafaf",
+			LifecycleHookName: "huzzah-9001",
+		}, lifecycleActionResultContinue, shushLog, asSvc)
+		assert.Nil(t, err)
+		assert.Equal(t, 3, calls)
+	})
+}
+
+func TestCompleteLifecycleAction_RetriesExhausted(t *testing.T) {
+	withTestCompleteLifecycleActionBackoff(t, func() {
+		calls := 0
+		errs := []error{}
+		for i := 0; i < completeLifecycleActionAttempts; i++ {
+			errs = append(errs, awserr.New("Throttling", "Rate exceeded", nil))
+		}
+		asSvc := newTestAutoScalingService(newTestFailingAutoScalingService(&calls, errs...))
+
+		err := completeLifecycleAction(&lifecycleAction{
+			EC2InstanceID:     "i-fafafaf",
+			LifecycleHookName: "huzzah-9001",
+		}, lifecycleActionResultContinue, shushLog, asSvc)
+		assert.NotNil(t, err)
+		assert.Equal(t, completeLifecycleActionAttempts, calls)
+
+		lae, ok := err.(*lifecycleActionError)
+		assert.True(t, ok)
+		assert.Equal(t, lifecycleActionErrCodeUnavailable, lae.Code)
+		assert.False(t, isLifecycleActionExpired(err))
+	})
+}
+
+func TestCompleteLifecycleAction_Expired(t *testing.T) {
+	calls := 0
+	asSvc := newTestAutoScalingService(newTestFailingAutoScalingService(&calls,
+		awserr.NewRequestFailure(awserr.New("ValidationError",
+			"No active Lifecycle Action found with token TOKEYTOKETOK", nil), 400, "req-1"),
+	))
+
+	err := completeLifecycleAction(&lifecycleAction{
+		EC2InstanceID:     "i-fafafaf",
+		LifecycleHookName: "huzzah-9001",
+	}, lifecycleActionResultContinue, shushLog, asSvc)
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, calls)
+	assert.True(t, isLifecycleActionExpired(err))
+}
+
+func TestCompleteLifecycleAction_OtherError(t *testing.T) {
+	calls := 0
+	asSvc := newTestAutoScalingService(newTestFailingAutoScalingService(&calls,
+		awserr.NewRequestFailure(awserr.New("AccessDenied", "nope", nil), 403, "req-1"),
+	))
+
+	err := completeLifecycleAction(&lifecycleAction{
+		EC2InstanceID:     "i-fafafaf",
+		LifecycleHookName: "huzzah-9001",
+	}, lifecycleActionResultContinue, shushLog, asSvc)
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, calls)
+
+	_, ok := err.(*lifecycleActionError)
+	assert.False(t, ok)
+}
+
+func TestHandleLifecycleTransition_Expired(t *testing.T) {
+	db := newTestRepo()
+	_ = db.setInstanceState("i-fafafaf", "up")
+	_ = db.storeInstanceLifecycleAction(&lifecycleAction{
+		LifecycleTransition:  "launching",
+		EC2InstanceID:        "i-fafafaf",
+		LifecycleActionToken: "TOKEYTOKETOK",
+		AutoScalingGroupName: "whimsical-mime-headphone",
+		LifecycleHookName:    "greased-banana-net",
+	})
+
+	calls := 0
+	asSvc := newTestAutoScalingService(newTestFailingAutoScalingService(&calls,
+		awserr.New("ValidationError", "No active Lifecycle Action found", nil),
+	))
+
+	err := handleLifecycleTransition(db, shushLog, asSvc, "launching", "i-fafafaf", "")
+	assert.True(t, isLifecycleActionExpired(err))
+
+	la := db.la["launching:i-fafafaf:greased-banana-net"]
+	assert.True(t, la.Completed)
+	assert.True(t, la.Expired)
+	assert.NotNil(t, db.e["i-fafafaf"]["launching_expired"])
+
+	err = handleLifecycleTransition(db, shushLog, asSvc, "launching", "i-fafafaf", "")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestHandleLifecycleTransition_ExpiredWithOtherHooks(t *testing.T) {
+	db := newTestRepo()
+	_ = db.setInstanceState("i-fafafaf", "down")
+	for _, hookName := range []string{"greased-banana-net", "soggy-waffle-iron"} {
+		_ = db.storeInstanceLifecycleAction(&lifecycleAction{
+			LifecycleTransition:  "launching",
+			EC2InstanceID:        "i-fafafaf",
+			AutoScalingGroupName: "whimsical-mime-headphone",
+			LifecycleHookName:    hookName,
+		})
+	}
+
+	completed := []string{}
+	asSvc := newTestAutoScalingService(func(r *request.Request) {
+		v := r.Params.(*autoscaling.CompleteLifecycleActionInput)
+		if *v.LifecycleHookName == "greased-banana-net" {
+			r.Error = awserr.New("ValidationError", "No active Lifecycle Action found", nil)
+			return
+		}
+		completed = append(completed, *v.LifecycleHookName)
+	})
+
+	err := handleLifecycleTransition(db, shushLog, asSvc, "launching", "i-fafafaf", "")
+	assert.True(t, isLifecycleActionExpired(err))
+	assert.Equal(t, []string{"soggy-waffle-iron"}, completed)
+
+	assert.True(t, db.la["launching:i-fafafaf:greased-banana-net"].Expired)
+	assert.True(t, db.la["launching:i-fafafaf:soggy-waffle-iron"].Completed)
+	assert.False(t, db.la["launching:i-fafafaf:soggy-waffle-iron"].Expired)
+	assert.Equal(t, "up", db.s["i-fafafaf"])
+	assert.NotNil(t, db.e["i-fafafaf"]["launching"])
+}
+
+func TestHandleAbandonedLaunchingLifecycleTransition_Expired(t *testing.T) {
+	db := newTestRepo()
+	_ = db.setInstanceState("i-fafafaf", "up")
+	_ = db.storeInstanceLifecycleAction(&lifecycleAction{
+		LifecycleTransition:  "launching",
+		EC2InstanceID:        "i-fafafaf",
+		AutoScalingGroupName: "whimsical-mime-headphone",
+		LifecycleHookName:    "greased-banana-net",
+	})
+
+	calls := 0
+	asSvc := newTestAutoScalingService(newTestFailingAutoScalingService(&calls,
+		awserr.New("ValidationError", "No active Lifecycle Action found", nil),
+	))
+
+	status, err := handleAbandonedLaunchingLifecycleTransition(db, shushLog, asSvc, "i-fafafaf", "")
+	assert.True(t, isLifecycleActionExpired(err))
+	assert.Equal(t, 410, status)
+	assert.True(t, db.la["launching:i-fafafaf:greased-banana-net"].Expired)
+	assert.Equal(t, "down", db.s["i-fafafaf"])
+	assert.NotNil(t, db.e["i-fafafaf"]["abandoned"])
+}
+
+func TestHandleImplosion(t *testing.T) {
+	for _, tc := range []struct {
+		action    string
+		operation string
+		decrement bool
+	}{
+		{action: "", operation: ""},
+		{action: "terminate", operation: "TerminateInstanceInAutoScalingGroup"},
+		{action: "terminate_and_decrement", operation: "TerminateInstanceInAutoScalingGroup", decrement: true},
+		{action: "replace", operation: "SetInstanceHealth"},
+	} {
+		db := newTestRepo()
+		_ = db.setInstanceState("i-fafafaf", "up")
+
+		operations := []string{}
+		asSvc := newTestAutoScalingService(func(r *request.Request) {
+			operations = append(operations, r.Operation.Name)
+			switch v := r.Params.(type) {
+			case *autoscaling.TerminateInstanceInAutoScalingGroupInput:
+				assert.Equal(t, "i-fafafaf", *v.InstanceId)
+				assert.Equal(t, tc.decrement, *v.ShouldDecrementDesiredCapacity)
+			case *autoscaling.SetInstanceHealthInput:
+				assert.Equal(t, "i-fafafaf", *v.InstanceId)
+				assert.Equal(t, "Unhealthy", *v.HealthStatus)
+			}
+		})
+
+		status, err := handleImplosion(db, shushLog, asSvc, "i-fafafaf", tc.action)
+		assert.Nil(t, err)
+		assert.Equal(t, 200, status)
+		assert.Equal(t, "down", db.s["i-fafafaf"])
+		assert.NotNil(t, db.e["i-fafafaf"]["implosion"])
+
+		if tc.operation == "" {
+			assert.Len(t, operations, 0)
+			assert.Equal(t, "", fetchImplosionAction(db, "i-fafafaf"))
+			continue
+		}
+
+		assert.Equal(t, []string{tc.operation}, operations)
+		assert.Equal(t, tc.action, fetchImplosionAction(db, "i-fafafaf"))
+	}
+}
+
+func TestHandleImplosion_WithFailingAutoScaling(t *testing.T) {
+	db := newTestRepo()
+	_ = db.setInstanceState("i-fafafaf", "up")
+
+	calls := 0
+	asSvc := newTestAutoScalingService(newTestFailingAutoScalingService(&calls,
+		awserr.New("AccessDenied", "nope", nil),
+	))
+
+	status, err := handleImplosion(db, shushLog, asSvc, "i-fafafaf", "terminate")
+	assert.NotNil(t, err)
+	assert.Equal(t, 500, status)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, "down", db.s["i-fafafaf"])
+	assert.NotNil(t, db.e["i-fafafaf"]["implosion"])
+	assert.Equal(t, "", fetchImplosionAction(db, "i-fafafaf"))
+
+	status, err = handleImplosion(db, shushLog, asSvc, "i-fafafaf", "terminate")
+	assert.Nil(t, err)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, "terminate", fetchImplosionAction(db, "i-fafafaf"))
+}
+
+func TestHandleImplosion_UnknownAction(t *testing.T) {
+	db := newTestRepo()
+	_ = db.setInstanceState("i-fafafaf", "up")
+
+	status, err := handleImplosion(db, shushLog, newTestAutoScalingService(nil), "i-fafafaf", "explode")
+	assert.NotNil(t, err)
+	assert.Equal(t, 400, status)
+	assert.Equal(t, "up", db.s["i-fafafaf"])
+	assert.Nil(t, db.e["i-fafafaf"]["implosion"])
+}
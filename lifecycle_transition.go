@@ -0,0 +1,208 @@
+package cyclist
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// lifecycleTransitions is the registry consulted when handling lifecycle
+	// notifications and instance confirmations, to which new transitions and
+	// per-ASG handlers may be added
+	lifecycleTransitions = newDefaultLifecycleTransitionRegistry()
+)
+
+// lifecycleTransitionHandler handles a lifecycle transition through each of
+// its phases: the notification from the auto scaling group, the confirmation
+// from the instance, and the completion of the lifecycle action.
+type lifecycleTransitionHandler interface {
+	OnNotification(db repo, log logrus.FieldLogger, tokGen tokenGenerator, la *lifecycleAction, asSvc autoscalingiface.AutoScalingAPI) error
+	OnInstanceConfirmation(db repo, log logrus.FieldLogger, la *lifecycleAction) (string, error)
+	OnComplete(db repo, log logrus.FieldLogger, la *lifecycleAction) error
+}
+
+// lifecycleTransition describes a transition by its name as found in lifecycle
+// actions, e.g. "launching", the noun and route used by instances to confirm
+// it, e.g. "launch" and "launches", and its phase in the instance lifecycle.
+type lifecycleTransition struct {
+	Name    string
+	Noun    string
+	Route   string
+	Phase   int
+	Handler lifecycleTransitionHandler
+}
+
+type asgLifecycleTransitionHandler struct {
+	pattern    string
+	transition string
+	handler    lifecycleTransitionHandler
+}
+
+type lifecycleTransitionRegistry struct {
+	mutex       sync.RWMutex
+	transitions map[string]*lifecycleTransition
+	asgHandlers []*asgLifecycleTransitionHandler
+}
+
+func newLifecycleTransitionRegistry() *lifecycleTransitionRegistry {
+	return &lifecycleTransitionRegistry{
+		transitions: map[string]*lifecycleTransition{},
+		asgHandlers: []*asgLifecycleTransitionHandler{},
+	}
+}
+
+func newDefaultLifecycleTransitionRegistry() *lifecycleTransitionRegistry {
+	ltr := newLifecycleTransitionRegistry()
+	_ = ltr.register(&lifecycleTransition{
+		Name:    "launching",
+		Noun:    "launch",
+		Route:   "launches",
+		Phase:   1,
+		Handler: &launchingTransitionHandler{},
+	})
+	_ = ltr.register(&lifecycleTransition{
+		Name:    "terminating",
+		Noun:    "termination",
+		Route:   "terminations",
+		Phase:   2,
+		Handler: &terminatingTransitionHandler{},
+	})
+	return ltr
+}
+
+func (ltr *lifecycleTransitionRegistry) register(lt *lifecycleTransition) error {
+	if lt.Name == "" || lt.Noun == "" || lt.Route == "" || lt.Handler == nil {
+		return fmt.Errorf("missing required fields in lifecycle transition: %+v", lt)
+	}
+
+	ltr.mutex.Lock()
+	defer ltr.mutex.Unlock()
+
+	ltr.transitions[lt.Name] = lt
+	return nil
+}
+
+// registerForASG overrides the handler of a registered transition for auto
+// scaling groups matching the name pattern, where the first matching pattern
+// wins
+func (ltr *lifecycleTransitionRegistry) registerForASG(pattern, transition string, h lifecycleTransitionHandler) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid asg name pattern %q: %v", pattern, err)
+	}
+
+	ltr.mutex.Lock()
+	defer ltr.mutex.Unlock()
+
+	if _, ok := ltr.transitions[transition]; !ok {
+		return fmt.Errorf("unknown lifecycle transition %q", transition)
+	}
+
+	ltr.asgHandlers = append(ltr.asgHandlers, &asgLifecycleTransitionHandler{
+		pattern:    pattern,
+		transition: transition,
+		handler:    h,
+	})
+	return nil
+}
+
+func (ltr *lifecycleTransitionRegistry) get(transition string) (*lifecycleTransition, bool) {
+	ltr.mutex.RLock()
+	defer ltr.mutex.RUnlock()
+
+	lt, ok := ltr.transitions[transition]
+	return lt, ok
+}
+
+func (ltr *lifecycleTransitionRegistry) handler(transition, asgName string) (lifecycleTransitionHandler, bool) {
+	ltr.mutex.RLock()
+	defer ltr.mutex.RUnlock()
+
+	lt, ok := ltr.transitions[transition]
+	if !ok {
+		return nil, false
+	}
+
+	for _, ah := range ltr.asgHandlers {
+		if ah.transition != transition {
+			continue
+		}
+
+		if matched, _ := path.Match(ah.pattern, asgName); matched {
+			return ah.handler, true
+		}
+	}
+
+	return lt.Handler, true
+}
+
+func (ltr *lifecycleTransitionRegistry) phase(transition string) (int, bool) {
+	lt, ok := ltr.get(transition)
+	if !ok {
+		return 0, false
+	}
+	return lt.Phase, true
+}
+
+// all returns the registered transitions ordered by phase and name
+func (ltr *lifecycleTransitionRegistry) all() []*lifecycleTransition {
+	ltr.mutex.RLock()
+	defer ltr.mutex.RUnlock()
+
+	res := []*lifecycleTransition{}
+	for _, lt := range ltr.transitions {
+		res = append(res, lt)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Phase == res[j].Phase {
+			return res[i].Name < res[j].Name
+		}
+		return res[i].Phase < res[j].Phase
+	})
+	return res
+}
+
+type launchingTransitionHandler struct{}
+
+func (lth *launchingTransitionHandler) OnNotification(db repo, log logrus.FieldLogger, tokGen tokenGenerator, la *lifecycleAction, asSvc autoscalingiface.AutoScalingAPI) error {
+	err := handleAutoScalingInstanceLaunching(db, log, la)
+	if err != nil {
+		return err
+	}
+
+	log.WithField("action", la).Debug("storing temporary instance token")
+	return db.storeTempInstanceToken(la.EC2InstanceID, tokGen.GenerateToken())
+}
+
+func (lth *launchingTransitionHandler) OnInstanceConfirmation(db repo, log logrus.FieldLogger, la *lifecycleAction) (string, error) {
+	return lifecycleActionResultContinue, nil
+}
+
+func (lth *launchingTransitionHandler) OnComplete(db repo, log logrus.FieldLogger, la *lifecycleAction) error {
+	if la.toWarmPool() {
+		return handleWarmedLifecycleTransition(db, la.EC2InstanceID, "warmed")
+	}
+	return handleLaunchingLifecycleTransition(db, la.EC2InstanceID)
+}
+
+type terminatingTransitionHandler struct{}
+
+func (tth *terminatingTransitionHandler) OnNotification(db repo, log logrus.FieldLogger, tokGen tokenGenerator, la *lifecycleAction, asSvc autoscalingiface.AutoScalingAPI) error {
+	return handleAutoScalingInstanceTerminating(db, log, la, asSvc)
+}
+
+func (tth *terminatingTransitionHandler) OnInstanceConfirmation(db repo, log logrus.FieldLogger, la *lifecycleAction) (string, error) {
+	return lifecycleActionResultContinue, nil
+}
+
+func (tth *terminatingTransitionHandler) OnComplete(db repo, log logrus.FieldLogger, la *lifecycleAction) error {
+	if la.toWarmPool() {
+		return handleWarmedLifecycleTransition(db, la.EC2InstanceID, "returned_to_warm_pool")
+	}
+	return handleTerminatingLifecycleTransition(db, la.EC2InstanceID)
+}
@@ -0,0 +1,140 @@
+package cyclist
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+type testTransitionHandler struct {
+	result   string
+	notified int
+	complete int
+}
+
+func (tth *testTransitionHandler) OnNotification(db repo, log logrus.FieldLogger, tokGen tokenGenerator, la *lifecycleAction, asSvc autoscalingiface.AutoScalingAPI) error {
+	tth.notified++
+	return db.storeInstanceLifecycleAction(la)
+}
+
+func (tth *testTransitionHandler) OnInstanceConfirmation(db repo, log logrus.FieldLogger, la *lifecycleAction) (string, error) {
+	return tth.result, nil
+}
+
+func (tth *testTransitionHandler) OnComplete(db repo, log logrus.FieldLogger, la *lifecycleAction) error {
+	tth.complete++
+	return nil
+}
+
+func withTestLifecycleTransitions(t *testing.T, f func(*lifecycleTransitionRegistry)) {
+	orig := lifecycleTransitions
+	defer func() { lifecycleTransitions = orig }()
+
+	lifecycleTransitions = newDefaultLifecycleTransitionRegistry()
+	f(lifecycleTransitions)
+}
+
+func TestLifecycleTransitionRegistry(t *testing.T) {
+	ltr := newDefaultLifecycleTransitionRegistry()
+
+	all := ltr.all()
+	assert.Len(t, all, 2)
+	assert.Equal(t, "launching", all[0].Name)
+	assert.Equal(t, "terminating", all[1].Name)
+
+	h, ok := ltr.handler("launching", "cat-theatre-napkin-hose")
+	assert.True(t, ok)
+	assert.IsType(t, &launchingTransitionHandler{}, h)
+
+	_, ok = ltr.handler("loathing", "cat-theatre-napkin-hose")
+	assert.False(t, ok)
+
+	phase, ok := ltr.phase("terminating")
+	assert.True(t, ok)
+	assert.Equal(t, 2, phase)
+
+	assert.NotNil(t, ltr.register(&lifecycleTransition{Name: "loathing"}))
+	assert.NotNil(t, ltr.registerForASG("cat-*", "loathing", &testTransitionHandler{}))
+	assert.NotNil(t, ltr.registerForASG("[", "launching", &testTransitionHandler{}))
+}
+
+func TestLifecycleTransitionRegistry_registerForASG(t *testing.T) {
+	ltr := newDefaultLifecycleTransitionRegistry()
+	tth := &testTransitionHandler{}
+	assert.Nil(t, ltr.registerForASG("cat-*", "launching", tth))
+
+	h, ok := ltr.handler("launching", "cat-theatre-napkin-hose")
+	assert.True(t, ok)
+	assert.Equal(t, tth, h)
+
+	h, ok = ltr.handler("launching", "whimsical-mime-headphone")
+	assert.True(t, ok)
+	assert.IsType(t, &launchingTransitionHandler{}, h)
+
+	h, ok = ltr.handler("terminating", "cat-theatre-napkin-hose")
+	assert.True(t, ok)
+	assert.IsType(t, &terminatingTransitionHandler{}, h)
+}
+
+func TestLifecycleTransitions_Custom(t *testing.T) {
+	withTestLifecycleTransitions(t, func(ltr *lifecycleTransitionRegistry) {
+		tth := &testTransitionHandler{result: lifecycleActionResultAbandon}
+		assert.Nil(t, ltr.register(&lifecycleTransition{
+			Name:    "loathing",
+			Noun:    "loathe",
+			Route:   "loathings",
+			Phase:   3,
+			Handler: tth,
+		}))
+
+		db := newTestRepo()
+		msg := &snsMessage{
+			Message: strings.Join(strings.Split(`{
+				"LifecycleTransition": "autoscaling:EC2_INSTANCE_LOATHING",
+				"EC2InstanceId": "i-fafafaf",
+				"LifecycleActionToken": "TOKEYTOKETOK",
+				"AutoScalingGroupName": "cat-theatre-napkin-hose",
+				"LifecycleHookName": "huzzah-9001"
+			}`, ""), ""),
+		}
+
+		status, err := handleSNSNotification(db, shushLog, newTestTokenGenerator(), nil, msg, newTestAutoScalingService(nil))
+		assert.Equal(t, http.StatusOK, status)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, tth.notified)
+
+		srv := newTestServer()
+		srv.db = db
+		srv.asSvc = newTestAutoScalingService(func(r *request.Request) {
+			v, ok := r.Params.(*autoscaling.CompleteLifecycleActionInput)
+			assert.True(t, ok)
+			if ok {
+				assert.Equal(t, "ABANDON", *v.LifecycleActionResult)
+			}
+		})
+		srv.setupRouter()
+		token := "surprisingly-guessable"
+		_ = srv.db.storeInstanceToken("i-fafafaf", token)
+		ts := httptest.NewServer(srv.router)
+		defer ts.Close()
+
+		req, err := http.NewRequest("POST", fmt.Sprintf("%s/loathings/i-fafafaf", ts.URL), &bytes.Buffer{})
+		assert.Nil(t, err)
+		req.Header.Set("Authorization", fmt.Sprintf("token %s", token))
+
+		res, err := (&http.Client{}).Do(req)
+		assert.Nil(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, 1, tth.complete)
+		assert.True(t, db.la["loathing:i-fafafaf:huzzah-9001"].Completed)
+	})
+}
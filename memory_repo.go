@@ -0,0 +1,651 @@
+package cyclist
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	memoryRepoSweepInterval = time.Minute
+)
+
+// memoryRepo is a repo kept in memory for development and single node use.
+// Entries expire after the same TTLs as their redis counterparts, where a TTL
+// of 0 never expires, and are swept out on writes at most once per sweep
+// interval.
+type memoryRepo struct {
+	mutex     sync.Mutex
+	now       func() time.Time
+	lastSweep time.Time
+
+	instEventTTL           time.Duration
+	instLifecycleActionTTL time.Duration
+	instTempTokTTL         time.Duration
+	instTokTTL             time.Duration
+	messageTTL             time.Duration
+
+	states           map[string]string
+	protections      map[string]bool
+	events           map[string]*memoryEvents
+	lifecycleActions map[string]*memoryLifecycleAction
+	lastTransitions  map[string]*memoryLastTransition
+	tokens           map[string]*memoryToken
+	tempTokens       map[string]*memoryToken
+	subscriptions    map[string]*snsSubscription
+	messages         map[string]*memoryMessage
+	cycleRuns        map[string][]byte
+	cycleLocks       map[string]*memoryToken
+}
+
+type memoryEvents struct {
+	events    map[string]time.Time
+	expiresAt time.Time
+}
+
+type memoryLifecycleAction struct {
+	la        lifecycleAction
+	expiresAt time.Time
+}
+
+type memoryLastTransition struct {
+	it        instanceTransition
+	expiresAt time.Time
+}
+
+type memoryToken struct {
+	token     string
+	expiresAt time.Time
+}
+
+type memoryMessage struct {
+	state     string
+	expiresAt time.Time
+}
+
+func newMemoryRepo(instEventTTL, instLifecycleActionTTL, instTempTokTTL, instTokTTL, messageTTL time.Duration) *memoryRepo {
+	return &memoryRepo{
+		now: time.Now,
+
+		instEventTTL:           instEventTTL,
+		instLifecycleActionTTL: instLifecycleActionTTL,
+		instTempTokTTL:         instTempTokTTL,
+		instTokTTL:             instTokTTL,
+		messageTTL:             messageTTL,
+
+		states:           map[string]string{},
+		protections:      map[string]bool{},
+		events:           map[string]*memoryEvents{},
+		lifecycleActions: map[string]*memoryLifecycleAction{},
+		lastTransitions:  map[string]*memoryLastTransition{},
+		tokens:           map[string]*memoryToken{},
+		tempTokens:       map[string]*memoryToken{},
+		subscriptions:    map[string]*snsSubscription{},
+		messages:         map[string]*memoryMessage{},
+		cycleRuns:        map[string][]byte{},
+		cycleLocks:       map[string]*memoryToken{},
+	}
+}
+
+func (mr *memoryRepo) expiresAt(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return mr.now().Add(ttl)
+}
+
+func (mr *memoryRepo) expired(expiresAt time.Time) bool {
+	return !expiresAt.IsZero() && !mr.now().Before(expiresAt)
+}
+
+// sweep deletes expired entries, and must be called with the mutex held
+func (mr *memoryRepo) sweep() {
+	if mr.now().Sub(mr.lastSweep) < memoryRepoSweepInterval {
+		return
+	}
+	mr.lastSweep = mr.now()
+
+	for key, me := range mr.events {
+		if mr.expired(me.expiresAt) {
+			delete(mr.events, key)
+		}
+	}
+	for key, mla := range mr.lifecycleActions {
+		if mr.expired(mla.expiresAt) {
+			delete(mr.lifecycleActions, key)
+		}
+	}
+	for key, mlt := range mr.lastTransitions {
+		if mr.expired(mlt.expiresAt) {
+			delete(mr.lastTransitions, key)
+		}
+	}
+	for _, tokens := range []map[string]*memoryToken{mr.tokens, mr.tempTokens, mr.cycleLocks} {
+		for key, mt := range tokens {
+			if mr.expired(mt.expiresAt) {
+				delete(tokens, key)
+			}
+		}
+	}
+	for key, mm := range mr.messages {
+		if mr.expired(mm.expiresAt) {
+			delete(mr.messages, key)
+		}
+	}
+}
+
+func (mr *memoryRepo) setInstanceState(instanceID, state string) error {
+	if strings.TrimSpace(instanceID) == "" {
+		return errEmptyInstanceID
+	}
+
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+
+	mr.states[instanceID] = state
+	return nil
+}
+
+func (mr *memoryRepo) fetchInstanceState(instanceID string) (string, error) {
+	if strings.TrimSpace(instanceID) == "" {
+		return "", errEmptyInstanceID
+	}
+
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+
+	state, ok := mr.states[instanceID]
+	if !ok {
+		return "", errNoInstanceState
+	}
+	return state, nil
+}
+
+func (mr *memoryRepo) wipeInstanceState(instanceID string) error {
+	if strings.TrimSpace(instanceID) == "" {
+		return errEmptyInstanceID
+	}
+
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+
+	delete(mr.states, instanceID)
+	delete(mr.protections, instanceID)
+	return nil
+}
+
+func (mr *memoryRepo) storeInstanceProtection(instanceID string, protected bool) error {
+	if strings.TrimSpace(instanceID) == "" {
+		return errEmptyInstanceID
+	}
+
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+
+	mr.protections[instanceID] = protected
+	return nil
+}
+
+func (mr *memoryRepo) fetchInstanceProtection(instanceID string) (bool, error) {
+	if strings.TrimSpace(instanceID) == "" {
+		return false, errEmptyInstanceID
+	}
+
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+
+	return mr.protections[instanceID], nil
+}
+
+func (mr *memoryRepo) storeInstanceEvent(instanceID, event string) error {
+	if strings.TrimSpace(instanceID) == "" {
+		return errEmptyInstanceID
+	}
+
+	if strings.TrimSpace(event) == "" {
+		return errEmptyEvent
+	}
+
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+	mr.sweep()
+
+	me, ok := mr.events[instanceID]
+	if !ok || mr.expired(me.expiresAt) {
+		me = &memoryEvents{events: map[string]time.Time{}}
+		mr.events[instanceID] = me
+	}
+
+	me.events[event] = mr.now().UTC()
+	me.expiresAt = mr.expiresAt(mr.instEventTTL)
+	return nil
+}
+
+func (mr *memoryRepo) fetchInstanceEvent(instanceID, event string) (*lifecycleEvent, error) {
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+
+	if me, ok := mr.events[instanceID]; ok && !mr.expired(me.expiresAt) {
+		if ts, ok := me.events[event]; ok {
+			return &lifecycleEvent{Event: event, Timestamp: ts}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no %s event for instance %s", event, instanceID)
+}
+
+func (mr *memoryRepo) fetchInstanceEvents(instanceID string) ([]*lifecycleEvent, error) {
+	if strings.TrimSpace(instanceID) == "" {
+		return nil, errEmptyInstanceID
+	}
+
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+
+	return mr.fetchInstanceEventsLocked(instanceID), nil
+}
+
+func (mr *memoryRepo) fetchInstanceEventsLocked(instanceID string) []*lifecycleEvent {
+	events := []*lifecycleEvent{}
+
+	me, ok := mr.events[instanceID]
+	if !ok || mr.expired(me.expiresAt) {
+		return events
+	}
+
+	for event, ts := range me.events {
+		events = append(events, &lifecycleEvent{Event: event, Timestamp: ts})
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Timestamp.Equal(events[j].Timestamp) {
+			return events[i].Event < events[j].Event
+		}
+		return events[i].Timestamp.Before(events[j].Timestamp)
+	})
+
+	return events
+}
+
+func (mr *memoryRepo) fetchAllInstanceEvents() (map[string][]*lifecycleEvent, error) {
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+
+	res := map[string][]*lifecycleEvent{}
+	for instanceID, me := range mr.events {
+		if mr.expired(me.expiresAt) {
+			continue
+		}
+		res[instanceID] = mr.fetchInstanceEventsLocked(instanceID)
+	}
+
+	return res, nil
+}
+
+func (mr *memoryRepo) storeInstanceLifecycleAction(la *lifecycleAction) error {
+	if la.LifecycleTransition == "" || la.EC2InstanceID == "" ||
+		la.AutoScalingGroupName == "" || la.LifecycleHookName == "" {
+		return fmt.Errorf("missing required fields in lifecycle action: %+v", la)
+	}
+
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+	mr.sweep()
+
+	stored := lifecycleAction{
+		LifecycleTransition:  la.LifecycleTransition,
+		EC2InstanceID:        la.EC2InstanceID,
+		LifecycleActionToken: la.LifecycleActionToken,
+		AutoScalingGroupName: la.AutoScalingGroupName,
+		LifecycleHookName:    la.LifecycleHookName,
+		Origin:               la.Origin,
+		Destination:          la.Destination,
+	}
+
+	mr.lifecycleActions[lifecycleActionKey(la.Transition(), la.EC2InstanceID, la.LifecycleHookName)] = &memoryLifecycleAction{
+		la:        stored,
+		expiresAt: mr.expiresAt(mr.instLifecycleActionTTL),
+	}
+	return nil
+}
+
+func (mr *memoryRepo) fetchInstanceLifecycleActions(transition, instanceID string) ([]*lifecycleAction, error) {
+	if strings.TrimSpace(instanceID) == "" {
+		return nil, errEmptyInstanceID
+	}
+
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+
+	prefix := lifecycleActionKey(transition, instanceID, "")
+	return mr.fetchLifecycleActionsLocked(func(key string, la *lifecycleAction) bool {
+		return strings.HasPrefix(key, prefix)
+	}), nil
+}
+
+func (mr *memoryRepo) completeInstanceLifecycleAction(transition, instanceID, hookName string) error {
+	return mr.setInstanceLifecycleActionBits(transition, instanceID, hookName, false)
+}
+
+func (mr *memoryRepo) expireInstanceLifecycleAction(transition, instanceID, hookName string) error {
+	return mr.setInstanceLifecycleActionBits(transition, instanceID, hookName, true)
+}
+
+func (mr *memoryRepo) setInstanceLifecycleActionBits(transition, instanceID, hookName string, expired bool) error {
+	if strings.TrimSpace(instanceID) == "" {
+		return errEmptyInstanceID
+	}
+
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+
+	mla, ok := mr.lifecycleActions[lifecycleActionKey(transition, instanceID, hookName)]
+	if !ok || mr.expired(mla.expiresAt) {
+		return fmt.Errorf("no lifecycle action found for transition '%s', instance ID '%s', hook '%s'",
+			transition, instanceID, hookName)
+	}
+
+	mla.la.Completed = true
+	if expired {
+		mla.la.Expired = true
+	}
+	return nil
+}
+
+func (mr *memoryRepo) fetchPendingLifecycleActions(transition string) ([]*lifecycleAction, error) {
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+
+	prefix := fmt.Sprintf("%s:", transition)
+	return mr.fetchLifecycleActionsLocked(func(key string, la *lifecycleAction) bool {
+		return strings.HasPrefix(key, prefix) && !la.Completed
+	}), nil
+}
+
+// fetchLifecycleActionsLocked returns copies of the unexpired lifecycle actions
+// matching f, ordered by key, and must be called with the mutex held
+func (mr *memoryRepo) fetchLifecycleActionsLocked(f func(string, *lifecycleAction) bool) []*lifecycleAction {
+	keys := []string{}
+	for key, mla := range mr.lifecycleActions {
+		if mr.expired(mla.expiresAt) || !f(key, &mla.la) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	res := []*lifecycleAction{}
+	for _, key := range keys {
+		la := mr.lifecycleActions[key].la
+		res = append(res, &la)
+	}
+	return res
+}
+
+func (mr *memoryRepo) storeInstanceLastTransition(instanceID, transition string, ts time.Time) error {
+	if strings.TrimSpace(instanceID) == "" {
+		return errEmptyInstanceID
+	}
+
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+	mr.sweep()
+
+	mr.lastTransitions[instanceID] = &memoryLastTransition{
+		it:        instanceTransition{Transition: transition, Time: ts.UTC()},
+		expiresAt: mr.expiresAt(mr.instLifecycleActionTTL),
+	}
+	return nil
+}
+
+func (mr *memoryRepo) fetchInstanceLastTransition(instanceID string) (*instanceTransition, error) {
+	if strings.TrimSpace(instanceID) == "" {
+		return nil, errEmptyInstanceID
+	}
+
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+
+	mlt, ok := mr.lastTransitions[instanceID]
+	if !ok || mr.expired(mlt.expiresAt) {
+		return nil, nil
+	}
+
+	it := mlt.it
+	return &it, nil
+}
+
+func (mr *memoryRepo) storeInstanceToken(instanceID, token string) error {
+	return mr.storeInstanceTokenTTL(mr.tokens, instanceID, token, mr.instTokTTL)
+}
+
+func (mr *memoryRepo) storeTempInstanceToken(instanceID, token string) error {
+	return mr.storeInstanceTokenTTL(mr.tempTokens, instanceID, token, mr.instTempTokTTL)
+}
+
+func (mr *memoryRepo) storeInstanceTokenTTL(tokens map[string]*memoryToken, instanceID, token string, ttl time.Duration) error {
+	if strings.TrimSpace(instanceID) == "" {
+		return errEmptyInstanceID
+	}
+
+	if strings.TrimSpace(token) == "" {
+		return errEmptyToken
+	}
+
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+	mr.sweep()
+
+	tokens[instanceID] = &memoryToken{token: token, expiresAt: mr.expiresAt(ttl)}
+	return nil
+}
+
+func (mr *memoryRepo) fetchInstanceToken(instanceID string) (string, error) {
+	return mr.fetchInstanceTokenTTL(mr.tokens, instanceID, mr.instTokTTL)
+}
+
+func (mr *memoryRepo) fetchTempInstanceToken(instanceID string) (string, error) {
+	return mr.fetchInstanceTokenTTL(mr.tempTokens, instanceID, 0)
+}
+
+// fetchInstanceTokenTTL returns the token, extending its expiry by the TTL if
+// greater than 0
+func (mr *memoryRepo) fetchInstanceTokenTTL(tokens map[string]*memoryToken, instanceID string, ttl time.Duration) (string, error) {
+	if strings.TrimSpace(instanceID) == "" {
+		return "", errEmptyInstanceID
+	}
+
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+
+	mt, ok := tokens[instanceID]
+	if !ok || mr.expired(mt.expiresAt) {
+		return "", fmt.Errorf("no token for instance '%s'", instanceID)
+	}
+
+	if ttl > 0 {
+		mt.expiresAt = mr.expiresAt(ttl)
+	}
+
+	return mt.token, nil
+}
+
+func (mr *memoryRepo) storeSNSSubscriptionState(topicARN, state string) error {
+	if strings.TrimSpace(topicARN) == "" {
+		return errEmptyTopicARN
+	}
+
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+
+	mr.subscriptions[topicARN] = &snsSubscription{
+		TopicARN:  topicARN,
+		State:     state,
+		UpdatedAt: mr.now().UTC().Format(time.RFC3339Nano),
+	}
+	return nil
+}
+
+func (mr *memoryRepo) fetchSNSSubscriptions() ([]*snsSubscription, error) {
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+
+	topicARNs := []string{}
+	for topicARN := range mr.subscriptions {
+		topicARNs = append(topicARNs, topicARN)
+	}
+
+	sort.Strings(topicARNs)
+
+	subs := []*snsSubscription{}
+	for _, topicARN := range topicARNs {
+		sub := *mr.subscriptions[topicARN]
+		subs = append(subs, &sub)
+	}
+
+	return subs, nil
+}
+
+func (mr *memoryRepo) markMessageHandling(messageID string) (string, error) {
+	if strings.TrimSpace(messageID) == "" {
+		return "", errEmptyMessageID
+	}
+
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+	mr.sweep()
+
+	if mm, ok := mr.messages[messageID]; ok && !mr.expired(mm.expiresAt) {
+		return mm.state, nil
+	}
+
+	mr.messages[messageID] = &memoryMessage{
+		state:     messageStateHandling,
+		expiresAt: mr.expiresAt(messageHandlingTTL),
+	}
+	return "", nil
+}
+
+func (mr *memoryRepo) markMessageHandled(messageID string) error {
+	if strings.TrimSpace(messageID) == "" {
+		return errEmptyMessageID
+	}
+
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+	mr.sweep()
+
+	mr.messages[messageID] = &memoryMessage{
+		state:     messageStateHandled,
+		expiresAt: mr.expiresAt(mr.messageTTL),
+	}
+	return nil
+}
+
+func (mr *memoryRepo) forgetMessage(messageID string) error {
+	if strings.TrimSpace(messageID) == "" {
+		return errEmptyMessageID
+	}
+
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+
+	delete(mr.messages, messageID)
+	return nil
+}
+
+func (mr *memoryRepo) storeCycleRun(run *cycleRun) error {
+	if strings.TrimSpace(run.ASGName) == "" {
+		return errEmptyASGName
+	}
+
+	runBytes, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+
+	mr.cycleRuns[run.ASGName] = runBytes
+	return nil
+}
+
+func (mr *memoryRepo) fetchCycleRun(asgName string) (*cycleRun, error) {
+	if strings.TrimSpace(asgName) == "" {
+		return nil, errEmptyASGName
+	}
+
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+
+	return mr.fetchCycleRunLocked(asgName)
+}
+
+func (mr *memoryRepo) fetchCycleRuns() ([]*cycleRun, error) {
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+
+	asgNames := []string{}
+	for asgName := range mr.cycleRuns {
+		asgNames = append(asgNames, asgName)
+	}
+
+	sort.Strings(asgNames)
+
+	runs := []*cycleRun{}
+	for _, asgName := range asgNames {
+		run, err := mr.fetchCycleRunLocked(asgName)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+
+	return runs, nil
+}
+
+func (mr *memoryRepo) fetchCycleRunLocked(asgName string) (*cycleRun, error) {
+	runBytes, ok := mr.cycleRuns[asgName]
+	if !ok {
+		return nil, nil
+	}
+
+	run := &cycleRun{}
+	return run, json.Unmarshal(runBytes, run)
+}
+
+func (mr *memoryRepo) lockCycleRun(asgName, owner string, ttl time.Duration) (bool, error) {
+	if strings.TrimSpace(asgName) == "" {
+		return false, errEmptyASGName
+	}
+
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+	mr.sweep()
+
+	if mt, ok := mr.cycleLocks[asgName]; ok && !mr.expired(mt.expiresAt) && mt.token != owner {
+		return false, nil
+	}
+
+	mr.cycleLocks[asgName] = &memoryToken{token: owner, expiresAt: mr.expiresAt(ttl)}
+	return true, nil
+}
+
+func (mr *memoryRepo) unlockCycleRun(asgName, owner string) error {
+	if strings.TrimSpace(asgName) == "" {
+		return errEmptyASGName
+	}
+
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+
+	if mt, ok := mr.cycleLocks[asgName]; ok && mt.token == owner {
+		delete(mr.cycleLocks, asgName)
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package cyclist
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestMemoryRepo(clock *testClock) *memoryRepo {
+	mr := newMemoryRepo(time.Hour, time.Hour, time.Minute, 10*time.Minute, time.Hour)
+	mr.now = clock.now
+	return mr
+}
+
+func TestMemoryRepo(t *testing.T) {
+	runRepoBehaviourTests(t, func(clock *testClock) (repo, func()) {
+		return newTestMemoryRepo(clock), func() {}
+	})
+}
+
+func TestMemoryRepo_sweep(t *testing.T) {
+	clock := newTestClock()
+	mr := newTestMemoryRepo(clock)
+
+	assert.Nil(t, mr.storeInstanceEvent("i-fafafaf", "launching"))
+	assert.Nil(t, mr.storeTempInstanceToken("i-fafafaf", "TEMPYTEMPTEMP"))
+	_, err := mr.markMessageHandling("msg-1")
+	assert.Nil(t, err)
+
+	clock.advance(2 * time.Hour)
+	assert.Nil(t, mr.storeInstanceEvent("i-bababab", "launching"))
+
+	assert.Len(t, mr.events, 1)
+	assert.Len(t, mr.tempTokens, 0)
+	assert.Len(t, mr.messages, 0)
+}
@@ -2,7 +2,10 @@ package cyclist
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -13,6 +16,8 @@ import (
 	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
 	"github.com/aws/aws-sdk-go/service/sns"
 	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
 	"github.com/garyburd/redigo/redis"
 	"github.com/rafaeljusto/redigomock"
 	"github.com/sirupsen/logrus"
@@ -49,20 +54,32 @@ func (trcg *testRedisConnGetter) Get() redis.Conn {
 }
 
 type testRepo struct {
-	s  map[string]string
-	e  map[string]map[string]*lifecycleEvent
-	la map[string]*lifecycleAction
-	t  map[string]string
-	tt map[string]string
+	s   map[string]string
+	e   map[string]map[string]*lifecycleEvent
+	la  map[string]*lifecycleAction
+	t   map[string]string
+	tt  map[string]string
+	sub map[string]*snsSubscription
+	m   map[string]string
+	lt  map[string]*instanceTransition
+	p   map[string]bool
+	cy  map[string][]byte
+	cl  map[string]string
 }
 
 func newTestRepo() *testRepo {
 	return &testRepo{
-		s:  map[string]string{},
-		e:  map[string]map[string]*lifecycleEvent{},
-		la: map[string]*lifecycleAction{},
-		t:  map[string]string{},
-		tt: map[string]string{},
+		s:   map[string]string{},
+		e:   map[string]map[string]*lifecycleEvent{},
+		la:  map[string]*lifecycleAction{},
+		t:   map[string]string{},
+		tt:  map[string]string{},
+		sub: map[string]*snsSubscription{},
+		m:   map[string]string{},
+		lt:  map[string]*instanceTransition{},
+		p:   map[string]bool{},
+		cy:  map[string][]byte{},
+		cl:  map[string]string{},
 	}
 }
 
@@ -76,18 +93,28 @@ func (tr *testRepo) fetchInstanceState(instanceID string) (string, error) {
 		return state, nil
 	}
 
-	return "", fmt.Errorf("no state for instance '%s'", instanceID)
+	return "", errNoInstanceState
 }
 
 func (tr *testRepo) wipeInstanceState(instanceID string) error {
 	if _, ok := tr.s[instanceID]; ok {
 		delete(tr.s, instanceID)
+		delete(tr.p, instanceID)
 		return nil
 	}
 
 	return fmt.Errorf("no state for instance '%s'", instanceID)
 }
 
+func (tr *testRepo) storeInstanceProtection(instanceID string, protected bool) error {
+	tr.p[instanceID] = protected
+	return nil
+}
+
+func (tr *testRepo) fetchInstanceProtection(instanceID string) (bool, error) {
+	return tr.p[instanceID], nil
+}
+
 func (tr *testRepo) storeInstanceEvent(instanceID, event string) error {
 	ts := time.Now().UTC().Format(time.RFC3339Nano)
 	if _, ok := tr.e[instanceID]; !ok {
@@ -112,11 +139,7 @@ func (tr *testRepo) fetchInstanceEvent(instanceID, event string) (*lifecycleEven
 }
 
 func (tr *testRepo) fetchInstanceEvents(instanceID string) ([]*lifecycleEvent, error) {
-	eventsMap, ok := tr.e[instanceID]
-	if !ok {
-		return nil, fmt.Errorf("no events for instance '%s'", instanceID)
-	}
-
+	eventsMap := tr.e[instanceID]
 	events := []*lifecycleEvent{}
 
 	for _, event := range eventsMap {
@@ -141,29 +164,74 @@ func (tr *testRepo) fetchAllInstanceEvents() (map[string][]*lifecycleEvent, erro
 
 func (tr *testRepo) storeInstanceLifecycleAction(la *lifecycleAction) error {
 	if la.LifecycleTransition == "" || la.EC2InstanceID == "" ||
-		la.LifecycleActionToken == "" || la.AutoScalingGroupName == "" ||
-		la.LifecycleHookName == "" {
+		la.AutoScalingGroupName == "" || la.LifecycleHookName == "" {
 		return fmt.Errorf("missing required fields in lifecycle action: %+v", la)
 	}
 
-	tr.la[fmt.Sprintf("%s:%s", la.Transition(), la.EC2InstanceID)] = la
+	tr.la[fmt.Sprintf("%s:%s:%s", la.Transition(), la.EC2InstanceID, la.LifecycleHookName)] = la
 	return nil
 }
 
-func (tr *testRepo) fetchInstanceLifecycleAction(transition, instanceID string) (*lifecycleAction, error) {
-	if la, ok := tr.la[fmt.Sprintf("%s:%s", transition, instanceID)]; ok {
-		return la, nil
+func (tr *testRepo) fetchInstanceLifecycleActions(transition, instanceID string) ([]*lifecycleAction, error) {
+	keys := []string{}
+	prefix := fmt.Sprintf("%s:%s:", transition, instanceID)
+	for key := range tr.la {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	res := []*lifecycleAction{}
+	for _, key := range keys {
+		res = append(res, tr.la[key])
+	}
+	return res, nil
+}
+
+func (tr *testRepo) completeInstanceLifecycleAction(transition, instanceID, hookName string) error {
+	key := fmt.Sprintf("%s:%s:%s", transition, instanceID, hookName)
+	if _, ok := tr.la[key]; ok {
+		tr.la[key].Completed = true
+		return nil
 	}
-	return nil, fmt.Errorf("no lifecycle action found for transition '%s', instance ID '%s'", transition, instanceID)
+	return fmt.Errorf("no lifecycle action found for transition '%s', instance ID '%s', hook '%s'", transition, instanceID, hookName)
 }
 
-func (tr *testRepo) completeInstanceLifecycleAction(transition, instanceID string) error {
-	key := fmt.Sprintf("%s:%s", transition, instanceID)
+func (tr *testRepo) expireInstanceLifecycleAction(transition, instanceID, hookName string) error {
+	key := fmt.Sprintf("%s:%s:%s", transition, instanceID, hookName)
 	if _, ok := tr.la[key]; ok {
 		tr.la[key].Completed = true
+		tr.la[key].Expired = true
 		return nil
 	}
-	return fmt.Errorf("no lifecycle action found for transition '%s', instance ID '%s'", transition, instanceID)
+	return fmt.Errorf("no lifecycle action found for transition '%s', instance ID '%s', hook '%s'", transition, instanceID, hookName)
+}
+
+func (tr *testRepo) fetchPendingLifecycleActions(transition string) ([]*lifecycleAction, error) {
+	keys := []string{}
+	for key := range tr.la {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	res := []*lifecycleAction{}
+	for _, key := range keys {
+		la := tr.la[key]
+		if la.Transition() == transition && !la.Completed {
+			res = append(res, la)
+		}
+	}
+	return res, nil
+}
+
+func (tr *testRepo) storeInstanceLastTransition(instanceID, transition string, ts time.Time) error {
+	tr.lt[instanceID] = &instanceTransition{Transition: transition, Time: ts}
+	return nil
+}
+
+func (tr *testRepo) fetchInstanceLastTransition(instanceID string) (*instanceTransition, error) {
+	return tr.lt[instanceID], nil
 }
 
 func (tr *testRepo) fetchInstanceToken(instanceID string) (string, error) {
@@ -192,6 +260,56 @@ func (tr *testRepo) storeTempInstanceToken(instanceID, token string) error {
 	return nil
 }
 
+func (tr *testRepo) storeSNSSubscriptionState(topicARN, state string) error {
+	tr.sub[topicARN] = &snsSubscription{
+		TopicARN:  topicARN,
+		State:     state,
+		UpdatedAt: time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	return nil
+}
+
+func (tr *testRepo) fetchSNSSubscriptions() ([]*snsSubscription, error) {
+	subs := []*snsSubscription{}
+	for _, sub := range tr.sub {
+		subs = append(subs, sub)
+	}
+	return subs, nil
+}
+
+func (tr *testRepo) markMessageHandling(messageID string) (string, error) {
+	if state, ok := tr.m[messageID]; ok {
+		return state, nil
+	}
+	tr.m[messageID] = messageStateHandling
+	return "", nil
+}
+
+func (tr *testRepo) markMessageHandled(messageID string) error {
+	tr.m[messageID] = messageStateHandled
+	return nil
+}
+
+func (tr *testRepo) forgetMessage(messageID string) error {
+	delete(tr.m, messageID)
+	return nil
+}
+
+func (tr *testRepo) lockCycleRun(asgName, owner string, ttl time.Duration) (bool, error) {
+	if held, ok := tr.cl[asgName]; ok && held != owner {
+		return false, nil
+	}
+	tr.cl[asgName] = owner
+	return true, nil
+}
+
+func (tr *testRepo) unlockCycleRun(asgName, owner string) error {
+	if tr.cl[asgName] == owner {
+		delete(tr.cl, asgName)
+	}
+	return nil
+}
+
 func newTestSNSService(f func(*request.Request)) snsiface.SNSAPI {
 	svc := sns.New(session.New(), aws.NewConfig().WithRegion("nz-isengard-1"))
 	svc.Handlers.Clear()
@@ -216,6 +334,18 @@ func newTestAutoScalingService(f func(*request.Request)) autoscalingiface.AutoSc
 	return svc
 }
 
+func newTestSQSService(f func(*request.Request)) sqsiface.SQSAPI {
+	svc := sqs.New(session.New(), aws.NewConfig().WithRegion("nz-isengard-1").WithDisableComputeChecksums(true))
+	svc.Handlers.Clear()
+	if f == nil {
+		f = func(r *request.Request) {
+			shushLog.WithField("request", r).Info("got this for ya")
+		}
+	}
+	svc.Handlers.Build.PushBack(f)
+	return svc
+}
+
 type testTokenGenerator struct{}
 
 func (ttg *testTokenGenerator) GenerateToken() string {
@@ -225,3 +355,39 @@ func (ttg *testTokenGenerator) GenerateToken() string {
 func newTestTokenGenerator() tokenGenerator {
 	return &testTokenGenerator{}
 }
+
+func (tr *testRepo) storeCycleRun(run *cycleRun) error {
+	runBytes, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	tr.cy[run.ASGName] = runBytes
+	return nil
+}
+
+func (tr *testRepo) fetchCycleRun(asgName string) (*cycleRun, error) {
+	runBytes, ok := tr.cy[asgName]
+	if !ok {
+		return nil, nil
+	}
+	run := &cycleRun{}
+	return run, json.Unmarshal(runBytes, run)
+}
+
+func (tr *testRepo) fetchCycleRuns() ([]*cycleRun, error) {
+	asgNames := []string{}
+	for asgName := range tr.cy {
+		asgNames = append(asgNames, asgName)
+	}
+	sort.Strings(asgNames)
+
+	runs := []*cycleRun{}
+	for _, asgName := range asgNames {
+		run, err := tr.fetchCycleRun(asgName)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
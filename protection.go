@@ -0,0 +1,322 @@
+package cyclist
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	instanceProtectionBusy = "busy"
+	instanceProtectionIdle = "idle"
+
+	// maxProtectionBatchSize is the most instance IDs accepted by a single
+	// SetInstanceProtection or DescribeAutoScalingInstances call
+	maxProtectionBatchSize = 50
+
+	// maxProtectionCacheSize bounds the applied protection and auto scaling
+	// group names remembered for instances, which are forgotten all at once
+	// beyond it
+	maxProtectionCacheSize = 10000
+)
+
+var (
+	defaultProtectionFlushInterval = 5 * time.Second
+)
+
+// instanceProtector applies scale-in protection requested by busy and idle
+// instances. Requests are coalesced per instance, so that only the latest
+// counts, and flushed periodically in batches per auto scaling group, so that
+// instances toggling often don't get cyclist throttled.
+type instanceProtector struct {
+	log      logrus.FieldLogger
+	asSvc    autoscalingiface.AutoScalingAPI
+	interval time.Duration
+
+	mutex   sync.Mutex
+	pending map[string]bool
+	applied map[string]bool
+	asgs    map[string]string
+}
+
+func newInstanceProtector(log logrus.FieldLogger, asSvc autoscalingiface.AutoScalingAPI, interval time.Duration) *instanceProtector {
+	if interval <= 0 {
+		interval = defaultProtectionFlushInterval
+	}
+
+	return &instanceProtector{
+		log:      log.WithField("self", "instance_protector"),
+		asSvc:    asSvc,
+		interval: interval,
+
+		pending: map[string]bool{},
+		applied: map[string]bool{},
+		asgs:    map[string]string{},
+	}
+}
+
+// request queues the instance's protection to be applied on the next flush,
+// replacing any protection queued before it
+func (ip *instanceProtector) request(instanceID string, protected bool) {
+	ip.mutex.Lock()
+	defer ip.mutex.Unlock()
+
+	ip.pending[instanceID] = protected
+}
+
+func (ip *instanceProtector) Run(ctx context.Context) {
+	ip.log.WithField("interval", ip.interval.String()).Info("starting")
+
+	ticker := time.NewTicker(ip.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			ip.log.Info("stopping")
+			return
+		case <-ticker.C:
+			err := ip.flush()
+			if err != nil {
+				ip.log.WithField("err", err).Error("failed to flush instance protection")
+			}
+		}
+	}
+}
+
+func (ip *instanceProtector) flush() error {
+	ip.mutex.Lock()
+	pending := ip.pending
+	ip.pending = map[string]bool{}
+
+	if len(ip.applied) > maxProtectionCacheSize || len(ip.asgs) > maxProtectionCacheSize {
+		ip.applied = map[string]bool{}
+		ip.asgs = map[string]string{}
+	}
+
+	unresolved := []string{}
+	for instanceID, protected := range pending {
+		if applied, ok := ip.applied[instanceID]; ok && applied == protected {
+			delete(pending, instanceID)
+			continue
+		}
+
+		if _, ok := ip.asgs[instanceID]; !ok {
+			unresolved = append(unresolved, instanceID)
+		}
+	}
+	ip.mutex.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	sort.Strings(unresolved)
+	asgs, err := ip.resolveASGs(unresolved)
+	if err != nil {
+		ip.requeue(pending)
+		return err
+	}
+
+	ip.mutex.Lock()
+	for instanceID, asgName := range asgs {
+		ip.asgs[instanceID] = asgName
+	}
+
+	batches := map[string]map[bool][]string{}
+	for instanceID, protected := range pending {
+		asgName, ok := ip.asgs[instanceID]
+		if !ok {
+			ip.log.WithField("instance", instanceID).Warn("no auto scaling group found for instance")
+			continue
+		}
+
+		if _, ok := batches[asgName]; !ok {
+			batches[asgName] = map[bool][]string{}
+		}
+		batches[asgName][protected] = append(batches[asgName][protected], instanceID)
+	}
+	ip.mutex.Unlock()
+
+	var flushErr error
+	for asgName, byProtection := range batches {
+		for protected, instanceIDs := range byProtection {
+			sort.Strings(instanceIDs)
+
+			for len(instanceIDs) > 0 {
+				n := len(instanceIDs)
+				if n > maxProtectionBatchSize {
+					n = maxProtectionBatchSize
+				}
+				batch := instanceIDs[:n]
+				instanceIDs = instanceIDs[n:]
+
+				err := ip.setProtection(asgName, batch, protected)
+				if err != nil {
+					flushErr = err
+					failed := map[string]bool{}
+					for _, instanceID := range batch {
+						failed[instanceID] = protected
+					}
+					ip.requeue(failed)
+					continue
+				}
+
+				ip.mutex.Lock()
+				for _, instanceID := range batch {
+					ip.applied[instanceID] = protected
+				}
+				ip.mutex.Unlock()
+			}
+		}
+	}
+
+	return flushErr
+}
+
+// requeue queues failed protection again unless a newer one was requested in
+// the meantime
+func (ip *instanceProtector) requeue(failed map[string]bool) {
+	ip.mutex.Lock()
+	defer ip.mutex.Unlock()
+
+	for instanceID, protected := range failed {
+		if _, ok := ip.pending[instanceID]; !ok {
+			ip.pending[instanceID] = protected
+		}
+	}
+}
+
+func (ip *instanceProtector) resolveASGs(instanceIDs []string) (map[string]string, error) {
+	asgs := map[string]string{}
+
+	for len(instanceIDs) > 0 {
+		n := len(instanceIDs)
+		if n > maxProtectionBatchSize {
+			n = maxProtectionBatchSize
+		}
+
+		out, err := ip.asSvc.DescribeAutoScalingInstances(&autoscaling.DescribeAutoScalingInstancesInput{
+			InstanceIds: aws.StringSlice(instanceIDs[:n]),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, inst := range out.AutoScalingInstances {
+			asgs[aws.StringValue(inst.InstanceId)] = aws.StringValue(inst.AutoScalingGroupName)
+		}
+		instanceIDs = instanceIDs[n:]
+	}
+
+	return asgs, nil
+}
+
+func (ip *instanceProtector) setProtection(asgName string, instanceIDs []string, protected bool) error {
+	ip.log.WithFields(logrus.Fields{
+		"asg":       asgName,
+		"instances": len(instanceIDs),
+		"protected": protected,
+	}).Info("setting instance protection")
+
+	_, err := ip.asSvc.SetInstanceProtection(&autoscaling.SetInstanceProtectionInput{
+		AutoScalingGroupName: aws.String(asgName),
+		InstanceIds:          aws.StringSlice(instanceIDs),
+		ProtectedFromScaleIn: aws.Bool(protected),
+	})
+	return err
+}
+
+func newProtectionsHandlerFunc(db repo, log logrus.FieldLogger, ip *instanceProtector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		instanceID := mux.Vars(r)["instance_id"]
+		log = log.WithFields(logrus.Fields{
+			"path":     r.URL.Path,
+			"method":   r.Method,
+			"instance": instanceID,
+		})
+
+		body := &jsonProtection{}
+		err := json.NewDecoder(r.Body).Decode(body)
+		if err != nil {
+			log.WithField("err", err).Error("invalid json received")
+			jsonRespond(w, http.StatusBadRequest, &jsonErr{
+				Err: errors.Wrap(err, "invalid json received"),
+			})
+			return
+		}
+
+		if body.State != instanceProtectionBusy && body.State != instanceProtectionIdle {
+			jsonRespond(w, http.StatusBadRequest, &jsonErr{
+				Err: fmt.Errorf("unknown protection state '%s'", body.State),
+			})
+			return
+		}
+
+		protected := body.State == instanceProtectionBusy
+		err = db.storeInstanceProtection(instanceID, protected)
+		if err != nil {
+			log.WithField("err", err).Error("storing instance protection failed")
+			jsonRespond(w, http.StatusInternalServerError, &jsonErr{
+				Err: errors.Wrap(err, "storing instance protection failed"),
+			})
+			return
+		}
+
+		if ip != nil {
+			ip.request(instanceID, protected)
+		}
+
+		jsonRespond(w, http.StatusAccepted, &jsonMsg{
+			Message: fmt.Sprintf("instance protection requested for %s instance", body.State),
+		})
+	}
+}
+
+func newProtectionHandlerFunc(db repo, log logrus.FieldLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		instanceID := mux.Vars(r)["instance_id"]
+		log = log.WithFields(logrus.Fields{
+			"path":     r.URL.Path,
+			"method":   r.Method,
+			"instance": instanceID,
+		})
+
+		protected, err := db.fetchInstanceProtection(instanceID)
+		if err != nil {
+			log.WithField("err", err).Error("fetching instance protection failed")
+			jsonRespond(w, http.StatusInternalServerError, &jsonErr{
+				Err: errors.Wrap(err, "fetching instance protection failed"),
+			})
+			return
+		}
+
+		state := instanceProtectionIdle
+		if protected {
+			state = instanceProtectionBusy
+		}
+
+		jsonRespond(w, http.StatusOK, &jsonProtection{
+			State:      state,
+			Protected:  protected,
+			InstanceID: instanceID,
+		})
+	}
+}
+
+type jsonProtection struct {
+	State      string `json:"state"`
+	Protected  bool   `json:"protected"`
+	InstanceID string `json:"@instance_id,omitempty"`
+}
@@ -0,0 +1,136 @@
+package cyclist
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/stretchr/testify/assert"
+)
+
+type testProtectionCall struct {
+	asg       string
+	instances []string
+	protected bool
+}
+
+func newTestProtectionAutoScalingService(asgs map[string]string, calls *[]*testProtectionCall, describes *int, fail *bool) func(*request.Request) {
+	return func(r *request.Request) {
+		switch v := r.Params.(type) {
+		case *autoscaling.DescribeAutoScalingInstancesInput:
+			*describes++
+			out := r.Data.(*autoscaling.DescribeAutoScalingInstancesOutput)
+			for _, instanceID := range aws.StringValueSlice(v.InstanceIds) {
+				if asgName, ok := asgs[instanceID]; ok {
+					out.AutoScalingInstances = append(out.AutoScalingInstances, &autoscaling.InstanceDetails{
+						InstanceId:           aws.String(instanceID),
+						AutoScalingGroupName: aws.String(asgName),
+					})
+				}
+			}
+		case *autoscaling.SetInstanceProtectionInput:
+			if *fail {
+				r.Error = errors.New("throttled, probably")
+				return
+			}
+			*calls = append(*calls, &testProtectionCall{
+				asg:       *v.AutoScalingGroupName,
+				instances: aws.StringValueSlice(v.InstanceIds),
+				protected: *v.ProtectedFromScaleIn,
+			})
+		}
+	}
+}
+
+func TestNewInstanceProtector_WithInvalidInterval(t *testing.T) {
+	for _, interval := range []time.Duration{0, -time.Second} {
+		ip := newInstanceProtector(shushLog, nil, interval)
+		assert.Equal(t, defaultProtectionFlushInterval, ip.interval)
+	}
+}
+
+func TestInstanceProtector_flush(t *testing.T) {
+	calls := []*testProtectionCall{}
+	describes := 0
+	fail := false
+	asSvc := newTestAutoScalingService(newTestProtectionAutoScalingService(map[string]string{
+		"i-fafafaf": "cat-theatre-napkin-hose",
+		"i-bababab": "cat-theatre-napkin-hose",
+		"i-cacacac": "whimsical-mime-headphone",
+	}, &calls, &describes, &fail))
+
+	ip := newInstanceProtector(shushLog, asSvc, time.Second)
+	ip.request("i-fafafaf", false)
+	ip.request("i-fafafaf", true)
+	ip.request("i-bababab", true)
+	ip.request("i-cacacac", true)
+	ip.request("i-gone", true)
+
+	assert.Nil(t, ip.flush())
+	assert.Equal(t, 1, describes)
+
+	sort.Slice(calls, func(i, j int) bool { return calls[i].asg < calls[j].asg })
+	assert.Equal(t, []*testProtectionCall{
+		{asg: "cat-theatre-napkin-hose", instances: []string{"i-bababab", "i-fafafaf"}, protected: true},
+		{asg: "whimsical-mime-headphone", instances: []string{"i-cacacac"}, protected: true},
+	}, calls)
+
+	calls = []*testProtectionCall{}
+	ip.request("i-fafafaf", true)
+	ip.request("i-bababab", false)
+
+	assert.Nil(t, ip.flush())
+	assert.Equal(t, 1, describes)
+	assert.Equal(t, []*testProtectionCall{
+		{asg: "cat-theatre-napkin-hose", instances: []string{"i-bababab"}, protected: false},
+	}, calls)
+}
+
+func TestInstanceProtector_flush_Batches(t *testing.T) {
+	calls := []*testProtectionCall{}
+	describes := 0
+	fail := false
+	asgs := map[string]string{}
+	for i := 0; i < maxProtectionBatchSize+1; i++ {
+		asgs[fmt.Sprintf("i-%07d", i)] = "cat-theatre-napkin-hose"
+	}
+	asSvc := newTestAutoScalingService(newTestProtectionAutoScalingService(asgs, &calls, &describes, &fail))
+
+	ip := newInstanceProtector(shushLog, asSvc, time.Second)
+	for instanceID := range asgs {
+		ip.request(instanceID, true)
+	}
+
+	assert.Nil(t, ip.flush())
+	assert.Equal(t, 2, describes)
+	assert.Len(t, calls, 2)
+	assert.Len(t, calls[0].instances, maxProtectionBatchSize)
+	assert.Len(t, calls[1].instances, 1)
+}
+
+func TestInstanceProtector_flush_Requeues(t *testing.T) {
+	calls := []*testProtectionCall{}
+	describes := 0
+	fail := true
+	asSvc := newTestAutoScalingService(newTestProtectionAutoScalingService(map[string]string{
+		"i-fafafaf": "cat-theatre-napkin-hose",
+	}, &calls, &describes, &fail))
+
+	ip := newInstanceProtector(shushLog, asSvc, time.Second)
+	ip.request("i-fafafaf", true)
+
+	assert.NotNil(t, ip.flush())
+	assert.Len(t, calls, 0)
+	assert.Equal(t, map[string]bool{"i-fafafaf": true}, ip.pending)
+
+	fail = false
+	assert.Nil(t, ip.flush())
+	assert.Equal(t, 1, describes)
+	assert.Len(t, calls, 1)
+	assert.Len(t, ip.pending, 0)
+}
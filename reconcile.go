@@ -0,0 +1,331 @@
+package cyclist
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	defaultReconcileInterval = 5 * time.Minute
+
+	reconcileWaitStates = map[string]string{
+		autoscaling.LifecycleStatePendingWait:     "autoscaling:EC2_INSTANCE_LAUNCHING",
+		autoscaling.LifecycleStateTerminatingWait: "autoscaling:EC2_INSTANCE_TERMINATING",
+	}
+)
+
+// reconciler periodically compares the lifecycle states of the instances in
+// allowed auto scaling groups with what cyclist knows of them. Instances left
+// waiting on lifecycle actions that were never received have them made up,
+// instances never heard of are flagged, and the pending lifecycle actions and
+// state of instances that are gone are cleaned up, leaving their events to
+// expire.
+type reconciler struct {
+	db        repo
+	log       logrus.FieldLogger
+	asSvc     autoscalingiface.AutoScalingAPI
+	tokGen    tokenGenerator
+	allowlist *lifecycleAllowlist
+	interval  time.Duration
+
+	// waiting holds the wait states seen on the previous pass, so that
+	// lifecycle actions are only made up for instances that have been waiting
+	// for longer than it takes for a notification to be delivered
+	waiting map[string]string
+
+	// missing holds the instances known to cyclist that were in no auto
+	// scaling group on the previous pass, so that only instances missing on
+	// two passes in a row are cleaned up, rather than those that the
+	// eventually consistent listing doesn't show yet
+	missing map[string]bool
+}
+
+func newReconciler(db repo, log logrus.FieldLogger, asSvc autoscalingiface.AutoScalingAPI,
+	tokGen tokenGenerator, allowlist *lifecycleAllowlist, interval time.Duration) *reconciler {
+
+	return &reconciler{
+		db:        db,
+		log:       log.WithField("self", "reconciler"),
+		asSvc:     asSvc,
+		tokGen:    tokGen,
+		allowlist: allowlist,
+		interval:  interval,
+
+		waiting: map[string]string{},
+		missing: map[string]bool{},
+	}
+}
+
+func (rc *reconciler) Run(ctx context.Context) {
+	rc.log.WithField("interval", rc.interval.String()).Info("starting")
+
+	ticker := time.NewTicker(rc.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			rc.log.Info("stopping")
+			return
+		case <-ticker.C:
+			err := rc.reconcile()
+			if err != nil {
+				rc.log.WithField("err", err).Error("failed to reconcile")
+			}
+		}
+	}
+}
+
+func (rc *reconciler) reconcile() error {
+	instances, err := rc.describeInstances()
+	if err != nil {
+		return err
+	}
+
+	hooks := map[string][]*autoscaling.LifecycleHook{}
+	waiting := map[string]string{}
+
+	for instanceID, inst := range instances {
+		if !rc.allowlist.allowASGName(aws.StringValue(inst.AutoScalingGroupName)) {
+			continue
+		}
+
+		log := rc.log.WithFields(logrus.Fields{
+			"instance": instanceID,
+			"asg":      aws.StringValue(inst.AutoScalingGroupName),
+			"state":    aws.StringValue(inst.LifecycleState),
+		})
+
+		state := aws.StringValue(inst.LifecycleState)
+		if _, ok := reconcileWaitStates[state]; ok {
+			waiting[instanceID] = state
+			if rc.waiting[instanceID] != state {
+				continue
+			}
+
+			err = rc.reconcileWaiting(log, inst, hooks)
+			if err != nil {
+				log.WithField("err", err).Error("failed to reconcile waiting instance")
+			}
+			continue
+		}
+
+		if state == autoscaling.LifecycleStateInService {
+			err = rc.flagUnknown(log, instanceID)
+			if err != nil {
+				log.WithField("err", err).Error("failed to flag unknown instance")
+			}
+		}
+	}
+
+	rc.waiting = waiting
+
+	return rc.cleanUp(instances)
+}
+
+// reconcileWaiting makes up the lifecycle actions of every hook for the wait
+// state that cyclist has no lifecycle action for, handling them as if they had
+// been received
+func (rc *reconciler) reconcileWaiting(log logrus.FieldLogger, inst *autoscaling.InstanceDetails,
+	hooks map[string][]*autoscaling.LifecycleHook) error {
+
+	instanceID := aws.StringValue(inst.InstanceId)
+	asgName := aws.StringValue(inst.AutoScalingGroupName)
+	lifecycleTransition := reconcileWaitStates[aws.StringValue(inst.LifecycleState)]
+
+	asgHooks, ok := hooks[asgName]
+	if !ok {
+		out, err := rc.asSvc.DescribeLifecycleHooks(&autoscaling.DescribeLifecycleHooksInput{
+			AutoScalingGroupName: aws.String(asgName),
+		})
+		if err != nil {
+			return err
+		}
+
+		asgHooks = out.LifecycleHooks
+		hooks[asgName] = asgHooks
+	}
+
+	for _, hook := range asgHooks {
+		if aws.StringValue(hook.LifecycleTransition) != lifecycleTransition {
+			continue
+		}
+
+		la := &lifecycleAction{
+			AutoScalingGroupName: asgName,
+			EC2InstanceID:        instanceID,
+			LifecycleTransition:  lifecycleTransition,
+			LifecycleHookName:    aws.StringValue(hook.LifecycleHookName),
+		}
+
+		known, err := rc.db.fetchInstanceLifecycleActions(la.Transition(), instanceID)
+		if err != nil {
+			return err
+		}
+
+		seen := false
+		for _, action := range known {
+			if action.LifecycleHookName == la.LifecycleHookName {
+				seen = true
+				break
+			}
+		}
+
+		if seen {
+			continue
+		}
+
+		hookLog := log.WithField("hook_name", la.LifecycleHookName)
+		hookLog.Warn("making up missing lifecycle action")
+
+		_, err = handleAutoScalingLifecycleAction(rc.db, hookLog, rc.tokGen, nil, la, rc.asSvc)
+		if err != nil {
+			return err
+		}
+
+		err = rc.db.storeInstanceEvent(instanceID, fmt.Sprintf("reconciled_%s", la.Transition()))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// flagUnknown records an event for in service instances that cyclist has no
+// state or events for
+func (rc *reconciler) flagUnknown(log logrus.FieldLogger, instanceID string) error {
+	if state, err := rc.db.fetchInstanceState(instanceID); err == nil && state != "" {
+		return nil
+	}
+
+	events, err := rc.db.fetchInstanceEvents(instanceID)
+	if err != nil {
+		return err
+	}
+
+	if len(events) > 0 {
+		return nil
+	}
+
+	log.Warn("flagging unknown instance")
+	return rc.db.storeInstanceEvent(instanceID, "unknown")
+}
+
+// cleanUp expires the pending lifecycle actions and wipes the state of
+// instances that have been in no auto scaling group on two passes in a row
+func (rc *reconciler) cleanUp(instances map[string]*autoscaling.InstanceDetails) error {
+	missing := map[string]bool{}
+	defer func() { rc.missing = missing }()
+
+	for _, lt := range lifecycleTransitions.all() {
+		pending, err := rc.db.fetchPendingLifecycleActions(lt.Name)
+		if err != nil {
+			return err
+		}
+
+		for _, la := range pending {
+			if _, ok := instances[la.EC2InstanceID]; ok {
+				continue
+			}
+
+			if !rc.allowlist.allowASGName(la.AutoScalingGroupName) {
+				continue
+			}
+
+			missing[la.EC2InstanceID] = true
+			if !rc.missing[la.EC2InstanceID] {
+				continue
+			}
+
+			log := rc.log.WithFields(logrus.Fields{
+				"instance":   la.EC2InstanceID,
+				"asg":        la.AutoScalingGroupName,
+				"hook_name":  la.LifecycleHookName,
+				"transition": lt.Name,
+			})
+			log.Warn("cleaning up vanished instance")
+
+			err = rc.db.expireInstanceLifecycleAction(lt.Name, la.EC2InstanceID, la.LifecycleHookName)
+			if err != nil {
+				log.WithField("err", err).Warn("failed to expire lifecycle action")
+			}
+
+			err = rc.db.wipeInstanceState(la.EC2InstanceID)
+			if err != nil {
+				log.WithField("err", err).Debug("failed to wipe instance state")
+			}
+
+			err = rc.db.storeInstanceEvent(la.EC2InstanceID, "vanished")
+			if err != nil {
+				log.WithField("err", err).Warn("failed to store vanished event")
+			}
+		}
+	}
+
+	// instances without pending lifecycle actions are only known by their
+	// events, and only their state is left to clean up as events expire
+	events, err := rc.db.fetchAllInstanceEvents()
+	if err != nil {
+		return err
+	}
+
+	for instanceID := range events {
+		if _, ok := instances[instanceID]; ok {
+			continue
+		}
+
+		missing[instanceID] = true
+		if !rc.missing[instanceID] {
+			continue
+		}
+
+		_, err = rc.db.fetchInstanceState(instanceID)
+		if err == errNoInstanceState {
+			continue
+		}
+
+		log := rc.log.WithField("instance", instanceID)
+		if err != nil {
+			log.WithField("err", err).Warn("failed to fetch instance state")
+			continue
+		}
+
+		log.Warn("cleaning up vanished instance state")
+
+		err = rc.db.wipeInstanceState(instanceID)
+		if err != nil {
+			log.WithField("err", err).Warn("failed to wipe instance state")
+			continue
+		}
+
+		err = rc.db.storeInstanceEvent(instanceID, "vanished")
+		if err != nil {
+			log.WithField("err", err).Warn("failed to store vanished event")
+		}
+	}
+
+	return nil
+}
+
+// describeInstances lists the instances of every auto scaling group, including
+// those that aren't allowed, so that their instances aren't taken to be gone
+func (rc *reconciler) describeInstances() (map[string]*autoscaling.InstanceDetails, error) {
+	instances := map[string]*autoscaling.InstanceDetails{}
+
+	err := rc.asSvc.DescribeAutoScalingInstancesPages(&autoscaling.DescribeAutoScalingInstancesInput{},
+		func(page *autoscaling.DescribeAutoScalingInstancesOutput, lastPage bool) bool {
+			for _, inst := range page.AutoScalingInstances {
+				instances[aws.StringValue(inst.InstanceId)] = inst
+			}
+			return true
+		})
+
+	return instances, err
+}
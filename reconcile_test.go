@@ -0,0 +1,173 @@
+package cyclist
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestReconcilerAutoScalingService(instances map[string][2]string) func(*request.Request) {
+	return func(r *request.Request) {
+		switch v := r.Params.(type) {
+		case *autoscaling.DescribeAutoScalingInstancesInput:
+			out := r.Data.(*autoscaling.DescribeAutoScalingInstancesOutput)
+			for instanceID, asgState := range instances {
+				out.AutoScalingInstances = append(out.AutoScalingInstances, &autoscaling.InstanceDetails{
+					InstanceId:           aws.String(instanceID),
+					AutoScalingGroupName: aws.String(asgState[0]),
+					LifecycleState:       aws.String(asgState[1]),
+				})
+			}
+		case *autoscaling.DescribeLifecycleHooksInput:
+			out := r.Data.(*autoscaling.DescribeLifecycleHooksOutput)
+			out.LifecycleHooks = []*autoscaling.LifecycleHook{
+				{
+					AutoScalingGroupName: v.AutoScalingGroupName,
+					LifecycleHookName:    aws.String("huzzah-9001"),
+					LifecycleTransition:  aws.String("autoscaling:EC2_INSTANCE_LAUNCHING"),
+				},
+				{
+					AutoScalingGroupName: v.AutoScalingGroupName,
+					LifecycleHookName:    aws.String("hooray-9002"),
+					LifecycleTransition:  aws.String("autoscaling:EC2_INSTANCE_TERMINATING"),
+				},
+			}
+		}
+	}
+}
+
+func TestReconciler_reconcile(t *testing.T) {
+	db := newTestRepo()
+	_ = db.storeInstanceLifecycleAction(&lifecycleAction{
+		LifecycleTransition:  "autoscaling:EC2_INSTANCE_LAUNCHING",
+		EC2InstanceID:        "i-bababab",
+		LifecycleActionToken: "TOKEYTOKETOK",
+		AutoScalingGroupName: "cat-theatre-napkin-hose",
+		LifecycleHookName:    "huzzah-9001",
+	})
+	_ = db.setInstanceState("i-dadadad", "down")
+	_ = db.storeInstanceLifecycleAction(&lifecycleAction{
+		LifecycleTransition:  "autoscaling:EC2_INSTANCE_TERMINATING",
+		EC2InstanceID:        "i-dadadad",
+		LifecycleActionToken: "TOKEYTOKETOK",
+		AutoScalingGroupName: "cat-theatre-napkin-hose",
+		LifecycleHookName:    "hooray-9002",
+	})
+	_ = db.storeInstanceLifecycleAction(&lifecycleAction{
+		LifecycleTransition:  "autoscaling:EC2_INSTANCE_TERMINATING",
+		EC2InstanceID:        "i-eaeaeae",
+		LifecycleActionToken: "TOKEYTOKETOK",
+		AutoScalingGroupName: "whimsical-mime-headphone",
+		LifecycleHookName:    "hooray-9002",
+	})
+
+	asSvc := newTestAutoScalingService(newTestReconcilerAutoScalingService(map[string][2]string{
+		"i-fafafaf": {"cat-theatre-napkin-hose", autoscaling.LifecycleStatePendingWait},
+		"i-bababab": {"cat-theatre-napkin-hose", autoscaling.LifecycleStatePendingWait},
+		"i-cacacac": {"cat-theatre-napkin-hose", autoscaling.LifecycleStateInService},
+		"i-fefefef": {"whimsical-mime-headphone", autoscaling.LifecycleStateInService},
+	}))
+
+	allowlist, err := newLifecycleAllowlist(nil, nil, []string{"cat-theatre-*"})
+	assert.Nil(t, err)
+
+	rc := newReconciler(db, shushLog, asSvc, newTestTokenGenerator(), allowlist, time.Minute)
+
+	assert.Nil(t, rc.reconcile())
+	las, err := db.fetchInstanceLifecycleActions("launching", "i-fafafaf")
+	assert.Nil(t, err)
+	assert.Len(t, las, 0)
+
+	assert.NotNil(t, db.e["i-cacacac"]["unknown"])
+	assert.Nil(t, db.e["i-fefefef"]["unknown"])
+
+	assert.False(t, db.la["terminating:i-dadadad:hooray-9002"].Expired)
+	assert.Equal(t, "down", db.s["i-dadadad"])
+
+	assert.Nil(t, rc.reconcile())
+	assert.True(t, db.la["terminating:i-dadadad:hooray-9002"].Expired)
+	assert.NotNil(t, db.e["i-dadadad"]["vanished"])
+	assert.Equal(t, "", db.s["i-dadadad"])
+	assert.False(t, db.la["terminating:i-eaeaeae:hooray-9002"].Expired)
+
+	las, err = db.fetchInstanceLifecycleActions("launching", "i-fafafaf")
+	assert.Nil(t, err)
+	assert.Len(t, las, 1)
+	assert.Equal(t, "huzzah-9001", las[0].LifecycleHookName)
+	assert.Equal(t, "", las[0].LifecycleActionToken)
+	assert.Equal(t, "up", db.s["i-fafafaf"])
+	assert.NotNil(t, db.e["i-fafafaf"]["reconciled_launching"])
+	assert.NotNil(t, db.e["i-fafafaf"]["prelaunching"])
+
+	assert.Nil(t, db.e["i-bababab"]["reconciled_launching"])
+}
+
+func TestReconciler_reconcile_WithActionStoredAfterListing(t *testing.T) {
+	db := newTestRepo()
+	instances := map[string][2]string{}
+	listed := newTestReconcilerAutoScalingService(instances)
+	asSvc := newTestAutoScalingService(func(r *request.Request) {
+		listed(r)
+		if _, ok := r.Params.(*autoscaling.DescribeAutoScalingInstancesInput); ok && db.la["launching:i-fafafaf:huzzah-9001"] == nil {
+			_ = db.setInstanceState("i-fafafaf", "up")
+			_ = db.storeInstanceEvent("i-fafafaf", "prelaunching")
+			_ = db.storeInstanceLifecycleAction(&lifecycleAction{
+				LifecycleTransition:  "autoscaling:EC2_INSTANCE_LAUNCHING",
+				EC2InstanceID:        "i-fafafaf",
+				AutoScalingGroupName: "cat-theatre-napkin-hose",
+				LifecycleHookName:    "huzzah-9001",
+			})
+		}
+	})
+
+	rc := newReconciler(db, shushLog, asSvc, newTestTokenGenerator(), nil, time.Minute)
+
+	assert.Nil(t, rc.reconcile())
+	assert.False(t, db.la["launching:i-fafafaf:huzzah-9001"].Expired)
+	assert.Equal(t, "up", db.s["i-fafafaf"])
+
+	instances["i-fafafaf"] = [2]string{"cat-theatre-napkin-hose", autoscaling.LifecycleStatePendingWait}
+
+	assert.Nil(t, rc.reconcile())
+	assert.False(t, db.la["launching:i-fafafaf:huzzah-9001"].Completed)
+	assert.Equal(t, "up", db.s["i-fafafaf"])
+	assert.Nil(t, db.e["i-fafafaf"]["vanished"])
+}
+
+func TestReconciler_reconcile_WithVanishedState(t *testing.T) {
+	db := newTestRepo()
+	_ = db.setInstanceState("i-fafafaf", "up")
+	_ = db.storeInstanceEvent("i-fafafaf", "launching")
+	_ = db.setInstanceState("i-bababab", "up")
+	_ = db.storeInstanceEvent("i-bababab", "launching")
+
+	asSvc := newTestAutoScalingService(newTestReconcilerAutoScalingService(map[string][2]string{
+		"i-bababab": {"whimsical-mime-headphone", autoscaling.LifecycleStateInService},
+	}))
+
+	allowlist, err := newLifecycleAllowlist(nil, nil, []string{"cat-theatre-*"})
+	assert.Nil(t, err)
+
+	rc := newReconciler(db, shushLog, asSvc, newTestTokenGenerator(), allowlist, time.Minute)
+
+	assert.Nil(t, rc.reconcile())
+	assert.Equal(t, "up", db.s["i-fafafaf"])
+
+	assert.Nil(t, rc.reconcile())
+	assert.Equal(t, "", db.s["i-fafafaf"])
+	assert.NotNil(t, db.e["i-fafafaf"]["vanished"])
+	assert.Equal(t, "up", db.s["i-bababab"])
+	assert.Nil(t, db.e["i-bababab"]["vanished"])
+
+	assert.Nil(t, rc.reconcile())
+	assert.Len(t, db.e["i-fafafaf"], 2)
+}
+
+func TestLifecycleAction_token(t *testing.T) {
+	assert.Nil(t, (&lifecycleAction{}).token())
+	assert.Equal(t, "TOKEYTOKETOK", *(&lifecycleAction{LifecycleActionToken: "TOKEYTOKETOK"}).token())
+}
@@ -0,0 +1,319 @@
+package cyclist
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	redisSentinelDefaultPort = "26379"
+)
+
+// redisPoolOptions configures the pool built by buildRedisPool, where timeouts
+// of 0 never time out and a MaxActive of 0 is unlimited
+type redisPoolOptions struct {
+	URL            string
+	MaxIdle        int
+	MaxActive      int
+	IdleTimeout    time.Duration
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
+	TLSCAFile      string
+}
+
+// buildRedisPool builds a pool of connections to either a single redis, given
+// a redis:// or rediss:// URL, or the primary monitored by sentinels, given a
+// redis+sentinel:// or rediss+sentinel:// URL such as
+// redis+sentinel://:password@sentinel-a:26379,sentinel-b:26379/primary-name/0
+func buildRedisPool(opts *redisPoolOptions) (*redis.Pool, error) {
+	dialOpts := []redis.DialOption{
+		redis.DialConnectTimeout(opts.ConnectTimeout),
+		redis.DialReadTimeout(opts.ReadTimeout),
+		redis.DialWriteTimeout(opts.WriteTimeout),
+	}
+
+	if opts.TLSCAFile != "" {
+		tlsConfig, err := buildRedisTLSConfig(opts.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		dialOpts = append(dialOpts, redis.DialTLSConfig(tlsConfig))
+	}
+
+	var dial func() (redis.Conn, error)
+
+	scheme := strings.SplitN(opts.URL, "://", 2)[0]
+
+	switch scheme {
+	case "redis", "rediss":
+		dial = func() (redis.Conn, error) {
+			return redis.DialURL(opts.URL, dialOpts...)
+		}
+	case "redis+sentinel", "rediss+sentinel":
+		rs, err := newRedisSentinel(opts.URL, dialOpts)
+		if err != nil {
+			return nil, err
+		}
+		dial = rs.dialPrimary
+	default:
+		return nil, fmt.Errorf("unsupported redis URL scheme '%s'", scheme)
+	}
+
+	return &redis.Pool{
+		MaxIdle:     opts.MaxIdle,
+		MaxActive:   opts.MaxActive,
+		Wait:        opts.MaxActive > 0,
+		IdleTimeout: opts.IdleTimeout,
+		Dial:        dial,
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Minute {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		},
+	}, nil
+}
+
+func buildRedisTLSConfig(caFile string) (*tls.Config, error) {
+	caBytes, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	rootCAs := x509.NewCertPool()
+	if !rootCAs.AppendCertsFromPEM(caBytes) {
+		return nil, fmt.Errorf("no certificates found in '%s'", caFile)
+	}
+
+	return &tls.Config{RootCAs: rootCAs}, nil
+}
+
+// redisSentinel asks the sentinels monitoring a primary for its address
+// whenever a connection is dialed, so that new connections follow failovers
+type redisSentinel struct {
+	mutex sync.Mutex
+	addrs []string
+
+	primaryName      string
+	sentinelDialOpts []redis.DialOption
+	primaryDialOpts  []redis.DialOption
+
+	dial func(string, string, ...redis.DialOption) (redis.Conn, error)
+}
+
+func newRedisSentinel(rawurl string, dialOpts []redis.DialOption) (*redisSentinel, error) {
+	redisURL, hosts, err := parseRedisSentinelURL(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := []string{}
+	for _, addr := range strings.Split(hosts, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(strings.Trim(addr, "[]"), redisSentinelDefaultPort)
+		}
+
+		addrs = append(addrs, addr)
+	}
+
+	if len(addrs) == 0 {
+		return nil, errors.New("missing sentinel addresses in redis URL")
+	}
+
+	pathParts := strings.Split(strings.Trim(redisURL.Path, "/"), "/")
+	if pathParts[0] == "" || len(pathParts) > 2 {
+		return nil, fmt.Errorf("invalid sentinel path '%s', expected /<primary-name>[/<db>]", redisURL.Path)
+	}
+
+	db := 0
+	if len(pathParts) == 2 && pathParts[1] != "" {
+		db, err = strconv.Atoi(pathParts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid database in redis URL: %v", err)
+		}
+	}
+
+	sentinelDialOpts := append([]redis.DialOption{}, dialOpts...)
+	sentinelDialOpts = append(sentinelDialOpts, redis.DialUseTLS(redisURL.Scheme == "rediss+sentinel"))
+
+	primaryDialOpts := append([]redis.DialOption{}, sentinelDialOpts...)
+	primaryDialOpts = append(primaryDialOpts, redis.DialDatabase(db))
+
+	if redisURL.User != nil {
+		if password, ok := redisURL.User.Password(); ok {
+			primaryDialOpts = append(primaryDialOpts, redis.DialPassword(password))
+		}
+	}
+
+	return &redisSentinel{
+		addrs: addrs,
+
+		primaryName:      pathParts[0],
+		sentinelDialOpts: sentinelDialOpts,
+		primaryDialOpts:  primaryDialOpts,
+
+		dial: redis.Dial,
+	}, nil
+}
+
+// parseRedisSentinelURL parses a sentinel URL and returns its comma separated
+// hosts apart, as these are not a valid URL host when any but the last has a
+// port
+func parseRedisSentinelURL(rawurl string) (*url.URL, string, error) {
+	urlParts := strings.SplitN(rawurl, "://", 2)
+	if len(urlParts) != 2 {
+		return nil, "", fmt.Errorf("invalid sentinel URL '%s'", rawurl)
+	}
+
+	rest := urlParts[1]
+	authorityEnd := strings.Index(rest, "/")
+	if authorityEnd == -1 {
+		authorityEnd = len(rest)
+	}
+
+	userinfo := ""
+	hosts := rest[:authorityEnd]
+	if i := strings.LastIndex(hosts, "@"); i != -1 {
+		userinfo = hosts[:i+1]
+		hosts = hosts[i+1:]
+	}
+
+	redisURL, err := url.Parse(fmt.Sprintf("%s://%ssentinels%s", urlParts[0], userinfo, rest[authorityEnd:]))
+	return redisURL, hosts, err
+}
+
+// dialPrimary dials the primary, refusing redis that are not or no longer the
+// primary, such as those still being demoted by a failover
+func (rs *redisSentinel) dialPrimary() (redis.Conn, error) {
+	addr, err := rs.primaryAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := rs.dial("tcp", addr, rs.primaryDialOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	role, err := redisRole(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	if role != "master" {
+		_ = conn.Close()
+		return nil, fmt.Errorf("redis at %s is a %s rather than the primary '%s'", addr, role, rs.primaryName)
+	}
+
+	return &redisSentinelConn{Conn: conn}, nil
+}
+
+// primaryAddr asks each sentinel in turn for the address of the primary,
+// moving the first to answer to the front so that it is asked first next time
+func (rs *redisSentinel) primaryAddr() (string, error) {
+	rs.mutex.Lock()
+	addrs := append([]string{}, rs.addrs...)
+	rs.mutex.Unlock()
+
+	errs := []string{}
+	for i, addr := range addrs {
+		primaryAddr, err := rs.askSentinel(addr)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", addr, err))
+			continue
+		}
+
+		if i > 0 {
+			rs.mutex.Lock()
+			rs.addrs = append([]string{addr}, append(addrs[:i:i], addrs[i+1:]...)...)
+			rs.mutex.Unlock()
+		}
+
+		return primaryAddr, nil
+	}
+
+	return "", fmt.Errorf("no sentinel knows the primary '%s': %s", rs.primaryName, strings.Join(errs, "; "))
+}
+
+func (rs *redisSentinel) askSentinel(addr string) (string, error) {
+	conn, err := rs.dial("tcp", addr, rs.sentinelDialOpts...)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	hostPort, err := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", rs.primaryName))
+	if err != nil {
+		return "", err
+	}
+
+	if len(hostPort) != 2 {
+		return "", fmt.Errorf("unexpected primary address %v", hostPort)
+	}
+
+	return net.JoinHostPort(hostPort[0], hostPort[1]), nil
+}
+
+func redisRole(conn redis.Conn) (string, error) {
+	reply, err := redis.Values(conn.Do("ROLE"))
+	if err != nil {
+		return "", err
+	}
+
+	if len(reply) == 0 {
+		return "", errors.New("empty role reply")
+	}
+
+	return redis.String(reply[0], nil)
+}
+
+// redisSentinelConn breaks on READONLY replies, so that the pool drops it
+// rather than keep using a primary that a failover has demoted
+type redisSentinelConn struct {
+	redis.Conn
+	err error
+}
+
+func (rsc *redisSentinelConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	reply, err := rsc.Conn.Do(commandName, args...)
+	rsc.check(err)
+	return reply, err
+}
+
+func (rsc *redisSentinelConn) Receive() (interface{}, error) {
+	reply, err := rsc.Conn.Receive()
+	rsc.check(err)
+	return reply, err
+}
+
+func (rsc *redisSentinelConn) Err() error {
+	if rsc.err != nil {
+		return rsc.err
+	}
+	return rsc.Conn.Err()
+}
+
+func (rsc *redisSentinelConn) check(err error) {
+	if redisErr, ok := err.(redis.Error); ok && strings.HasPrefix(string(redisErr), "READONLY") {
+		rsc.err = err
+	}
+}
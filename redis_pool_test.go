@@ -0,0 +1,208 @@
+package cyclist
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRedisSentinel(t *testing.T, rawurl string, conns map[string]*redigomock.Conn) *redisSentinel {
+	rs, err := newRedisSentinel(rawurl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs.dial = func(network, addr string, opts ...redis.DialOption) (redis.Conn, error) {
+		conn, ok := conns[addr]
+		if !ok {
+			return nil, errors.New("connection refused")
+		}
+		return conn, nil
+	}
+
+	return rs
+}
+
+func writeTestCAFile(t *testing.T, pemBytes []byte) string {
+	f, err := ioutil.TempFile("", "cyclist-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	_, err = f.Write(pemBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return f.Name()
+}
+
+func TestBuildRedisPool(t *testing.T) {
+	pool, err := buildRedisPool(&redisPoolOptions{
+		URL:         "redis://localhost:6379/0",
+		MaxIdle:     7,
+		MaxActive:   20,
+		IdleTimeout: 3 * time.Minute,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 7, pool.MaxIdle)
+	assert.Equal(t, 20, pool.MaxActive)
+	assert.True(t, pool.Wait)
+	assert.Equal(t, 3*time.Minute, pool.IdleTimeout)
+}
+
+func TestBuildRedisPool_WithSentinelURL(t *testing.T) {
+	pool, err := buildRedisPool(&redisPoolOptions{
+		URL: "redis+sentinel://sentinel-a:26379,sentinel-b/primary/0",
+	})
+	assert.Nil(t, err)
+	assert.NotNil(t, pool.Dial)
+	assert.False(t, pool.Wait)
+}
+
+func TestBuildRedisPool_WithInvalidURL(t *testing.T) {
+	for _, rawurl := range []string{
+		"memcached://localhost:11211",
+		"redis+sentinel:///primary",
+		"redis+sentinel://sentinel-a",
+		"redis+sentinel://sentinel-a/primary/zero",
+		"redis+sentinel://sentinel-a/primary/0/extra",
+	} {
+		_, err := buildRedisPool(&redisPoolOptions{URL: rawurl})
+		assert.NotNil(t, err, rawurl)
+	}
+}
+
+func TestBuildRedisPool_WithTLSCAFile(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certBytes, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "cyclist test ca"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "cyclist test ca"},
+	}, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caFile := writeTestCAFile(t, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes}))
+	defer os.Remove(caFile)
+
+	tlsConfig, err := buildRedisTLSConfig(caFile)
+	assert.Nil(t, err)
+	assert.Len(t, tlsConfig.RootCAs.Subjects(), 1)
+
+	_, err = buildRedisPool(&redisPoolOptions{URL: "rediss://localhost:6380/0", TLSCAFile: caFile})
+	assert.Nil(t, err)
+}
+
+func TestBuildRedisPool_WithInvalidTLSCAFile(t *testing.T) {
+	caFile := writeTestCAFile(t, []byte("not a certificate"))
+	defer os.Remove(caFile)
+
+	_, err := buildRedisPool(&redisPoolOptions{URL: "rediss://localhost:6380/0", TLSCAFile: caFile})
+	assert.NotNil(t, err)
+
+	_, err = buildRedisPool(&redisPoolOptions{URL: "rediss://localhost:6380/0", TLSCAFile: caFile + ".nope"})
+	assert.NotNil(t, err)
+}
+
+func TestNewRedisSentinel(t *testing.T) {
+	rs, err := newRedisSentinel("rediss+sentinel://:hunter2@sentinel-a:26380,sentinel-b,[::1]/primary/2", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"sentinel-a:26380", "sentinel-b:26379", "[::1]:26379"}, rs.addrs)
+	assert.Equal(t, "primary", rs.primaryName)
+	assert.Len(t, rs.sentinelDialOpts, 1)
+	assert.Len(t, rs.primaryDialOpts, 3)
+}
+
+func TestRedisSentinel_dialPrimary(t *testing.T) {
+	sentinelB := redigomock.NewConn()
+	sentinelB.Command("SENTINEL", "get-master-addr-by-name", "primary").
+		Expect([]interface{}{[]byte("10.0.0.2"), []byte("6379")})
+
+	primary := redigomock.NewConn()
+	primary.Command("ROLE").Expect([]interface{}{[]byte("master"), int64(3129659), []interface{}{}})
+
+	rs := newTestRedisSentinel(t, "redis+sentinel://sentinel-a,sentinel-b/primary", map[string]*redigomock.Conn{
+		"sentinel-b:26379": sentinelB,
+		"10.0.0.2:6379":    primary,
+	})
+
+	conn, err := rs.dialPrimary()
+	assert.Nil(t, err)
+	assert.NotNil(t, conn)
+	assert.Equal(t, []string{"sentinel-b:26379", "sentinel-a:26379"}, rs.addrs)
+}
+
+func TestRedisSentinel_dialPrimary_WithDemotedPrimary(t *testing.T) {
+	sentinel := redigomock.NewConn()
+	sentinel.Command("SENTINEL", "get-master-addr-by-name", "primary").
+		Expect([]interface{}{[]byte("10.0.0.1"), []byte("6379")})
+
+	demoted := redigomock.NewConn()
+	demoted.Command("ROLE").Expect([]interface{}{[]byte("slave"), []byte("10.0.0.2"), int64(6379), []byte("connected"), int64(3129659)})
+
+	rs := newTestRedisSentinel(t, "redis+sentinel://sentinel-a/primary", map[string]*redigomock.Conn{
+		"sentinel-a:26379": sentinel,
+		"10.0.0.1:6379":    demoted,
+	})
+
+	_, err := rs.dialPrimary()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "slave")
+}
+
+func TestRedisSentinel_dialPrimary_WithUnknownPrimary(t *testing.T) {
+	sentinel := redigomock.NewConn()
+	sentinel.Command("SENTINEL", "get-master-addr-by-name", "primary").Expect(nil)
+
+	rs := newTestRedisSentinel(t, "redis+sentinel://sentinel-a,sentinel-b/primary", map[string]*redigomock.Conn{
+		"sentinel-a:26379": sentinel,
+	})
+
+	_, err := rs.dialPrimary()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "sentinel-a:26379")
+	assert.Contains(t, err.Error(), "sentinel-b:26379")
+}
+
+func TestRedisSentinelConn_Err(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("GET", "cyclist:instance:i-fafafaf:state").Expect([]byte("up"))
+	conn.Command("SET", "cyclist:instance:i-fafafaf:state", "down").
+		ExpectError(redis.Error("READONLY You can't write against a read only slave."))
+
+	rsc := &redisSentinelConn{Conn: conn}
+
+	_, err := rsc.Do("GET", "cyclist:instance:i-fafafaf:state")
+	assert.Nil(t, err)
+	assert.Nil(t, rsc.Err())
+
+	_, err = rsc.Do("SET", "cyclist:instance:i-fafafaf:state", "down")
+	assert.NotNil(t, err)
+	assert.NotNil(t, rsc.Err())
+}
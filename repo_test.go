@@ -0,0 +1,399 @@
+package cyclist
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testClock struct {
+	mutex sync.Mutex
+	t     time.Time
+
+	// onAdvance moves on the clocks of repos that expire keys by their own,
+	// such as redis
+	onAdvance func(time.Duration)
+}
+
+func newTestClock() *testClock {
+	return &testClock{t: time.Date(2017, time.December, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (tc *testClock) now() time.Time {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	return tc.t
+}
+
+func (tc *testClock) advance(d time.Duration) {
+	tc.mutex.Lock()
+	tc.t = tc.t.Add(d)
+	onAdvance := tc.onAdvance
+	tc.mutex.Unlock()
+
+	if onAdvance != nil {
+		onAdvance(d)
+	}
+}
+
+// runRepoBehaviourTests runs the behaviours shared by every repo that keeps
+// its own TTLs against fresh repos built by newRepo, which are expected to use
+// TTLs of an hour for events, lifecycle actions and messages, ten minutes for
+// tokens and a minute for temporary tokens
+func runRepoBehaviourTests(t *testing.T, newRepo func(*testClock) (repo, func())) {
+	behaviours := map[string]func(*testing.T, repo, *testClock){
+		"InstanceState":                     testRepoInstanceState,
+		"InstanceState_WithEmptyInstanceID": testRepoInstanceState_WithEmptyInstanceID,
+		"InstanceEvents":                    testRepoInstanceEvents,
+		"InstanceEvents_Expire":             testRepoInstanceEvents_Expire,
+		"LifecycleActions":                  testRepoLifecycleActions,
+		"LifecycleActions_Expire":           testRepoLifecycleActions_Expire,
+		"InstanceLastTransition":            testRepoInstanceLastTransition,
+		"InstanceTokens":                    testRepoInstanceTokens,
+		"SNSSubscriptions":                  testRepoSNSSubscriptions,
+		"Messages":                          testRepoMessages,
+		"CycleRuns":                         testRepoCycleRuns,
+		"CycleRunLocks":                     testRepoCycleRunLocks,
+		"Concurrent":                        testRepoConcurrent,
+	}
+
+	for name, behaviour := range behaviours {
+		behaviour := behaviour
+		t.Run(name, func(t *testing.T) {
+			clock := newTestClock()
+			r, cleanup := newRepo(clock)
+			defer cleanup()
+			behaviour(t, r, clock)
+		})
+	}
+}
+
+func testRepoInstanceState(t *testing.T, r repo, clock *testClock) {
+	_, err := r.fetchInstanceState("i-fafafaf")
+	assert.Equal(t, errNoInstanceState, err)
+
+	assert.Nil(t, r.setInstanceState("i-fafafaf", "up"))
+	assert.Nil(t, r.storeInstanceProtection("i-fafafaf", true))
+
+	state, err := r.fetchInstanceState("i-fafafaf")
+	assert.Nil(t, err)
+	assert.Equal(t, "up", state)
+
+	protected, err := r.fetchInstanceProtection("i-fafafaf")
+	assert.Nil(t, err)
+	assert.True(t, protected)
+
+	assert.Nil(t, r.wipeInstanceState("i-fafafaf"))
+
+	_, err = r.fetchInstanceState("i-fafafaf")
+	assert.Equal(t, errNoInstanceState, err)
+
+	protected, err = r.fetchInstanceProtection("i-fafafaf")
+	assert.Nil(t, err)
+	assert.False(t, protected)
+}
+
+func testRepoInstanceState_WithEmptyInstanceID(t *testing.T, r repo, clock *testClock) {
+	assert.Equal(t, errEmptyInstanceID, r.setInstanceState("", "up"))
+	assert.Equal(t, errEmptyInstanceID, r.wipeInstanceState(""))
+	_, err := r.fetchInstanceState("")
+	assert.Equal(t, errEmptyInstanceID, err)
+}
+
+func testRepoInstanceEvents(t *testing.T, r repo, clock *testClock) {
+	assert.Nil(t, r.storeInstanceEvent("i-fafafaf", "prelaunching"))
+	clock.advance(time.Second)
+	assert.Nil(t, r.storeInstanceEvent("i-fafafaf", "launching"))
+
+	events, err := r.fetchInstanceEvents("i-fafafaf")
+	assert.Nil(t, err)
+	assert.Len(t, events, 2)
+	assert.Equal(t, "prelaunching", events[0].Event)
+	assert.Equal(t, "launching", events[1].Event)
+
+	event, err := r.fetchInstanceEvent("i-fafafaf", "launching")
+	assert.Nil(t, err)
+	assert.Equal(t, clock.now(), event.Timestamp)
+
+	_, err = r.fetchInstanceEvent("i-fafafaf", "terminating")
+	assert.NotNil(t, err)
+
+	events, err = r.fetchInstanceEvents("i-nope")
+	assert.Nil(t, err)
+	assert.Len(t, events, 0)
+
+	all, err := r.fetchAllInstanceEvents()
+	assert.Nil(t, err)
+	assert.Len(t, all, 1)
+	assert.Len(t, all["i-fafafaf"], 2)
+
+	assert.Equal(t, errEmptyEvent, r.storeInstanceEvent("i-fafafaf", ""))
+}
+
+func testRepoInstanceEvents_Expire(t *testing.T, r repo, clock *testClock) {
+	assert.Nil(t, r.storeInstanceEvent("i-fafafaf", "launching"))
+	clock.advance(45 * time.Minute)
+	assert.Nil(t, r.storeInstanceEvent("i-fafafaf", "terminating"))
+	clock.advance(45 * time.Minute)
+
+	events, err := r.fetchInstanceEvents("i-fafafaf")
+	assert.Nil(t, err)
+	assert.Len(t, events, 2)
+
+	clock.advance(time.Hour)
+
+	events, err = r.fetchInstanceEvents("i-fafafaf")
+	assert.Nil(t, err)
+	assert.Len(t, events, 0)
+
+	all, err := r.fetchAllInstanceEvents()
+	assert.Nil(t, err)
+	assert.Len(t, all, 0)
+}
+
+func testRepoLifecycleActions(t *testing.T, r repo, clock *testClock) {
+	la := &lifecycleAction{
+		LifecycleTransition:  "autoscaling:EC2_INSTANCE_LAUNCHING",
+		EC2InstanceID:        "i-fafafaf",
+		LifecycleActionToken: "TOKEYTOKETOKE",
+		AutoScalingGroupName: "fafafaf-asg",
+		LifecycleHookName:    "fafafaf-hook",
+	}
+	assert.Nil(t, r.storeInstanceLifecycleAction(la))
+	assert.NotNil(t, r.storeInstanceLifecycleAction(&lifecycleAction{}))
+
+	la.LifecycleHookName = "changed-after-store"
+
+	pending, err := r.fetchPendingLifecycleActions("launching")
+	assert.Nil(t, err)
+	assert.Len(t, pending, 1)
+	assert.Equal(t, "fafafaf-hook", pending[0].LifecycleHookName)
+
+	actions, err := r.fetchInstanceLifecycleActions("launching", "i-fafafaf")
+	assert.Nil(t, err)
+	assert.Len(t, actions, 1)
+
+	actions, err = r.fetchInstanceLifecycleActions("terminating", "i-fafafaf")
+	assert.Nil(t, err)
+	assert.Len(t, actions, 0)
+
+	assert.Nil(t, r.completeInstanceLifecycleAction("launching", "i-fafafaf", "fafafaf-hook"))
+	assert.NotNil(t, r.completeInstanceLifecycleAction("launching", "i-fafafaf", "nope-hook"))
+
+	pending, err = r.fetchPendingLifecycleActions("launching")
+	assert.Nil(t, err)
+	assert.Len(t, pending, 0)
+
+	actions, err = r.fetchInstanceLifecycleActions("launching", "i-fafafaf")
+	assert.Nil(t, err)
+	assert.Len(t, actions, 1)
+	assert.True(t, actions[0].Completed)
+	assert.False(t, actions[0].Expired)
+
+	assert.Nil(t, r.expireInstanceLifecycleAction("launching", "i-fafafaf", "fafafaf-hook"))
+
+	actions, err = r.fetchInstanceLifecycleActions("launching", "i-fafafaf")
+	assert.Nil(t, err)
+	assert.True(t, actions[0].Expired)
+}
+
+func testRepoLifecycleActions_Expire(t *testing.T, r repo, clock *testClock) {
+	assert.Nil(t, r.storeInstanceLifecycleAction(&lifecycleAction{
+		LifecycleTransition:  "autoscaling:EC2_INSTANCE_TERMINATING",
+		EC2InstanceID:        "i-fafafaf",
+		AutoScalingGroupName: "fafafaf-asg",
+		LifecycleHookName:    "fafafaf-hook",
+	}))
+	assert.Nil(t, r.storeInstanceLastTransition("i-fafafaf", "terminating", clock.now()))
+
+	clock.advance(2 * time.Hour)
+
+	pending, err := r.fetchPendingLifecycleActions("terminating")
+	assert.Nil(t, err)
+	assert.Len(t, pending, 0)
+
+	it, err := r.fetchInstanceLastTransition("i-fafafaf")
+	assert.Nil(t, err)
+	assert.Nil(t, it)
+
+	assert.NotNil(t, r.completeInstanceLifecycleAction("terminating", "i-fafafaf", "fafafaf-hook"))
+}
+
+func testRepoInstanceLastTransition(t *testing.T, r repo, clock *testClock) {
+	it, err := r.fetchInstanceLastTransition("i-fafafaf")
+	assert.Nil(t, err)
+	assert.Nil(t, it)
+
+	assert.Nil(t, r.storeInstanceLastTransition("i-fafafaf", "launching", clock.now()))
+
+	it, err = r.fetchInstanceLastTransition("i-fafafaf")
+	assert.Nil(t, err)
+	assert.Equal(t, "launching", it.Transition)
+	assert.Equal(t, clock.now(), it.Time)
+}
+
+func testRepoInstanceTokens(t *testing.T, r repo, clock *testClock) {
+	assert.Nil(t, r.storeInstanceToken("i-fafafaf", "TOKEYTOKETOKE"))
+	assert.Nil(t, r.storeTempInstanceToken("i-fafafaf", "TEMPYTEMPTEMP"))
+	assert.Equal(t, errEmptyToken, r.storeInstanceToken("i-fafafaf", ""))
+
+	tok, err := r.fetchInstanceToken("i-fafafaf")
+	assert.Nil(t, err)
+	assert.Equal(t, "TOKEYTOKETOKE", tok)
+
+	tok, err = r.fetchTempInstanceToken("i-fafafaf")
+	assert.Nil(t, err)
+	assert.Equal(t, "TEMPYTEMPTEMP", tok)
+
+	clock.advance(2 * time.Minute)
+
+	_, err = r.fetchTempInstanceToken("i-fafafaf")
+	assert.NotNil(t, err)
+
+	for i := 0; i < 3; i++ {
+		clock.advance(7 * time.Minute)
+		tok, err = r.fetchInstanceToken("i-fafafaf")
+		assert.Nil(t, err)
+		assert.Equal(t, "TOKEYTOKETOKE", tok)
+	}
+
+	clock.advance(11 * time.Minute)
+
+	_, err = r.fetchInstanceToken("i-fafafaf")
+	assert.NotNil(t, err)
+}
+
+func testRepoSNSSubscriptions(t *testing.T, r repo, clock *testClock) {
+	assert.Nil(t, r.storeSNSSubscriptionState("arn:aws:sns:us-east-1:123456789012:zzz", "confirmed"))
+	assert.Nil(t, r.storeSNSSubscriptionState("arn:aws:sns:us-east-1:123456789012:aaa", "unsubscribed"))
+	assert.Equal(t, errEmptyTopicARN, r.storeSNSSubscriptionState("", "confirmed"))
+
+	subs, err := r.fetchSNSSubscriptions()
+	assert.Nil(t, err)
+	assert.Len(t, subs, 2)
+	assert.Equal(t, "arn:aws:sns:us-east-1:123456789012:aaa", subs[0].TopicARN)
+	assert.Equal(t, "unsubscribed", subs[0].State)
+	assert.Equal(t, "2017-12-01T00:00:00Z", subs[0].UpdatedAt)
+}
+
+func testRepoMessages(t *testing.T, r repo, clock *testClock) {
+	state, err := r.markMessageHandling("msg-1")
+	assert.Nil(t, err)
+	assert.Equal(t, "", state)
+
+	state, err = r.markMessageHandling("msg-1")
+	assert.Nil(t, err)
+	assert.Equal(t, messageStateHandling, state)
+
+	assert.Nil(t, r.forgetMessage("msg-1"))
+
+	state, err = r.markMessageHandling("msg-1")
+	assert.Nil(t, err)
+	assert.Equal(t, "", state)
+
+	clock.advance(messageHandlingTTL)
+
+	state, err = r.markMessageHandling("msg-1")
+	assert.Nil(t, err)
+	assert.Equal(t, "", state)
+
+	assert.Nil(t, r.markMessageHandled("msg-1"))
+	clock.advance(messageHandlingTTL)
+
+	state, err = r.markMessageHandling("msg-1")
+	assert.Nil(t, err)
+	assert.Equal(t, messageStateHandled, state)
+
+	clock.advance(2 * time.Hour)
+
+	state, err = r.markMessageHandling("msg-1")
+	assert.Nil(t, err)
+	assert.Equal(t, "", state)
+
+	_, err = r.markMessageHandling("")
+	assert.Equal(t, errEmptyMessageID, err)
+	assert.Equal(t, errEmptyMessageID, r.markMessageHandled(""))
+}
+
+func testRepoCycleRuns(t *testing.T, r repo, clock *testClock) {
+	run, err := r.fetchCycleRun("fafafaf-asg")
+	assert.Nil(t, err)
+	assert.Nil(t, run)
+
+	assert.Nil(t, r.storeCycleRun(&cycleRun{ASGName: "zzz-asg", State: cycleStateDone}))
+	assert.Nil(t, r.storeCycleRun(&cycleRun{ASGName: "fafafaf-asg", State: cycleStateDraining, Queue: []string{"i-fafafaf"}}))
+	assert.Equal(t, errEmptyASGName, r.storeCycleRun(&cycleRun{}))
+
+	run, err = r.fetchCycleRun("fafafaf-asg")
+	assert.Nil(t, err)
+	assert.Equal(t, cycleStateDraining, run.State)
+	assert.Equal(t, []string{"i-fafafaf"}, run.Queue)
+
+	runs, err := r.fetchCycleRuns()
+	assert.Nil(t, err)
+	assert.Len(t, runs, 2)
+	assert.Equal(t, "fafafaf-asg", runs[0].ASGName)
+	assert.Equal(t, "zzz-asg", runs[1].ASGName)
+}
+
+func testRepoCycleRunLocks(t *testing.T, r repo, clock *testClock) {
+	locked, err := r.lockCycleRun("fafafaf-asg", "owner-a", time.Minute)
+	assert.Nil(t, err)
+	assert.True(t, locked)
+
+	locked, err = r.lockCycleRun("fafafaf-asg", "owner-b", time.Minute)
+	assert.Nil(t, err)
+	assert.False(t, locked)
+
+	locked, err = r.lockCycleRun("bababab-asg", "owner-b", time.Minute)
+	assert.Nil(t, err)
+	assert.True(t, locked)
+
+	assert.Nil(t, r.unlockCycleRun("fafafaf-asg", "owner-b"))
+	locked, err = r.lockCycleRun("fafafaf-asg", "owner-b", time.Minute)
+	assert.Nil(t, err)
+	assert.False(t, locked)
+
+	assert.Nil(t, r.unlockCycleRun("fafafaf-asg", "owner-a"))
+	locked, err = r.lockCycleRun("fafafaf-asg", "owner-b", time.Minute)
+	assert.Nil(t, err)
+	assert.True(t, locked)
+
+	clock.advance(2 * time.Minute)
+
+	locked, err = r.lockCycleRun("fafafaf-asg", "owner-a", time.Minute)
+	assert.Nil(t, err)
+	assert.True(t, locked)
+
+	_, err = r.lockCycleRun("", "owner-a", time.Minute)
+	assert.Equal(t, errEmptyASGName, err)
+	assert.Equal(t, errEmptyASGName, r.unlockCycleRun("", "owner-a"))
+}
+
+func testRepoConcurrent(t *testing.T, r repo, clock *testClock) {
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			instanceID := fmt.Sprintf("i-%08d", i)
+			for j := 0; j < 20; j++ {
+				assert.Nil(t, r.setInstanceState(instanceID, "up"))
+				assert.Nil(t, r.storeInstanceEvent(instanceID, fmt.Sprintf("event-%d", j)))
+				_, err := r.fetchAllInstanceEvents()
+				assert.Nil(t, err)
+				_, err = r.markMessageHandling(fmt.Sprintf("%s-%d", instanceID, j))
+				assert.Nil(t, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	all, err := r.fetchAllInstanceEvents()
+	assert.Nil(t, err)
+	assert.Len(t, all, 10)
+	assert.Len(t, all["i-00000000"], 20)
+}
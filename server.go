@@ -1,9 +1,11 @@
 package cyclist
 
 import (
+	"context"
 	"crypto/subtle"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"net/http"
 	"strings"
@@ -33,7 +35,17 @@ type server struct {
 	tokGen tokenGenerator
 	router *mux.Router
 
-	snsVerify bool
+	snsVerify   bool
+	snsVerifier *snsVerifier
+	allowlist   *lifecycleAllowlist
+	heartbeater *lifecycleHeartbeater
+
+	drainDeadlines *drainDeadlines
+	launchReaper   *launchTimeoutReaper
+	drainReaper    *drainTimeoutReaper
+	protector      *instanceProtector
+	cycler         *cycler
+	reconciler     *reconciler
 }
 
 func (srv *server) ohai(w http.ResponseWriter, req *http.Request) {
@@ -44,7 +56,9 @@ func (srv *server) meta(w http.ResponseWriter, req *http.Request) {
 	jsonRespond(w, http.StatusOK, cyclistMetadata)
 }
 
-func (srv *server) Serve() error {
+// Serve serves until it fails or ctx is done, when it stops accepting
+// connections and waits for those in flight before returning
+func (srv *server) Serve(ctx context.Context) error {
 	if srv.authTokens == nil {
 		srv.authTokens = []string{}
 	}
@@ -53,13 +67,49 @@ func (srv *server) Serve() error {
 		srv.setupRouter()
 	}
 
+	if srv.launchReaper != nil {
+		go srv.launchReaper.Run(ctx)
+	}
+
+	if srv.drainReaper != nil {
+		go srv.drainReaper.Run(ctx)
+	}
+
+	if srv.protector != nil {
+		go srv.protector.Run(ctx)
+	}
+
+	if srv.cycler != nil {
+		srv.cycler.resume(ctx)
+	}
+
+	if srv.reconciler != nil {
+		go srv.reconciler.Run(ctx)
+	}
+
+	httpSrv := &http.Server{
+		Addr: srv.port,
+		Handler: negroni.New(
+			negroni.NewRecovery(),
+			negronilogrus.NewMiddleware(),
+			negroni.Wrap(srv.router),
+		),
+	}
+
+	go func() {
+		<-ctx.Done()
+		err := httpSrv.Shutdown(context.Background())
+		if err != nil {
+			srv.log.WithField("err", err).Warn("failed to shut down cleanly")
+		}
+	}()
+
 	srv.log.WithField("port", srv.port).Info("serving")
 
-	err := http.ListenAndServe(srv.port, negroni.New(
-		negroni.NewRecovery(),
-		negronilogrus.NewMiddleware(),
-		negroni.Wrap(srv.router),
-	))
+	err := httpSrv.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
 
 	if err != nil {
 		srv.log.WithField("err", err).Error("failed to serve")
@@ -70,22 +120,30 @@ func (srv *server) Serve() error {
 func (srv *server) setupRouter() {
 	srv.router = mux.NewRouter()
 	srv.router.HandleFunc(`/sns`,
-		newSNSHandlerFunc(srv.db, srv.log, srv.snsSvc, srv.snsVerify, srv.tokGen, srv.asSvc)).Methods("POST")
+		newSNSHandlerFunc(srv.db, srv.log, srv.snsSvc, srv.snsVerify, srv.snsVerifier, srv.allowlist, srv.tokGen, srv.asSvc)).Methods("POST")
 
 	srv.router.Handle(`/tokens/{instance_id}`,
 		srv.authd(newTokensHandlerFunc(srv.db, srv.log))).Methods("GET")
 
 	srv.router.Handle(`/heartbeats/{instance_id}`,
-		srv.instAuthd(newHeartbeatHandlerFunc(srv.db, srv.log))).Methods("GET")
+		srv.instAuthd(newHeartbeatHandlerFunc(srv.db, srv.log, srv.asSvc, srv.heartbeater))).Methods("GET")
 
-	srv.router.Handle(`/launches/{instance_id}`,
-		srv.instAuthd(newLifecycleHandlerFunc("launch", srv.db, srv.log, srv.asSvc))).Methods("POST")
+	for _, lt := range lifecycleTransitions.all() {
+		srv.router.Handle(fmt.Sprintf("/%s/{instance_id}", lt.Route),
+			srv.instAuthd(newLifecycleHandlerFunc(lt, srv.db, srv.log, srv.asSvc))).Methods("POST")
+	}
 
-	srv.router.Handle(`/terminations/{instance_id}`,
-		srv.instAuthd(newLifecycleHandlerFunc("termination", srv.db, srv.log, srv.asSvc))).Methods("POST")
+	srv.router.Handle(`/abandonments/{instance_id}`,
+		srv.instAuthd(newAbandonmentsHandlerFunc(srv.db, srv.log, srv.asSvc))).Methods("POST")
 
 	srv.router.Handle(`/implosions/{instance_id}`,
-		srv.instAuthd(newImplosionsHandlerFunc(srv.db, srv.log))).Methods("POST")
+		srv.instAuthd(newImplosionsHandlerFunc(srv.db, srv.log, srv.asSvc))).Methods("POST")
+
+	srv.router.Handle(`/protections/{instance_id}`,
+		srv.instAuthd(newProtectionsHandlerFunc(srv.db, srv.log, srv.protector))).Methods("POST")
+
+	srv.router.Handle(`/protections/{instance_id}`,
+		srv.instAuthd(newProtectionHandlerFunc(srv.db, srv.log))).Methods("GET")
 
 	srv.router.Handle(`/events/{instance_id}`,
 		srv.instAuthd(newLifecycleEventsHandlerFunc(srv.db, srv.log))).Methods("GET")
@@ -93,6 +151,26 @@ func (srv *server) setupRouter() {
 	srv.router.Handle(`/events`,
 		srv.authd(newAllLifecycleEventsHandlerFunc(srv.db, srv.log))).Methods("GET")
 
+	srv.router.Handle(`/drains`,
+		srv.authd(newDrainsHandlerFunc(srv.db, srv.log, srv.drainDeadlines))).Methods("GET")
+
+	if srv.cycler != nil {
+		srv.router.Handle(`/cycles`,
+			srv.authd(newCyclesHandlerFunc(srv.log, srv.cycler))).Methods("POST")
+	}
+
+	srv.router.Handle(`/adoptions`,
+		srv.authd(newAdoptionsHandlerFunc(srv.db, srv.log, srv.asSvc, srv.tokGen))).Methods("POST")
+
+	srv.router.Handle(`/cycles/{asg_name}`,
+		srv.authd(newCycleHandlerFunc(srv.db, srv.log))).Methods("GET")
+
+	srv.router.Handle(`/sns/subscriptions`,
+		srv.authd(newSNSSubscriptionsHandlerFunc(srv.db, srv.log))).Methods("GET")
+
+	srv.router.Handle(`/__vars__`,
+		srv.authd(expvar.Handler().ServeHTTP)).Methods("GET")
+
 	srv.router.HandleFunc(`/`, srv.ohai).Methods("GET", "HEAD")
 	srv.router.HandleFunc(`/__meta__`, srv.meta).Methods("GET", "HEAD")
 }
@@ -171,10 +249,14 @@ func jsonRespond(w http.ResponseWriter, status int, data interface{}) {
 }
 
 type jsonErr struct {
-	Err error
+	Err  error
+	Code string
 }
 
 func (je *jsonErr) MarshalJSON() ([]byte, error) {
+	if je.Code != "" {
+		return []byte(fmt.Sprintf(`{"error":%q,"code":%q}`, je.Err.Error(), je.Code)), nil
+	}
 	return []byte(fmt.Sprintf(`{"error":%q}`, je.Err.Error())), nil
 }
 
@@ -8,7 +8,11 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -56,6 +60,165 @@ func TestServer_POST_sns_Confirmation(t *testing.T) {
 	assert.Equal(t, "handled 'SubscriptionConfirmation' message", body["message"])
 }
 
+func TestServer_POST_sns_UnsubscribeConfirmation(t *testing.T) {
+	srv := newTestServer()
+	ts := httptest.NewServer(srv.router)
+	defer ts.Close()
+
+	msg := &snsMessage{
+		Type:     "UnsubscribeConfirmation",
+		Token:    "TOKEYTOKETOK",
+		TopicARN: "arn:faf:af/af",
+	}
+	msgBuf := &bytes.Buffer{}
+	err := json.NewEncoder(msgBuf).Encode(msg)
+	assert.Nil(t, err)
+
+	res, err := http.Post(fmt.Sprintf("%s/sns", ts.URL),
+		"application/json", msgBuf)
+	assert.Nil(t, err)
+
+	body := map[string]interface{}{}
+	err = json.NewDecoder(res.Body).Decode(&body)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "handled 'UnsubscribeConfirmation' message", body["message"])
+	assert.Equal(t, "unsubscribed", srv.db.(*testRepo).sub["arn:faf:af/af"].State)
+}
+
+func TestServer_GET_snsSubscriptions(t *testing.T) {
+	srv := newTestServer()
+	ts := httptest.NewServer(srv.router)
+	defer ts.Close()
+
+	_ = srv.db.storeSNSSubscriptionState("arn:faf:af/af", "confirmed")
+	_ = srv.db.storeSNSSubscriptionState("arn:faf:af/bb", "unsubscribed")
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/sns/subscriptions", ts.URL), nil)
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "token mysteriously")
+
+	res, err := (&http.Client{}).Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+
+	body := &jsonSNSSubscriptions{}
+	err = json.NewDecoder(res.Body).Decode(body)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, body.Total)
+	assert.Equal(t, 1, body.Confirmed)
+	assert.Len(t, body.Subscriptions, 2)
+}
+
+func TestServer_POST_sns_Confirmation_DisallowedTopic(t *testing.T) {
+	srv := newTestServer()
+	srv.allowlist, _ = newLifecycleAllowlist([]string{"arn:faf:af/ok"}, nil, nil)
+	srv.setupRouter()
+	ts := httptest.NewServer(srv.router)
+	defer ts.Close()
+
+	msg := &snsMessage{
+		Type:     "SubscriptionConfirmation",
+		Token:    "TOKEYTOKETOK",
+		TopicARN: "arn:faf:af/af",
+	}
+	msgBuf := &bytes.Buffer{}
+	err := json.NewEncoder(msgBuf).Encode(msg)
+	assert.Nil(t, err)
+
+	res, err := http.Post(fmt.Sprintf("%s/sns", ts.URL),
+		"application/json", msgBuf)
+	assert.Nil(t, err)
+
+	body := map[string]interface{}{}
+	err = json.NewDecoder(res.Body).Decode(&body)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 403, res.StatusCode)
+	assert.Regexp(t, "topic .+ is not allowed", body["error"])
+	assert.Len(t, srv.db.(*testRepo).sub, 0)
+}
+
+func TestServer_POST_sns_Notification_Stale(t *testing.T) {
+	tss := newTestSNSSigner(t)
+
+	srv := newTestServer()
+	srv.snsVerify = true
+	srv.snsVerifier = newSNSVerifier(&testSNSCertFetcher{cert: tss.cert}, time.Hour, 1, time.Hour)
+	srv.setupRouter()
+	ts := httptest.NewServer(srv.router)
+	defer ts.Close()
+
+	msg := &snsMessage{
+		Type:             "Notification",
+		Message:          `{"Event": "autoscaling:TEST_NOTIFICATION"}`,
+		MessageID:        "c0ffee",
+		Timestamp:        "2018-01-09T19:40:50.123Z",
+		TopicARN:         "arn:aws:sns:nz-isengard-1:999999999999:toaster-pastries",
+		SignatureVersion: "2",
+		SigningCertURL:   testSNSCertURL,
+	}
+	tss.sign(t, msg)
+
+	msgBuf := &bytes.Buffer{}
+	err := json.NewEncoder(msgBuf).Encode(msg)
+	assert.Nil(t, err)
+
+	res, err := http.Post(fmt.Sprintf("%s/sns", ts.URL),
+		"application/json", msgBuf)
+	assert.Nil(t, err)
+
+	body := map[string]interface{}{}
+	err = json.NewDecoder(res.Body).Decode(&body)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 400, res.StatusCode)
+	assert.Equal(t, errSNSMessageStale.Error(), body["error"])
+}
+
+func TestServer_POST_sns_Notification_DisallowedAccount(t *testing.T) {
+	srv := newTestServer()
+	srv.allowlist, _ = newLifecycleAllowlist(nil, []string{"999999999999"}, nil)
+	srv.setupRouter()
+	ts := httptest.NewServer(srv.router)
+	defer ts.Close()
+
+	msgMsg := &lifecycleAction{
+		AccountID:            "666666666666",
+		LifecycleTransition:  "autoscaling:EC2_INSTANCE_TERMINATING",
+		EC2InstanceID:        "i-fafafaf",
+		LifecycleActionToken: "TOKEYTOKETOK",
+		AutoScalingGroupName: "whimsical-mime-headphone",
+		LifecycleHookName:    "greased-banana-net",
+	}
+	msgMsgBuf := &bytes.Buffer{}
+	err := json.NewEncoder(msgMsgBuf).Encode(msgMsg)
+	assert.Nil(t, err)
+
+	msg := &snsMessage{
+		Type:    "Notification",
+		Message: msgMsgBuf.String(),
+	}
+
+	msgBuf := &bytes.Buffer{}
+	err = json.NewEncoder(msgBuf).Encode(msg)
+	assert.Nil(t, err)
+
+	res, err := http.Post(fmt.Sprintf("%s/sns", ts.URL),
+		"application/json", msgBuf)
+	assert.Nil(t, err)
+
+	body := map[string]interface{}{}
+	err = json.NewDecoder(res.Body).Decode(&body)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 403, res.StatusCode)
+	assert.Regexp(t, "account .+ is not allowed", body["error"])
+	assert.Len(t, srv.db.(*testRepo).s, 0)
+	assert.Len(t, srv.db.(*testRepo).la, 0)
+}
+
 func TestServer_POST_sns_Notification_UnknownLifecycleTransition(t *testing.T) {
 	srv := newTestServer()
 	ts := httptest.NewServer(srv.router)
@@ -247,6 +410,312 @@ func TestServer_POST_launches(t *testing.T) {
 	assert.Equal(t, "instance launch complete", body["message"])
 }
 
+func TestServer_POST_launches_Expired(t *testing.T) {
+	srv := newTestServer()
+	srv.asSvc = newTestAutoScalingService(func(r *request.Request) {
+		r.Error = awserr.NewRequestFailure(awserr.New("ValidationError",
+			"No active Lifecycle Action found with token TOKEYTOKETOK", nil), 400, "req-1")
+	})
+	srv.setupRouter()
+	token := "surprisingly-guessable"
+	_ = srv.db.storeInstanceToken("i-fafafaf", token)
+	ts := httptest.NewServer(srv.router)
+	defer ts.Close()
+
+	err := srv.db.storeInstanceLifecycleAction(&lifecycleAction{
+		LifecycleTransition:  "launching",
+		EC2InstanceID:        "i-fafafaf",
+		LifecycleActionToken: "TOKEYTOKETOK",
+		AutoScalingGroupName: "whimsical-mime-headphone",
+		LifecycleHookName:    "greased-banana-net",
+	})
+	assert.Nil(t, err)
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/launches/i-fafafaf", ts.URL), &bytes.Buffer{})
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", fmt.Sprintf("token %s", token))
+
+	res, err := (&http.Client{}).Do(req)
+	assert.Nil(t, err)
+	assert.NotNil(t, res)
+
+	bodyBytes, err := ioutil.ReadAll(res.Body)
+	assert.Nil(t, err)
+	body := map[string]interface{}{}
+	err = json.Unmarshal(bodyBytes, &body)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 410, res.StatusCode)
+	assert.Equal(t, "lifecycle_action_expired", body["code"])
+	assert.Contains(t, body, "error")
+}
+
+func TestServer_POST_launches_IntoWarmPool(t *testing.T) {
+	srv := newTestServer()
+	token := "surprisingly-guessable"
+	_ = srv.db.storeInstanceToken("i-fafafaf", token)
+	_ = srv.db.setInstanceState("i-fafafaf", "down")
+	ts := httptest.NewServer(srv.router)
+	defer ts.Close()
+
+	err := srv.db.storeInstanceLifecycleAction(&lifecycleAction{
+		LifecycleTransition:  "launching",
+		EC2InstanceID:        "i-fafafaf",
+		LifecycleActionToken: "TOKEYTOKETOK",
+		AutoScalingGroupName: "whimsical-mime-headphone",
+		LifecycleHookName:    "greased-banana-net",
+		Origin:               "EC2",
+		Destination:          "WarmPool",
+	})
+	assert.Nil(t, err)
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/launches/i-fafafaf", ts.URL), &bytes.Buffer{})
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", fmt.Sprintf("token %s", token))
+
+	res, err := (&http.Client{}).Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+
+	le, _ := srv.db.fetchInstanceEvent("i-fafafaf", "warmed")
+	assert.NotNil(t, le)
+
+	req, err = http.NewRequest("GET", fmt.Sprintf("%s/heartbeats/i-fafafaf", ts.URL), nil)
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", fmt.Sprintf("token %s", token))
+
+	res, err = (&http.Client{}).Do(req)
+	assert.Nil(t, err)
+
+	body := map[string]interface{}{}
+	err = json.NewDecoder(res.Body).Decode(&body)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "down", body["state"])
+}
+
+func TestServer_POST_terminations_MultipleHooks(t *testing.T) {
+	srv := newTestServer()
+	completed := []string{}
+	srv.asSvc = newTestAutoScalingService(func(r *request.Request) {
+		if v, ok := r.Params.(*autoscaling.CompleteLifecycleActionInput); ok {
+			completed = append(completed, *v.LifecycleHookName)
+		}
+	})
+	srv.setupRouter()
+	token := "surprisingly-guessable"
+	_ = srv.db.storeInstanceToken("i-fafafaf", token)
+	_ = srv.db.setInstanceState("i-fafafaf", "down")
+	ts := httptest.NewServer(srv.router)
+	defer ts.Close()
+
+	for _, hookName := range []string{"greased-banana-net", "buttered-pickle-sieve", "oiled-melon-sling"} {
+		err := srv.db.storeInstanceLifecycleAction(&lifecycleAction{
+			LifecycleTransition:  "terminating",
+			EC2InstanceID:        "i-fafafaf",
+			LifecycleActionToken: "TOKEYTOKETOK",
+			AutoScalingGroupName: "whimsical-mime-headphone",
+			LifecycleHookName:    hookName,
+		})
+		assert.Nil(t, err)
+	}
+
+	post := func(query string) int {
+		req, err := http.NewRequest("POST", fmt.Sprintf("%s/terminations/i-fafafaf%s", ts.URL, query), &bytes.Buffer{})
+		assert.Nil(t, err)
+		req.Header.Set("Authorization", fmt.Sprintf("token %s", token))
+
+		res, err := (&http.Client{}).Do(req)
+		assert.Nil(t, err)
+		return res.StatusCode
+	}
+
+	assert.Equal(t, 200, post("?hook_name=oiled-melon-sling"))
+	assert.Equal(t, []string{"oiled-melon-sling"}, completed)
+
+	state, _ := srv.db.fetchInstanceState("i-fafafaf")
+	assert.Equal(t, "down", state)
+
+	assert.Equal(t, 400, post("?hook_name=oiled-melon-sling"))
+
+	assert.Equal(t, 200, post(""))
+	assert.Equal(t, []string{"oiled-melon-sling", "buttered-pickle-sieve", "greased-banana-net"}, completed)
+
+	state, _ = srv.db.fetchInstanceState("i-fafafaf")
+	assert.Equal(t, "", state)
+
+	le, _ := srv.db.fetchInstanceEvent("i-fafafaf", "terminating")
+	assert.NotNil(t, le)
+}
+
+func TestServer_POST_abandonments(t *testing.T) {
+	srv := newTestServer()
+	srv.asSvc = newTestAutoScalingService(func(r *request.Request) {
+		v, ok := r.Params.(*autoscaling.CompleteLifecycleActionInput)
+		assert.True(t, ok)
+		if ok {
+			assert.Equal(t, "ABANDON", *v.LifecycleActionResult)
+			assert.Equal(t, "TOKEYTOKETOK", *v.LifecycleActionToken)
+		}
+	})
+	srv.setupRouter()
+	token := "surprisingly-guessable"
+	_ = srv.db.storeInstanceToken("i-fafafaf", token)
+	_ = srv.db.setInstanceState("i-fafafaf", "up")
+	ts := httptest.NewServer(srv.router)
+	defer ts.Close()
+
+	err := srv.db.storeInstanceLifecycleAction(&lifecycleAction{
+		LifecycleTransition:  "launching",
+		EC2InstanceID:        "i-fafafaf",
+		LifecycleActionToken: "TOKEYTOKETOK",
+		AutoScalingGroupName: "whimsical-mime-headphone",
+		LifecycleHookName:    "greased-banana-net",
+	})
+	assert.Nil(t, err)
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/abandonments/i-fafafaf", ts.URL),
+		bytes.NewBufferString(`{"reason": "Docker pull timed out!"}`))
+	assert.Nil(t, err)
+	assert.NotNil(t, req)
+	req.Header.Set("Authorization", fmt.Sprintf("token %s", token))
+
+	res, err := (&http.Client{}).Do(req)
+	assert.Nil(t, err)
+	assert.NotNil(t, res)
+
+	body := map[string]interface{}{}
+	err = json.NewDecoder(res.Body).Decode(&body)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "instance launch abandoned", body["message"])
+
+	state, _ := srv.db.fetchInstanceState("i-fafafaf")
+	assert.Equal(t, "down", state)
+
+	le, _ := srv.db.fetchInstanceEvent("i-fafafaf", "abandoned:docker_pull_timed_out")
+	assert.NotNil(t, le)
+
+	res, err = (&http.Client{}).Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, 409, res.StatusCode)
+}
+
+func TestServer_POST_implosions(t *testing.T) {
+	srv := newTestServer()
+	operations := []string{}
+	srv.asSvc = newTestAutoScalingService(func(r *request.Request) {
+		operations = append(operations, r.Operation.Name)
+	})
+	srv.setupRouter()
+	token := "surprisingly-guessable"
+	_ = srv.db.storeInstanceToken("i-fafafaf", token)
+	ts := httptest.NewServer(srv.router)
+	defer ts.Close()
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/implosions/i-fafafaf", ts.URL),
+		bytes.NewBufferString(`{"action":"replace"}`))
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", fmt.Sprintf("token %s", token))
+
+	res, err := (&http.Client{}).Do(req)
+	assert.Nil(t, err)
+	assert.NotNil(t, res)
+
+	bodyBytes, err := ioutil.ReadAll(res.Body)
+	assert.Nil(t, err)
+	body := map[string]interface{}{}
+	err = json.Unmarshal(bodyBytes, &body)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "instance implosion recorded", body["message"])
+	assert.Equal(t, []string{"SetInstanceHealth"}, operations)
+}
+
+func TestServer_POST_protections(t *testing.T) {
+	srv := newTestServer()
+	srv.protector = newInstanceProtector(shushLog, srv.asSvc, time.Second)
+	srv.setupRouter()
+	token := "surprisingly-guessable"
+	_ = srv.db.storeInstanceToken("i-fafafaf", token)
+	ts := httptest.NewServer(srv.router)
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		body   string
+		status int
+	}{
+		{body: `{"state":"busy"}`, status: 202},
+		{body: `{"state":"sleepy"}`, status: 400},
+	} {
+		req, err := http.NewRequest("POST", fmt.Sprintf("%s/protections/i-fafafaf", ts.URL),
+			bytes.NewBufferString(tc.body))
+		assert.Nil(t, err)
+		req.Header.Set("Authorization", fmt.Sprintf("token %s", token))
+
+		res, err := (&http.Client{}).Do(req)
+		assert.Nil(t, err)
+		assert.NotNil(t, res)
+		assert.Equal(t, tc.status, res.StatusCode)
+	}
+
+	assert.Equal(t, map[string]bool{"i-fafafaf": true}, srv.protector.pending)
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/protections/i-fafafaf", ts.URL), nil)
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", fmt.Sprintf("token %s", token))
+
+	res, err := (&http.Client{}).Do(req)
+	assert.Nil(t, err)
+	assert.NotNil(t, res)
+
+	bodyBytes, err := ioutil.ReadAll(res.Body)
+	assert.Nil(t, err)
+	body := map[string]interface{}{}
+	err = json.Unmarshal(bodyBytes, &body)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "busy", body["state"])
+	assert.Equal(t, true, body["protected"])
+}
+
+func TestServer_POST_adoptions(t *testing.T) {
+	srv := newTestServer()
+	tca := &testCycleASG{
+		desired:   1,
+		instances: map[string]string{"i-fafafaf": autoscaling.LifecycleStateInService},
+	}
+	srv.asSvc = newTestAutoScalingService(tca.handle)
+	srv.setupRouter()
+	ts := httptest.NewServer(srv.router)
+	defer ts.Close()
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/adoptions", ts.URL),
+		bytes.NewBufferString(`{"asg":"cat-theatre-napkin-hose"}`))
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "token mysteriously")
+
+	res, err := (&http.Client{}).Do(req)
+	assert.Nil(t, err)
+	assert.NotNil(t, res)
+
+	body := map[string]interface{}{}
+	err = json.NewDecoder(res.Body).Decode(&body)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, []interface{}{"i-fafafaf"}, body["instances"])
+	assert.Equal(t, float64(1), body["@total"])
+
+	state, err := srv.db.fetchInstanceState("i-fafafaf")
+	assert.Nil(t, err)
+	assert.Equal(t, "up", state)
+}
+
 func TestServer_POST_launches_WithoutAuthorizationHeader(t *testing.T) {
 	srv := newTestServer()
 	ts := httptest.NewServer(srv.router)
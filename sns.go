@@ -2,8 +2,10 @@ package cyclist
 
 import (
 	"encoding/json"
+	"expvar"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
@@ -13,7 +15,11 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func newSNSHandlerFunc(db repo, log logrus.FieldLogger, snsSvc snsiface.SNSAPI, snsVerify bool, tokGen tokenGenerator, asSvc autoscalingiface.AutoScalingAPI) http.HandlerFunc {
+var (
+	messageReplays = expvar.NewInt("cyclist_message_replays")
+)
+
+func newSNSHandlerFunc(db repo, log logrus.FieldLogger, snsSvc snsiface.SNSAPI, snsVerify bool, snsVerifier *snsVerifier, allowlist *lifecycleAllowlist, tokGen tokenGenerator, asSvc autoscalingiface.AutoScalingAPI) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log = log.WithFields(logrus.Fields{
 			"path":   r.URL.Path,
@@ -30,23 +36,42 @@ func newSNSHandlerFunc(db repo, log logrus.FieldLogger, snsSvc snsiface.SNSAPI,
 		}
 
 		if snsVerify {
-			err = msg.verify()
+			err = snsVerifier.verify(msg)
 			if err != nil {
 				log.WithField("err", err).Error("failed to verify sns message")
 				jsonRespond(w, http.StatusBadRequest, &jsonErr{
 					Err: errors.Wrap(err, "failed to verify sns message"),
 				})
+				return
+			}
+
+			age, err := snsVerifier.checkAge(msg)
+			if err != nil {
+				log.WithFields(logrus.Fields{
+					"err":         err,
+					"message_age": age.String(),
+				}).Error("rejected stale sns message")
+				jsonRespond(w, http.StatusBadRequest, &jsonErr{Err: err})
+				return
 			}
 		}
 
-		err = nil
+		err = allowlist.allowTopic(msg.TopicARN)
+		if err != nil {
+			log.WithField("err", err).Warn("rejected sns message")
+			jsonRespond(w, http.StatusForbidden, &jsonErr{Err: err})
+			return
+		}
+
 		status := http.StatusBadRequest
 
 		switch msg.Type {
 		case "SubscriptionConfirmation":
-			status, err = handleSNSSubscriptionConfirmation(snsSvc, msg)
+			status, err = handleSNSSubscriptionConfirmation(db, log, snsSvc, msg)
+		case "UnsubscribeConfirmation":
+			status, err = handleSNSUnsubscribeConfirmation(db, log, msg)
 		case "Notification":
-			status, err = handleSNSNotification(db, log, tokGen, msg, asSvc)
+			status, err = handleSNSNotification(db, log, tokGen, allowlist, msg, asSvc)
 		default:
 			log.WithField("type", msg.Type).Warn("unknown sns message type")
 			jsonRespond(w, http.StatusBadRequest, map[string]interface{}{
@@ -70,7 +95,7 @@ func newSNSHandlerFunc(db repo, log logrus.FieldLogger, snsSvc snsiface.SNSAPI,
 	}
 }
 
-func handleSNSSubscriptionConfirmation(snsSvc snsiface.SNSAPI, msg *snsMessage) (int, error) {
+func handleSNSSubscriptionConfirmation(db repo, log logrus.FieldLogger, snsSvc snsiface.SNSAPI, msg *snsMessage) (int, error) {
 	params := &sns.ConfirmSubscriptionInput{
 		Token:    aws.String(msg.Token),
 		TopicArn: aws.String(msg.TopicARN),
@@ -79,10 +104,29 @@ func handleSNSSubscriptionConfirmation(snsSvc snsiface.SNSAPI, msg *snsMessage)
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
+
+	log.WithField("topic_arn", msg.TopicARN).Info("confirmed sns subscription")
+	err = db.storeSNSSubscriptionState(msg.TopicARN, "confirmed")
+	if err != nil {
+		log.WithField("err", err).Warn("failed to store sns subscription state")
+	}
+	return http.StatusOK, nil
+}
+
+func handleSNSUnsubscribeConfirmation(db repo, log logrus.FieldLogger, msg *snsMessage) (int, error) {
+	log.WithFields(logrus.Fields{
+		"topic_arn":     msg.TopicARN,
+		"subscribe_url": msg.SubscribeURL,
+	}).Error("sns subscription removed, lifecycle notifications from this topic will no longer be received")
+
+	err := db.storeSNSSubscriptionState(msg.TopicARN, "unsubscribed")
+	if err != nil {
+		return http.StatusInternalServerError, errors.Wrap(err, "failed to store sns subscription state")
+	}
 	return http.StatusOK, nil
 }
 
-func handleSNSNotification(db repo, log logrus.FieldLogger, tokGen tokenGenerator, msg *snsMessage, asSvc autoscalingiface.AutoScalingAPI) (int, error) {
+func handleSNSNotification(db repo, log logrus.FieldLogger, tokGen tokenGenerator, allowlist *lifecycleAllowlist, msg *snsMessage, asSvc autoscalingiface.AutoScalingAPI) (int, error) {
 	la, err := msg.lifecycleAction()
 	if err != nil {
 		return http.StatusBadRequest, errors.Wrap(err, "invalid json received in sns Message")
@@ -92,37 +136,147 @@ func handleSNSNotification(db repo, log logrus.FieldLogger, tokGen tokenGenerato
 		return http.StatusBadRequest, errors.New("no lifecycle action present in sns Message")
 	}
 
+	return handleAutoScalingLifecycleActionOnce(db, log, tokGen, allowlist, msg.MessageID, la, asSvc)
+}
+
+// handleAutoScalingLifecycleActionOnce skips lifecycle actions delivered in a
+// message that has already been handled, as both SNS and SQS may deliver the
+// same message more than once, and asks for copies delivered while it is still
+// being handled to be redelivered, in case handling it fails.
+func handleAutoScalingLifecycleActionOnce(db repo, log logrus.FieldLogger, tokGen tokenGenerator, allowlist *lifecycleAllowlist, messageID string, la *lifecycleAction, asSvc autoscalingiface.AutoScalingAPI) (int, error) {
+	if messageID == "" {
+		return handleAutoScalingLifecycleAction(db, log, tokGen, allowlist, la, asSvc)
+	}
+
+	log = log.WithField("message_id", messageID)
+
+	state, err := db.markMessageHandling(messageID)
+	if err != nil {
+		log.WithField("err", err).Warn("failed to mark message handling, handling anyway")
+	} else if state == messageStateHandling {
+		log.Warn("message is still being handled, asking for redelivery")
+		return http.StatusServiceUnavailable, fmt.Errorf("message '%s' is still being handled", messageID)
+	} else if state != "" {
+		messageReplays.Add(1)
+		log.WithField("replays", messageReplays.Value()).Warn("ignoring replayed message")
+		return http.StatusOK, nil
+	}
+
+	status, err := handleAutoScalingLifecycleAction(db, log, tokGen, allowlist, la, asSvc)
+	if err != nil {
+		forgetErr := db.forgetMessage(messageID)
+		if forgetErr != nil {
+			log.WithField("err", forgetErr).Warn("failed to forget unhandled message")
+		}
+		return status, err
+	}
+
+	err = db.markMessageHandled(messageID)
+	if err != nil {
+		log.WithField("err", err).Warn("failed to mark message handled")
+	}
+	return status, nil
+}
+
+func handleAutoScalingLifecycleAction(db repo, log logrus.FieldLogger, tokGen tokenGenerator, allowlist *lifecycleAllowlist, la *lifecycleAction, asSvc autoscalingiface.AutoScalingAPI) (int, error) {
+	err := allowlist.allowLifecycleAction(la)
+	if err != nil {
+		log.WithField("err", err).Warn("rejected lifecycle action")
+		return http.StatusForbidden, err
+	}
+
 	if la.Event == "autoscaling:TEST_NOTIFICATION" {
 		log.WithField("event", la.Event).Debug("ignoring")
 		return http.StatusAccepted, nil
 	}
 
-	err = nil
-
-	switch la.LifecycleTransition {
-	case "autoscaling:EC2_INSTANCE_LAUNCHING":
-		err = handleAutoScalingInstanceLaunching(db, log, la)
-		if err == nil {
-			log.WithField("action", la).Debug("storing temporary instance token")
-			err = db.storeTempInstanceToken(la.EC2InstanceID, tokGen.GenerateToken())
-		}
-	case "autoscaling:EC2_INSTANCE_TERMINATING":
-		err = handleAutoScalingInstanceTerminating(db, log, la, asSvc)
-	default:
+	h, ok := lifecycleTransitions.handler(la.Transition(), la.AutoScalingGroupName)
+	if !ok {
 		log.WithField("transition", la.LifecycleTransition).Warn("unknown lifecycle transition")
 		return http.StatusBadRequest, fmt.Errorf("unknown lifecycle transition %q", la.LifecycleTransition)
 	}
 
+	ok, err = checkLifecycleActionOrder(db, log, la)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if !ok {
+		return http.StatusAccepted, nil
+	}
+
+	err = h.OnNotification(db, log, tokGen, la, asSvc)
 	if err != nil {
 		return http.StatusBadRequest, err
 	}
+
+	ts, ok := la.Timestamp()
+	if !ok {
+		ts = time.Now().UTC()
+	}
+
+	err = db.storeInstanceLastTransition(la.EC2InstanceID, la.Transition(), ts)
+	if err != nil {
+		log.WithField("err", err).Warn("failed to store last instance transition")
+	}
 	return http.StatusOK, nil
 }
 
+// checkLifecycleActionOrder refuses lifecycle actions that would move an
+// instance back to an earlier lifecycle phase, or that are older than the last
+// transition applied to the instance in another phase, recording an event when
+// doing so.
+func checkLifecycleActionOrder(db repo, log logrus.FieldLogger, la *lifecycleAction) (bool, error) {
+	phase, ok := lifecycleTransitions.phase(la.Transition())
+	if !ok {
+		return true, nil
+	}
+
+	last, err := db.fetchInstanceLastTransition(la.EC2InstanceID)
+	if err != nil {
+		return false, err
+	}
+
+	if last == nil {
+		return true, nil
+	}
+
+	// several hooks on the same transition notify separately and in no
+	// particular order, so only actions from another phase are stale by time
+	lastPhase, _ := lifecycleTransitions.phase(last.Transition)
+	stale := phase < lastPhase && !la.fromWarmPool()
+	if ts, ok := la.Timestamp(); ok && phase != lastPhase && ts.Before(last.Time) {
+		stale = true
+	}
+
+	if !stale {
+		return true, nil
+	}
+
+	log.WithFields(logrus.Fields{
+		"transition":      la.Transition(),
+		"time":            la.Time,
+		"last_transition": last.Transition,
+		"last_time":       last.Time.Format(time.RFC3339Nano),
+	}).Warn("ignoring out of order lifecycle action")
+
+	return false, db.storeInstanceEvent(la.EC2InstanceID, fmt.Sprintf("stale_%s", la.Transition()))
+}
+
 func handleAutoScalingInstanceTerminating(db repo, log logrus.FieldLogger, la *lifecycleAction, asSvc autoscalingiface.AutoScalingAPI) error {
 	if le, _ := db.fetchInstanceEvent(la.EC2InstanceID, "implosion"); le != nil {
+		action := fetchImplosionAction(db, la.EC2InstanceID)
+		log = log.WithField("implosion_action", action)
 		log.Debug("instance already imploded")
-		return completeLifecycleAction(la, log, asSvc)
+		err := completeLifecycleAction(la, lifecycleActionResultContinue, log, asSvc)
+		if isLifecycleActionExpired(err) {
+			log.WithField("err", err).Warn("imploded instance lifecycle action expired")
+			return nil
+		}
+		if err != nil || action == "" {
+			return err
+		}
+		return handleTerminatingLifecycleTransition(db, la.EC2InstanceID)
 	}
 	log.WithField("action", la).Debug("setting expected_state to down")
 	err := db.setInstanceState(la.EC2InstanceID, "down")
@@ -143,6 +297,16 @@ func handleAutoScalingInstanceLaunching(db repo, log logrus.FieldLogger, la *lif
 	if err != nil {
 		return err
 	}
+
+	if la.toWarmPool() {
+		log.WithField("action", la).Debug("setting expected_state to down for warm pool")
+		err = db.setInstanceState(la.EC2InstanceID, "down")
+		if err != nil {
+			return err
+		}
+		return db.storeInstanceEvent(la.EC2InstanceID, "prewarming")
+	}
+
 	log.WithField("action", la).Debug("setting expected_state to up")
 	err = db.setInstanceState(la.EC2InstanceID, "up")
 	if err != nil {
@@ -0,0 +1,241 @@
+package cyclist
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	snsCertHostRegexp = regexp.MustCompile(`^sns\.([a-z0-9-]+)\.amazonaws\.com(\.cn)?$`)
+
+	errSNSCertURLScheme = errors.New("signing cert url is not https")
+	errSNSCertURLHost   = errors.New("signing cert url host is not an sns host")
+	errSNSCertURLPath   = errors.New("signing cert url path is not a pem file")
+	errSNSMessageStale  = errors.New("sns message is older than the maximum message age")
+)
+
+// snsCertFetcher fetches the certificate found at an SNS SigningCertURL
+type snsCertFetcher interface {
+	FetchCert(certURL string) (*x509.Certificate, error)
+}
+
+type httpSNSCertFetcher struct {
+	client *http.Client
+}
+
+func newHTTPSNSCertFetcher(caBundle string) (*httpSNSCertFetcher, error) {
+	if caBundle == "" {
+		return &httpSNSCertFetcher{client: &http.Client{Timeout: 10 * time.Second}}, nil
+	}
+
+	pemBytes, err := ioutil.ReadFile(caBundle)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read ca bundle")
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemBytes) {
+		return nil, fmt.Errorf("no certs found in ca bundle %q", caBundle)
+	}
+
+	return &httpSNSCertFetcher{
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		},
+	}, nil
+}
+
+func (hscf *httpSNSCertFetcher) FetchCert(certURL string) (*x509.Certificate, error) {
+	res, err := hscf.client.Get(certURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to fetch signing cert")
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch signing cert: status %d", res.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read signing cert body")
+	}
+
+	return parseSNSCert(body)
+}
+
+// dirSNSCertFetcher looks up signing certs by file name in a local directory,
+// for environments that can't reach the SNS cert hosts.
+type dirSNSCertFetcher struct {
+	dir string
+}
+
+func (dscf *dirSNSCertFetcher) FetchCert(certURL string) (*x509.Certificate, error) {
+	u, err := url.Parse(certURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid signing cert url")
+	}
+
+	body, err := ioutil.ReadFile(filepath.Join(dscf.dir, path.Base(u.Path)))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read signing cert")
+	}
+
+	return parseSNSCert(body)
+}
+
+func parseSNSCert(body []byte) (*x509.Certificate, error) {
+	p, _ := pem.Decode(body)
+	if p == nil {
+		return nil, errEmptyPEM
+	}
+
+	cert, err := x509.ParseCertificate(p.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse signing cert")
+	}
+
+	return cert, nil
+}
+
+type snsCachedCert struct {
+	cert    *x509.Certificate
+	expires time.Time
+}
+
+// snsVerifier checks the signatures of SNS messages, validating and caching
+// the signing certs along the way.
+type snsVerifier struct {
+	fetcher       snsCertFetcher
+	certCacheTTL  time.Duration
+	minSigVersion int
+	maxMessageAge time.Duration
+
+	certsMutex sync.Mutex
+	certs      map[string]*snsCachedCert
+}
+
+func newSNSVerifier(fetcher snsCertFetcher, certCacheTTL time.Duration, minSigVersion int, maxMessageAge time.Duration) *snsVerifier {
+	return &snsVerifier{
+		fetcher:       fetcher,
+		certCacheTTL:  certCacheTTL,
+		minSigVersion: minSigVersion,
+		maxMessageAge: maxMessageAge,
+
+		certs: map[string]*snsCachedCert{},
+	}
+}
+
+func (sv *snsVerifier) verify(m *snsMessage) error {
+	err := validateSNSCertURL(m.SigningCertURL, m.TopicARN)
+	if err != nil {
+		return err
+	}
+
+	cert, err := sv.cert(m.SigningCertURL)
+	if err != nil {
+		return err
+	}
+
+	return m.verify(cert, sv.minSigVersion)
+}
+
+// checkAge rejects messages with a signed Timestamp older than the maximum
+// message age so that captured messages can't be replayed indefinitely.  The
+// age is returned for logging.
+func (sv *snsVerifier) checkAge(m *snsMessage) (time.Duration, error) {
+	if sv.maxMessageAge <= 0 {
+		return 0, nil
+	}
+
+	ts, err := time.Parse(time.RFC3339Nano, m.Timestamp)
+	if err != nil {
+		return 0, errors.Wrap(err, "invalid sns message timestamp")
+	}
+
+	age := time.Since(ts)
+	if age > sv.maxMessageAge {
+		return age, errSNSMessageStale
+	}
+
+	return age, nil
+}
+
+func (sv *snsVerifier) cert(certURL string) (*x509.Certificate, error) {
+	now := time.Now()
+
+	sv.certsMutex.Lock()
+	cached, ok := sv.certs[certURL]
+	sv.certsMutex.Unlock()
+
+	if ok && now.Before(cached.expires) {
+		return cached.cert, nil
+	}
+
+	cert, err := sv.fetcher.FetchCert(certURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return nil, fmt.Errorf("signing cert is not valid at %s", now.Format(time.RFC3339))
+	}
+
+	expires := now.Add(sv.certCacheTTL)
+	if cert.NotAfter.Before(expires) {
+		expires = cert.NotAfter
+	}
+
+	sv.certsMutex.Lock()
+	sv.certs[certURL] = &snsCachedCert{cert: cert, expires: expires}
+	sv.certsMutex.Unlock()
+
+	return cert, nil
+}
+
+// validateSNSCertURL ensures that the signing cert is served over https from
+// an SNS host, and from the same region as the topic when that is known.
+func validateSNSCertURL(certURL, topicARN string) error {
+	u, err := url.Parse(certURL)
+	if err != nil {
+		return errors.Wrap(err, "invalid signing cert url")
+	}
+
+	if u.Scheme != "https" {
+		return errSNSCertURLScheme
+	}
+
+	match := snsCertHostRegexp.FindStringSubmatch(u.Hostname())
+	if match == nil {
+		return errSNSCertURLHost
+	}
+
+	if !strings.HasSuffix(u.Path, ".pem") {
+		return errSNSCertURLPath
+	}
+
+	arnParts := strings.Split(topicARN, ":")
+	if len(arnParts) > 3 && arnParts[3] != "" && arnParts[3] != match[1] {
+		return fmt.Errorf("signing cert region %q does not match topic region %q",
+			match[1], arnParts[3])
+	}
+
+	return nil
+}
@@ -0,0 +1,175 @@
+package cyclist
+
+import (
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testSNSCertURL = "https://sns.nz-isengard-1.amazonaws.com/SimpleNotificationService-f00.pem"
+)
+
+type testSNSCertFetcher struct {
+	cert    *x509.Certificate
+	fetched int
+}
+
+func (tscf *testSNSCertFetcher) FetchCert(certURL string) (*x509.Certificate, error) {
+	tscf.fetched++
+	if tscf.cert == nil {
+		return nil, errors.New("no cert for you")
+	}
+	return tscf.cert, nil
+}
+
+func TestValidateSNSCertURL(t *testing.T) {
+	for _, tc := range []struct {
+		u     string
+		arn   string
+		valid bool
+	}{
+		{u: testSNSCertURL, arn: "arn:aws:sns:nz-isengard-1:999999999999:toaster-pastries", valid: true},
+		{u: testSNSCertURL, arn: "", valid: true},
+		{u: "https://sns.cn-north-1.amazonaws.com.cn/SimpleNotificationService-f00.pem", arn: "", valid: true},
+		{u: testSNSCertURL, arn: "arn:aws:sns:nz-mordor-1:999999999999:toaster-pastries", valid: false},
+		{u: "http://sns.nz-isengard-1.amazonaws.com/SimpleNotificationService-f00.pem", valid: false},
+		{u: "https://sns.nz-isengard-1.amazonaws.com.evil.example.org/SimpleNotificationService-f00.pem", valid: false},
+		{u: "https://evil.example.org/sns.nz-isengard-1.amazonaws.com/f00.pem", valid: false},
+		{u: "https://sns.nz-isengard-1.amazonaws.com/SimpleNotificationService-f00.txt", valid: false},
+		{u: "https://%zz", valid: false},
+	} {
+		err := validateSNSCertURL(tc.u, tc.arn)
+		if tc.valid {
+			assert.Nil(t, err, "url=%q arn=%q", tc.u, tc.arn)
+		} else {
+			assert.NotNil(t, err, "url=%q arn=%q", tc.u, tc.arn)
+		}
+	}
+}
+
+func TestSNSVerifier_verify(t *testing.T) {
+	tss := newTestSNSSigner(t)
+	fetcher := &testSNSCertFetcher{cert: tss.cert}
+	sv := newSNSVerifier(fetcher, time.Hour, 1, 0)
+
+	m := &snsMessage{
+		Type:             "Notification",
+		Message:          `{"Event": "autoscaling:TEST_NOTIFICATION"}`,
+		MessageID:        "c0ffee",
+		Timestamp:        "2018-01-09T19:40:50.123Z",
+		TopicARN:         "arn:aws:sns:nz-isengard-1:999999999999:toaster-pastries",
+		SignatureVersion: "2",
+		SigningCertURL:   testSNSCertURL,
+	}
+	tss.sign(t, m)
+
+	assert.Nil(t, sv.verify(m))
+	assert.Nil(t, sv.verify(m))
+	assert.Equal(t, 1, fetcher.fetched)
+
+	m.SigningCertURL = "https://evil.example.org/SimpleNotificationService-f00.pem"
+	assert.Equal(t, errSNSCertURLHost, sv.verify(m))
+	assert.Equal(t, 1, fetcher.fetched)
+}
+
+func TestSNSVerifier_checkAge(t *testing.T) {
+	sv := newSNSVerifier(&testSNSCertFetcher{}, time.Hour, 1, 10*time.Minute)
+
+	_, err := sv.checkAge(&snsMessage{Timestamp: time.Now().Add(-time.Minute).UTC().Format(time.RFC3339Nano)})
+	assert.Nil(t, err)
+
+	age, err := sv.checkAge(&snsMessage{Timestamp: time.Now().Add(-time.Hour).UTC().Format(time.RFC3339Nano)})
+	assert.Equal(t, errSNSMessageStale, err)
+	assert.True(t, age > 10*time.Minute)
+
+	_, err = sv.checkAge(&snsMessage{Timestamp: "last tuesday"})
+	assert.NotNil(t, err)
+
+	sv.maxMessageAge = 0
+	_, err = sv.checkAge(&snsMessage{Timestamp: "2018-01-09T19:40:50.123Z"})
+	assert.Nil(t, err)
+}
+
+func TestSNSVerifier_cert_Expiry(t *testing.T) {
+	tss := newTestSNSSigner(t)
+	fetcher := &testSNSCertFetcher{cert: tss.cert}
+	sv := newSNSVerifier(fetcher, time.Hour, 1, 0)
+
+	_, err := sv.cert(testSNSCertURL)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, fetcher.fetched)
+
+	sv.certs[testSNSCertURL].expires = time.Now().Add(-time.Second)
+
+	_, err = sv.cert(testSNSCertURL)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, fetcher.fetched)
+	assert.True(t, sv.certs[testSNSCertURL].expires.After(time.Now()))
+}
+
+func TestSNSVerifier_cert_FetchError(t *testing.T) {
+	sv := newSNSVerifier(&testSNSCertFetcher{}, time.Hour, 1, 0)
+
+	cert, err := sv.cert(testSNSCertURL)
+	assert.Nil(t, cert)
+	assert.NotNil(t, err)
+	assert.Len(t, sv.certs, 0)
+}
+
+func TestHTTPSNSCertFetcher_FetchCert(t *testing.T) {
+	tss := newTestSNSSigner(t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/SimpleNotificationService-f00.pem" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(tss.certPEM)
+	}))
+	defer ts.Close()
+
+	fetcher, err := newHTTPSNSCertFetcher("")
+	assert.Nil(t, err)
+
+	cert, err := fetcher.FetchCert(ts.URL + "/SimpleNotificationService-f00.pem")
+	assert.Nil(t, err)
+	assert.Equal(t, tss.cert.Raw, cert.Raw)
+
+	cert, err = fetcher.FetchCert(ts.URL + "/nope.pem")
+	assert.Nil(t, cert)
+	assert.NotNil(t, err)
+}
+
+func TestNewHTTPSNSCertFetcher_WithInvalidCABundle(t *testing.T) {
+	_, err := newHTTPSNSCertFetcher("/this/does/not/exist.pem")
+	assert.NotNil(t, err)
+}
+
+func TestDirSNSCertFetcher_FetchCert(t *testing.T) {
+	tss := newTestSNSSigner(t)
+
+	dir, err := ioutil.TempDir("", "cyclist-sns-certs")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "SimpleNotificationService-f00.pem"), tss.certPEM, 0644)
+	assert.Nil(t, err)
+
+	fetcher := &dirSNSCertFetcher{dir: dir}
+
+	cert, err := fetcher.FetchCert(testSNSCertURL)
+	assert.Nil(t, err)
+	assert.Equal(t, tss.cert.Raw, cert.Raw)
+
+	cert, err = fetcher.FetchCert("https://sns.nz-isengard-1.amazonaws.com/SimpleNotificationService-b4r.pem")
+	assert.Nil(t, cert)
+	assert.NotNil(t, err)
+}
@@ -5,10 +5,9 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
-	"encoding/pem"
-	"io/ioutil"
-	"net/http"
+	"fmt"
 	"reflect"
+	"strconv"
 
 	"github.com/pkg/errors"
 )
@@ -23,6 +22,11 @@ var (
 	}
 
 	errEmptyPEM = errors.New("nothing found in pem encoded bytes")
+
+	snsSigAlgorithms = map[int]x509.SignatureAlgorithm{
+		1: x509.SHA1WithRSA,
+		2: x509.SHA256WithRSA,
+	}
 )
 
 func init() {
@@ -43,18 +47,21 @@ func init() {
 		"TopicARN",
 		"Type",
 	}
+	snsSigKeys["UnsubscribeConfirmation"] = snsSigKeys["SubscriptionConfirmation"]
 }
 
 type snsMessage struct {
-	Message        string
-	MessageID      string `json:"MessageId"`
-	Token          string
-	TopicARN       string `json:"TopicArn"`
-	Type           string
-	Subject        string
-	Timestamp      string
-	Signature      string
-	SigningCertURL string
+	Message          string
+	MessageID        string `json:"MessageId"`
+	Token            string
+	SubscribeURL     string
+	TopicARN         string `json:"TopicArn"`
+	Type             string
+	Subject          string
+	Timestamp        string
+	SignatureVersion string
+	Signature        string
+	SigningCertURL   string
 }
 
 func (m *snsMessage) lifecycleAction() (*lifecycleAction, error) {
@@ -87,34 +94,36 @@ func (m *snsMessage) sigSerialized() []byte {
 	return buf.Bytes()
 }
 
-func (m *snsMessage) verify() error {
-	msgSig, err := base64.StdEncoding.DecodeString(m.Signature)
-	if err != nil {
-		return errors.Wrap(err, "failed to base64 decode signature")
+// sigVersion returns the signature version of the message, which defaults to
+// 1 for messages that don't specify one.
+func (m *snsMessage) sigVersion() (int, error) {
+	if m.SignatureVersion == "" {
+		return 1, nil
 	}
+	return strconv.Atoi(m.SignatureVersion)
+}
 
-	res, err := http.Get(m.SigningCertURL)
+func (m *snsMessage) verify(cert *x509.Certificate, minSigVersion int) error {
+	sigVersion, err := m.sigVersion()
 	if err != nil {
-		return errors.Wrap(err, "failed to fetch signing cert")
+		return errors.Wrap(err, "invalid signature version")
 	}
-	defer res.Body.Close()
 
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return errors.Wrap(err, "failed to read signing cert body")
+	sigAlgo, ok := snsSigAlgorithms[sigVersion]
+	if !ok {
+		return fmt.Errorf("unsupported signature version %d", sigVersion)
 	}
 
-	p, _ := pem.Decode(body)
-	if p == nil {
-		return errEmptyPEM
+	if sigVersion < minSigVersion {
+		return fmt.Errorf("signature version %d is below minimum %d", sigVersion, minSigVersion)
 	}
 
-	cert, err := x509.ParseCertificate(p.Bytes)
+	msgSig, err := base64.StdEncoding.DecodeString(m.Signature)
 	if err != nil {
-		return errors.Wrap(err, "failed to parse signing cert")
+		return errors.Wrap(err, "failed to base64 decode signature")
 	}
 
-	err = cert.CheckSignature(x509.SHA1WithRSA, m.sigSerialized(), msgSig)
+	err = cert.CheckSignature(sigAlgo, m.sigSerialized(), msgSig)
 	if err != nil {
 		return errors.Wrap(err, "message signature check error")
 	}
@@ -1,7 +1,16 @@
 package cyclist
 
 import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -23,3 +32,100 @@ func TestSnsMessage_lifecycleAction(t *testing.T) {
 	assert.NotNil(t, err)
 	assert.Nil(t, la)
 }
+
+type testSNSSigner struct {
+	key     *rsa.PrivateKey
+	cert    *x509.Certificate
+	certPEM []byte
+}
+
+func newTestSNSSigner(t *testing.T) *testSNSSigner {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sns.nz-isengard-1.amazonaws.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.Nil(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	return &testSNSSigner{
+		key:     key,
+		cert:    cert,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+func (tss *testSNSSigner) sign(t *testing.T, m *snsMessage) {
+	hash := crypto.SHA1
+	if m.SignatureVersion == "2" {
+		hash = crypto.SHA256
+	}
+
+	h := hash.New()
+	h.Write(m.sigSerialized())
+
+	sig, err := rsa.SignPKCS1v15(rand.Reader, tss.key, hash, h.Sum(nil))
+	assert.Nil(t, err)
+	m.Signature = base64.StdEncoding.EncodeToString(sig)
+}
+
+func TestSnsMessage_verify(t *testing.T) {
+	tss := newTestSNSSigner(t)
+
+	for _, tc := range []struct {
+		sigVersion    string
+		minSigVersion int
+		valid         bool
+	}{
+		{sigVersion: "", minSigVersion: 1, valid: true},
+		{sigVersion: "1", minSigVersion: 1, valid: true},
+		{sigVersion: "2", minSigVersion: 1, valid: true},
+		{sigVersion: "1", minSigVersion: 2, valid: false},
+		{sigVersion: "2", minSigVersion: 2, valid: true},
+		{sigVersion: "3", minSigVersion: 1, valid: false},
+		{sigVersion: "two", minSigVersion: 1, valid: false},
+	} {
+		m := &snsMessage{
+			Type:             "Notification",
+			Message:          `{"Event": "autoscaling:TEST_NOTIFICATION"}`,
+			MessageID:        "c0ffee",
+			Timestamp:        "2018-01-09T19:40:50.123Z",
+			TopicARN:         "arn:aws:sns:nz-isengard-1:999999999999:toaster-pastries",
+			SignatureVersion: tc.sigVersion,
+		}
+		tss.sign(t, m)
+
+		err := m.verify(tss.cert, tc.minSigVersion)
+		if tc.valid {
+			assert.Nil(t, err, "version=%q min=%d", tc.sigVersion, tc.minSigVersion)
+		} else {
+			assert.NotNil(t, err, "version=%q min=%d", tc.sigVersion, tc.minSigVersion)
+		}
+	}
+}
+
+func TestSnsMessage_verify_TamperedMessage(t *testing.T) {
+	tss := newTestSNSSigner(t)
+
+	m := &snsMessage{
+		Type:             "Notification",
+		Message:          `{"Event": "autoscaling:TEST_NOTIFICATION"}`,
+		MessageID:        "c0ffee",
+		Timestamp:        "2018-01-09T19:40:50.123Z",
+		TopicARN:         "arn:aws:sns:nz-isengard-1:999999999999:toaster-pastries",
+		SignatureVersion: "2",
+	}
+	tss.sign(t, m)
+	m.Message = `{"LifecycleTransition": "autoscaling:EC2_INSTANCE_TERMINATING"}`
+
+	err := m.verify(tss.cert, 1)
+	assert.NotNil(t, err)
+	assert.Regexp(t, "message signature check error.*", err.Error())
+}
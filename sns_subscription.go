@@ -0,0 +1,51 @@
+package cyclist
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+type snsSubscription struct {
+	TopicARN  string `json:"topic_arn" redis:"topic_arn"`
+	State     string `json:"state" redis:"state"`
+	UpdatedAt string `json:"updated_at" redis:"updated_at"`
+}
+
+func newSNSSubscriptionsHandlerFunc(db repo, log logrus.FieldLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log = log.WithFields(logrus.Fields{
+			"path":   r.URL.Path,
+			"method": r.Method,
+		})
+
+		subs, err := db.fetchSNSSubscriptions()
+		if err != nil {
+			log.WithField("err", err).Error("fetching sns subscriptions failed")
+			jsonRespond(w, http.StatusInternalServerError, &jsonErr{
+				Err: errors.Wrap(err, "fetching sns subscriptions failed"),
+			})
+			return
+		}
+
+		confirmed := 0
+		for _, sub := range subs {
+			if sub.State == "confirmed" {
+				confirmed++
+			}
+		}
+
+		jsonRespond(w, http.StatusOK, &jsonSNSSubscriptions{
+			Subscriptions: subs,
+			Confirmed:     confirmed,
+			Total:         len(subs),
+		})
+	}
+}
+
+type jsonSNSSubscriptions struct {
+	Subscriptions []*snsSubscription `json:"subscriptions"`
+	Confirmed     int                `json:"@confirmed"`
+	Total         int                `json:"@total"`
+}
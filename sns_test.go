@@ -2,11 +2,14 @@ package cyclist
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -19,19 +22,36 @@ func TestHandleSNSConfirmation(t *testing.T) {
 		called++
 	})
 
+	db := newTestRepo()
+
 	msg := &snsMessage{Token: "fafafaf", TopicARN: "faf/af/af"}
-	status, err := handleSNSSubscriptionConfirmation(snsSvc, msg)
+	status, err := handleSNSSubscriptionConfirmation(db, shushLog, snsSvc, msg)
 	assert.Equal(t, http.StatusOK, status)
 	assert.Nil(t, err)
 
 	msg = &snsMessage{Token: "fafafaf2", TopicARN: "faf/af/af2"}
-	status, err = handleSNSSubscriptionConfirmation(snsSvc, msg)
+	status, err = handleSNSSubscriptionConfirmation(db, shushLog, snsSvc, msg)
 	assert.Equal(t, http.StatusInternalServerError, status)
 	assert.NotNil(t, err)
+
+	assert.Len(t, db.sub, 1)
+	assert.Equal(t, "confirmed", db.sub["faf/af/af"].State)
+}
+
+func TestHandleSNSUnsubscribeConfirmation(t *testing.T) {
+	db := newTestRepo()
+	_ = db.storeSNSSubscriptionState("faf/af/af", "confirmed")
+
+	msg := &snsMessage{Token: "fafafaf", TopicARN: "faf/af/af"}
+	status, err := handleSNSUnsubscribeConfirmation(db, shushLog, msg)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Nil(t, err)
+
+	assert.Equal(t, "unsubscribed", db.sub["faf/af/af"].State)
 }
 
 func TestHandleSNSNotification_EmptyMessage(t *testing.T) {
-	status, err := handleSNSNotification(newTestRepo(), shushLog, newTestTokenGenerator(), &snsMessage{}, newTestAutoScalingService(nil))
+	status, err := handleSNSNotification(newTestRepo(), shushLog, newTestTokenGenerator(), nil, &snsMessage{}, newTestAutoScalingService(nil))
 	assert.Equal(t, http.StatusBadRequest, status)
 	assert.Regexp(t, "invalid json.+", err.Error())
 }
@@ -40,7 +60,7 @@ func TestHandleSNSNotification_TestNotification(t *testing.T) {
 	msg := &snsMessage{
 		Message: `{"Event": "autoscaling:TEST_NOTIFICATION"}`,
 	}
-	status, err := handleSNSNotification(newTestRepo(), shushLog, newTestTokenGenerator(), msg, newTestAutoScalingService(nil))
+	status, err := handleSNSNotification(newTestRepo(), shushLog, newTestTokenGenerator(), nil, msg, newTestAutoScalingService(nil))
 	assert.Equal(t, http.StatusAccepted, status)
 	assert.Nil(t, err)
 }
@@ -49,7 +69,7 @@ func TestHandleSNSNotification_InstanceLaunching_InvalidPayload(t *testing.T) {
 	msg := &snsMessage{
 		Message: `{"LifecycleTransition": "autoscaling:EC2_INSTANCE_LAUNCHING"}`,
 	}
-	status, err := handleSNSNotification(newTestRepo(), shushLog, newTestTokenGenerator(), msg, newTestAutoScalingService(nil))
+	status, err := handleSNSNotification(newTestRepo(), shushLog, newTestTokenGenerator(), nil, msg, newTestAutoScalingService(nil))
 	assert.NotNil(t, err)
 	assert.Equal(t, http.StatusBadRequest, status)
 	assert.Regexp(t, "missing required fields in lifecycle action.+", err.Error())
@@ -65,7 +85,7 @@ func TestHandleSNSNotification_InstanceLaunching(t *testing.T) {
 			"LifecycleHookName": "huzzah-9001"
 		}`, ""), ""),
 	}
-	status, err := handleSNSNotification(newTestRepo(), shushLog, newTestTokenGenerator(), msg, newTestAutoScalingService(nil))
+	status, err := handleSNSNotification(newTestRepo(), shushLog, newTestTokenGenerator(), nil, msg, newTestAutoScalingService(nil))
 	assert.Equal(t, http.StatusOK, status)
 	assert.Nil(t, err)
 }
@@ -80,7 +100,279 @@ func TestHandleSNSNotification_InstanceTerminating(t *testing.T) {
 			"LifecycleHookName": "huzzah-9001"
 		}`, ""), ""),
 	}
-	status, err := handleSNSNotification(newTestRepo(), shushLog, newTestTokenGenerator(), msg, newTestAutoScalingService(nil))
+	status, err := handleSNSNotification(newTestRepo(), shushLog, newTestTokenGenerator(), nil, msg, newTestAutoScalingService(nil))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Nil(t, err)
+}
+
+func TestHandleSNSNotification_InstanceTerminatingAfterImplosion(t *testing.T) {
+	db := newTestRepo()
+	_, err := handleImplosion(db, shushLog, newTestAutoScalingService(nil), "i-fafafaf", "terminate")
+	assert.Nil(t, err)
+
+	results := []string{}
+	asSvc := newTestAutoScalingService(func(r *request.Request) {
+		if v, ok := r.Params.(*autoscaling.CompleteLifecycleActionInput); ok {
+			results = append(results, *v.LifecycleActionResult)
+		}
+	})
+
+	msg := &snsMessage{
+		Message: `{
+			"LifecycleTransition": "autoscaling:EC2_INSTANCE_TERMINATING",
+			"EC2InstanceId": "i-fafafaf",
+			"LifecycleActionToken": "TOKEYTOKETOK",
+			"AutoScalingGroupName": "cat-theatre-napkin-hose",
+			"LifecycleHookName": "huzzah-9001"
+		}`,
+	}
+	status, err := handleSNSNotification(db, shushLog, newTestTokenGenerator(), nil, msg, asSvc)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"CONTINUE"}, results)
+	assert.NotNil(t, db.e["i-fafafaf"]["terminating"])
+
+	las, err := db.fetchInstanceLifecycleActions("terminating", "i-fafafaf")
+	assert.Nil(t, err)
+	assert.Len(t, las, 0)
+}
+
+func TestHandleSNSNotification_Replayed(t *testing.T) {
+	db := newTestRepo()
+	msg := &snsMessage{
+		MessageID: "c0ffee",
+		Message: strings.Join(strings.Split(`{
+			"LifecycleTransition": "autoscaling:EC2_INSTANCE_TERMINATING",
+			"EC2InstanceId": "i-fafafaf",
+			"LifecycleActionToken": "TOKEYTOKETOK",
+			"AutoScalingGroupName": "cat-theatre-napkin-hose",
+			"LifecycleHookName": "huzzah-9001"
+		}`, ""), ""),
+	}
+
+	replays := messageReplays.Value()
+
+	status, err := handleSNSNotification(db, shushLog, newTestTokenGenerator(), nil, msg, newTestAutoScalingService(nil))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Nil(t, err)
+	assert.Len(t, db.e["i-fafafaf"], 1)
+
+	delete(db.e, "i-fafafaf")
+
+	status, err = handleSNSNotification(db, shushLog, newTestTokenGenerator(), nil, msg, newTestAutoScalingService(nil))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Nil(t, err)
+	assert.Len(t, db.e["i-fafafaf"], 0)
+	assert.Equal(t, replays+1, messageReplays.Value())
+}
+
+func TestHandleSNSNotification_StillHandling(t *testing.T) {
+	db := newTestRepo()
+	db.m["c0ffee"] = messageStateHandling
+	msg := &snsMessage{
+		MessageID: "c0ffee",
+		Message: strings.Join(strings.Split(`{
+			"LifecycleTransition": "autoscaling:EC2_INSTANCE_TERMINATING",
+			"EC2InstanceId": "i-fafafaf",
+			"LifecycleActionToken": "TOKEYTOKETOK",
+			"AutoScalingGroupName": "cat-theatre-napkin-hose",
+			"LifecycleHookName": "huzzah-9001"
+		}`, ""), ""),
+	}
+
+	status, err := handleSNSNotification(db, shushLog, newTestTokenGenerator(), nil, msg, newTestAutoScalingService(nil))
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.NotNil(t, err)
+	assert.Len(t, db.e["i-fafafaf"], 0)
+	assert.Equal(t, messageStateHandling, db.m["c0ffee"])
+
+	delete(db.m, "c0ffee")
+
+	status, err = handleSNSNotification(db, shushLog, newTestTokenGenerator(), nil, msg, newTestAutoScalingService(nil))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Nil(t, err)
+	assert.Len(t, db.e["i-fafafaf"], 1)
+	assert.Equal(t, messageStateHandled, db.m["c0ffee"])
+}
+
+func TestHandleSNSNotification_FailedIsNotRemembered(t *testing.T) {
+	db := newTestRepo()
+	msg := &snsMessage{
+		MessageID: "c0ffee",
+		Message:   `{"LifecycleTransition": "autoscaling:EC2_INSTANCE_LAUNCHING"}`,
+	}
+
+	status, err := handleSNSNotification(db, shushLog, newTestTokenGenerator(), nil, msg, newTestAutoScalingService(nil))
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.NotNil(t, err)
+	assert.Len(t, db.m, 0)
+}
+
+func TestHandleSNSNotification_LaunchingAfterTerminating(t *testing.T) {
+	db := newTestRepo()
+	db.lt["i-fafafaf"] = &instanceTransition{
+		Transition: "terminating",
+		Time:       time.Date(2018, 1, 9, 19, 45, 0, 0, time.UTC),
+	}
+	msg := &snsMessage{
+		Message: strings.Join(strings.Split(`{
+			"LifecycleTransition": "autoscaling:EC2_INSTANCE_LAUNCHING",
+			"EC2InstanceId": "i-fafafaf",
+			"LifecycleActionToken": "TOKEYTOKETOK",
+			"AutoScalingGroupName": "cat-theatre-napkin-hose",
+			"LifecycleHookName": "huzzah-9001",
+			"Time": "2018-01-09T19:40:50.123Z"
+		}`, ""), ""),
+	}
+
+	status, err := handleSNSNotification(db, shushLog, newTestTokenGenerator(), nil, msg, newTestAutoScalingService(nil))
+	assert.Equal(t, http.StatusAccepted, status)
+	assert.Nil(t, err)
+	assert.Equal(t, "", db.s["i-fafafaf"])
+	assert.NotNil(t, db.e["i-fafafaf"]["stale_launching"])
+	assert.Equal(t, "terminating", db.lt["i-fafafaf"].Transition)
+}
+
+func TestHandleSNSNotification_OlderTerminating(t *testing.T) {
+	db := newTestRepo()
+	db.lt["i-fafafaf"] = &instanceTransition{
+		Transition: "launching",
+		Time:       time.Date(2018, 1, 9, 19, 45, 0, 0, time.UTC),
+	}
+	msg := &snsMessage{
+		Message: strings.Join(strings.Split(`{
+			"LifecycleTransition": "autoscaling:EC2_INSTANCE_TERMINATING",
+			"EC2InstanceId": "i-fafafaf",
+			"LifecycleActionToken": "TOKEYTOKETOK",
+			"AutoScalingGroupName": "cat-theatre-napkin-hose",
+			"LifecycleHookName": "huzzah-9001",
+			"Time": "2018-01-09T19:40:50.123Z"
+		}`, ""), ""),
+	}
+
+	status, err := handleSNSNotification(db, shushLog, newTestTokenGenerator(), nil, msg, newTestAutoScalingService(nil))
+	assert.Equal(t, http.StatusAccepted, status)
+	assert.Nil(t, err)
+	assert.NotNil(t, db.e["i-fafafaf"]["stale_terminating"])
+}
+
+func TestHandleSNSNotification_OlderTerminatingFromAnotherHook(t *testing.T) {
+	db := newTestRepo()
+	db.lt["i-fafafaf"] = &instanceTransition{
+		Transition: "terminating",
+		Time:       time.Date(2018, 1, 9, 19, 45, 0, 0, time.UTC),
+	}
+	msg := &snsMessage{
+		Message: strings.Join(strings.Split(`{
+			"LifecycleTransition": "autoscaling:EC2_INSTANCE_TERMINATING",
+			"EC2InstanceId": "i-fafafaf",
+			"LifecycleActionToken": "TOKEYTOKETOK",
+			"AutoScalingGroupName": "cat-theatre-napkin-hose",
+			"LifecycleHookName": "huzzah-9002",
+			"Time": "2018-01-09T19:44:59.987Z"
+		}`, ""), ""),
+	}
+
+	status, err := handleSNSNotification(db, shushLog, newTestTokenGenerator(), nil, msg, newTestAutoScalingService(nil))
 	assert.Equal(t, http.StatusOK, status)
 	assert.Nil(t, err)
+	assert.Nil(t, db.e["i-fafafaf"]["stale_terminating"])
+	assert.NotNil(t, db.e["i-fafafaf"]["preterminating"])
+	assert.Len(t, db.la, 1)
+}
+
+func TestHandleSNSNotification_RecordsLastTransition(t *testing.T) {
+	db := newTestRepo()
+	msg := &snsMessage{
+		Message: strings.Join(strings.Split(`{
+			"LifecycleTransition": "autoscaling:EC2_INSTANCE_LAUNCHING",
+			"EC2InstanceId": "i-fafafaf",
+			"LifecycleActionToken": "TOKEYTOKETOK",
+			"AutoScalingGroupName": "cat-theatre-napkin-hose",
+			"LifecycleHookName": "huzzah-9001",
+			"Time": "2018-01-09T19:40:50.123Z"
+		}`, ""), ""),
+	}
+
+	status, err := handleSNSNotification(db, shushLog, newTestTokenGenerator(), nil, msg, newTestAutoScalingService(nil))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Nil(t, err)
+	assert.Equal(t, &instanceTransition{
+		Transition: "launching",
+		Time:       time.Date(2018, 1, 9, 19, 40, 50, 123000000, time.UTC),
+	}, db.lt["i-fafafaf"])
+}
+
+func TestHandleSNSNotification_InstanceLaunchingIntoWarmPool(t *testing.T) {
+	db := newTestRepo()
+	msg := &snsMessage{
+		Message: strings.Join(strings.Split(`{
+			"LifecycleTransition": "autoscaling:EC2_INSTANCE_LAUNCHING",
+			"EC2InstanceId": "i-fafafaf",
+			"LifecycleActionToken": "TOKEYTOKETOK",
+			"AutoScalingGroupName": "cat-theatre-napkin-hose",
+			"LifecycleHookName": "huzzah-9001",
+			"Origin": "EC2",
+			"Destination": "WarmPool"
+		}`, ""), ""),
+	}
+
+	status, err := handleSNSNotification(db, shushLog, newTestTokenGenerator(), nil, msg, newTestAutoScalingService(nil))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Nil(t, err)
+	assert.Equal(t, "down", db.s["i-fafafaf"])
+	assert.NotNil(t, db.e["i-fafafaf"]["prewarming"])
+	assert.Nil(t, db.e["i-fafafaf"]["prelaunching"])
+	assert.Equal(t, "WarmPool", db.la["launching:i-fafafaf:huzzah-9001"].Destination)
+}
+
+func TestHandleSNSNotification_InstanceLaunchingFromWarmPool(t *testing.T) {
+	db := newTestRepo()
+	db.lt["i-fafafaf"] = &instanceTransition{
+		Transition: "terminating",
+		Time:       time.Date(2018, 1, 9, 19, 45, 0, 0, time.UTC),
+	}
+	msg := &snsMessage{
+		Message: strings.Join(strings.Split(`{
+			"LifecycleTransition": "autoscaling:EC2_INSTANCE_LAUNCHING",
+			"EC2InstanceId": "i-fafafaf",
+			"LifecycleActionToken": "TOKEYTOKETOK",
+			"AutoScalingGroupName": "cat-theatre-napkin-hose",
+			"LifecycleHookName": "huzzah-9001",
+			"Time": "2018-01-09T20:40:50.123Z",
+			"Origin": "WarmPool",
+			"Destination": "AutoScalingGroup"
+		}`, ""), ""),
+	}
+
+	status, err := handleSNSNotification(db, shushLog, newTestTokenGenerator(), nil, msg, newTestAutoScalingService(nil))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Nil(t, err)
+	assert.Equal(t, "up", db.s["i-fafafaf"])
+	assert.NotNil(t, db.e["i-fafafaf"]["prelaunching"])
+	assert.Equal(t, "launching", db.lt["i-fafafaf"].Transition)
+}
+
+func TestHandleSNSNotification_InstanceTerminatingMultipleHooks(t *testing.T) {
+	db := newTestRepo()
+	for _, hookName := range []string{"huzzah-9001", "hooray-9002"} {
+		msg := &snsMessage{
+			Message: fmt.Sprintf(`{
+				"LifecycleTransition": "autoscaling:EC2_INSTANCE_TERMINATING",
+				"EC2InstanceId": "i-fafafaf",
+				"LifecycleActionToken": "TOKEYTOKETOK-%s",
+				"AutoScalingGroupName": "cat-theatre-napkin-hose",
+				"LifecycleHookName": %q
+			}`, hookName, hookName),
+		}
+		status, err := handleSNSNotification(db, shushLog, newTestTokenGenerator(), nil, msg, newTestAutoScalingService(nil))
+		assert.Equal(t, http.StatusOK, status)
+		assert.Nil(t, err)
+	}
+
+	las, err := db.fetchInstanceLifecycleActions("terminating", "i-fafafaf")
+	assert.Nil(t, err)
+	assert.Len(t, las, 2)
+	assert.Equal(t, "TOKEYTOKETOK-hooray-9002", las[0].LifecycleActionToken)
+	assert.Equal(t, "TOKEYTOKETOK-huzzah-9001", las[1].LifecycleActionToken)
 }
@@ -1,15 +1,42 @@
 package cyclist
 
-/* TODO: #5
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	defaultSQSVisibilityTimeout = 30 * time.Second
+	defaultSQSWaitTimeSeconds   = int64(20)
+	sqsReceiveErrorSleep        = 5 * time.Second
+)
+
 type sqsHandler struct {
-	queueURL    string
-	concurrency int
+	queueURL          string
+	concurrency       int
+	visibilityTimeout time.Duration
 
 	db     repo
 	log    logrus.FieldLogger
 	asSvc  autoscalingiface.AutoScalingAPI
 	snsSvc snsiface.SNSAPI
 	sqsSvc sqsiface.SQSAPI
+	tokGen tokenGenerator
+
+	allowlist *lifecycleAllowlist
 }
 
 func (sh *sqsHandler) Run(ctx context.Context) error {
@@ -22,31 +49,38 @@ func (sh *sqsHandler) Run(ctx context.Context) error {
 		},
 	}
 
-	resp, err := sh.sqsSvc.GetQueueAttributes(params)
+	resp, err := sh.sqsSvc.GetQueueAttributesWithContext(ctx, params)
 	if err != nil {
 		return err
 	}
 
+	if sh.visibilityTimeout < 2*time.Second {
+		sh.visibilityTimeout = defaultSQSVisibilityTimeout
+	}
+
+	if sh.concurrency < 1 {
+		sh.concurrency = 1
+	}
+
 	sh.log.WithField("queue_attrs", resp.Attributes).Debug("fetched queue attributes")
 	sh.log.WithField("concurrency", sh.concurrency).Debug("starting SQS consumers")
 
 	wg := &sync.WaitGroup{}
 
-	for i := sh.concurrency; i > -1; i-- {
+	for i := 0; i < sh.concurrency; i++ {
 		wg.Add(1)
-		sleepMs, err := rand.Int(rand.Reader, big.NewInt(5000))
-		if err != nil {
-			return err
-		}
-		time.Sleep(time.Duration(sleepMs.Int64()) * time.Millisecond)
-		go sh.runOne(wg, ctx)
+		go sh.runOne(ctx, wg, i)
 	}
 
 	wg.Wait()
 	return nil
 }
 
-func (sh *sqsHandler) runOne(wg *sync.WaitGroup, ctx context.Context) {
+func (sh *sqsHandler) runOne(ctx context.Context, wg *sync.WaitGroup, n int) {
+	defer wg.Done()
+
+	log := sh.log.WithField("consumer", n)
+
 	params := &sqs.ReceiveMessageInput{
 		QueueUrl: aws.String(sh.queueURL),
 		AttributeNames: []*string{
@@ -56,40 +90,150 @@ func (sh *sqsHandler) runOne(wg *sync.WaitGroup, ctx context.Context) {
 		MessageAttributeNames: []*string{
 			aws.String("All"),
 		},
-		VisibilityTimeout: aws.Int64(1),
-		WaitTimeSeconds:   aws.Int64(1),
+		VisibilityTimeout: aws.Int64(int64(sh.visibilityTimeout.Seconds())),
+		WaitTimeSeconds:   aws.Int64(defaultSQSWaitTimeSeconds),
 	}
 
 	for {
 		select {
 		case <-ctx.Done():
-			wg.Done()
+			log.Debug("stopping SQS consumer")
 			return
 		default:
-			sh.log.WithField("params", params).Debug("receiving")
+			log.WithField("params", params).Debug("receiving")
 		}
 
-		resp, err := sh.sqsSvc.ReceiveMessage(params)
+		resp, err := sh.sqsSvc.ReceiveMessageWithContext(ctx, params)
 		if err != nil {
-			ae := err.(awserr.Error)
-			sh.log.WithFields(logrus.Fields{
-				"errcode": ae.Code(),
-				"errmsg":  ae.Message(),
-				"err":     ae.OrigErr(),
-			}).Error("failed to receive from SQS queue")
+			if ctx.Err() != nil {
+				continue
+			}
+
+			fields := logrus.Fields{"err": err}
+			if ae, ok := err.(awserr.Error); ok {
+				fields["errcode"] = ae.Code()
+				fields["errmsg"] = ae.Message()
+			}
+			log.WithFields(fields).Error("failed to receive from SQS queue")
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(sqsReceiveErrorSleep):
+			}
 			continue
 		}
 
-		if resp.Messages != nil {
-			for _, message := range resp.Messages {
-				sh.handle(message)
-			}
+		for _, message := range resp.Messages {
+			sh.handle(ctx, log, message)
 		}
 	}
 }
 
-func (sh *sqsHandler) handle(message *sqs.Message) {
-	sh.log.WithField("msg", message).Debug("not really handling")
-	return
+func (sh *sqsHandler) handle(ctx context.Context, log logrus.FieldLogger, message *sqs.Message) {
+	log = log.WithField("message_id", aws.StringValue(message.MessageId))
+
+	stopExtending := sh.extendVisibility(ctx, log, message)
+	status, err := sh.handleBody(log, aws.StringValue(message.MessageId), aws.StringValue(message.Body))
+	stopExtending()
+
+	if err != nil && status == http.StatusForbidden {
+		log.WithField("err", err).Warn("rejected sqs message, deleting")
+	} else if err != nil {
+		log.WithFields(logrus.Fields{
+			"err":    err,
+			"status": status,
+		}).Error("failed to handle sqs message")
+		return
+	}
+
+	_, err = sh.sqsSvc.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(sh.queueURL),
+		ReceiptHandle: message.ReceiptHandle,
+	})
+	if err != nil {
+		log.WithField("err", err).Error("failed to delete sqs message")
+		return
+	}
+
+	log.WithField("status", status).Debug("handled and deleted sqs message")
+}
+
+func (sh *sqsHandler) handleBody(log logrus.FieldLogger, messageID, body string) (int, error) {
+	msg := &snsMessage{}
+	err := json.Unmarshal([]byte(body), msg)
+	if err != nil {
+		return http.StatusBadRequest, errors.Wrap(err, "invalid json received")
+	}
+
+	if msg.Type == "" {
+		return sh.handleRawBody(log, messageID, body)
+	}
+
+	err = sh.allowlist.allowTopic(msg.TopicARN)
+	if err != nil {
+		return http.StatusForbidden, err
+	}
+
+	log = log.WithField("type", msg.Type)
+
+	switch msg.Type {
+	case "SubscriptionConfirmation":
+		return handleSNSSubscriptionConfirmation(sh.db, log, sh.snsSvc, msg)
+	case "UnsubscribeConfirmation":
+		return handleSNSUnsubscribeConfirmation(sh.db, log, msg)
+	case "Notification":
+		return handleSNSNotification(sh.db, log, sh.tokGen, sh.allowlist, msg, sh.asSvc)
+	default:
+		return http.StatusBadRequest, fmt.Errorf("unknown message type '%s'", msg.Type)
+	}
+}
+
+// handleRawBody handles messages delivered by lifecycle hooks that target the
+// queue directly, which carry the bare lifecycle action without an SNS
+// envelope.
+func (sh *sqsHandler) handleRawBody(log logrus.FieldLogger, messageID, body string) (int, error) {
+	la := &lifecycleAction{}
+	err := json.Unmarshal([]byte(body), la)
+	if err != nil {
+		return http.StatusBadRequest, errors.Wrap(err, "invalid json received")
+	}
+
+	if la.LifecycleTransition == "" && la.Event == "" {
+		return http.StatusBadRequest, errors.New("message is neither an sns message nor a lifecycle action")
+	}
+
+	return handleAutoScalingLifecycleActionOnce(sh.db, log.WithField("type", "raw"),
+		sh.tokGen, sh.allowlist, messageID, la, sh.asSvc)
+}
+
+// extendVisibility keeps the message hidden from other consumers while it is
+// being handled, and returns a func that stops doing so.
+func (sh *sqsHandler) extendVisibility(ctx context.Context, log logrus.FieldLogger, message *sqs.Message) func() {
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(sh.visibilityTimeout / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				log.Debug("extending sqs message visibility")
+				_, err := sh.sqsSvc.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{
+					QueueUrl:          aws.String(sh.queueURL),
+					ReceiptHandle:     message.ReceiptHandle,
+					VisibilityTimeout: aws.Int64(int64(sh.visibilityTimeout.Seconds())),
+				})
+				if err != nil {
+					log.WithField("err", err).Warn("failed to extend sqs message visibility")
+				}
+			}
+		}
+	}()
+
+	return func() { close(done) }
 }
-*/
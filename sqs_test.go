@@ -0,0 +1,240 @@
+package cyclist
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testSQSLaunchingBody = `{
+		"Type": "Notification",
+		"MessageId": "c0ffee",
+		"Message": "{\"LifecycleTransition\":\"autoscaling:EC2_INSTANCE_LAUNCHING\",\"EC2InstanceId\":\"i-fafafaf\",\"LifecycleActionToken\":\"TOKEYTOKETOK\",\"AutoScalingGroupName\":\"cat-theatre-napkin-hose\",\"LifecycleHookName\":\"huzzah-9001\"}"
+	}`
+)
+
+func newTestSQSHandler(f func(*request.Request)) *sqsHandler {
+	return &sqsHandler{
+		queueURL:          "https://queue.example.org/serious-things",
+		concurrency:       1,
+		visibilityTimeout: 2 * time.Second,
+
+		db:     newTestRepo(),
+		log:    shushLog,
+		asSvc:  newTestAutoScalingService(nil),
+		snsSvc: newTestSNSService(nil),
+		sqsSvc: newTestSQSService(f),
+		tokGen: newTestTokenGenerator(),
+	}
+}
+
+func TestSQSHandler_handle(t *testing.T) {
+	deleted := []string{}
+	sh := newTestSQSHandler(func(r *request.Request) {
+		if v, ok := r.Params.(*sqs.DeleteMessageInput); ok {
+			deleted = append(deleted, *v.ReceiptHandle)
+		}
+	})
+
+	sh.handle(context.Background(), shushLog, &sqs.Message{
+		MessageId:     aws.String("c0ffee"),
+		ReceiptHandle: aws.String("handle-with-care"),
+		Body:          aws.String(testSQSLaunchingBody),
+	})
+
+	assert.Equal(t, []string{"handle-with-care"}, deleted)
+
+	state, err := sh.db.fetchInstanceState("i-fafafaf")
+	assert.Nil(t, err)
+	assert.Equal(t, "up", state)
+
+	las, err := sh.db.fetchInstanceLifecycleActions("launching", "i-fafafaf")
+	assert.Nil(t, err)
+	assert.Len(t, las, 1)
+}
+
+func TestSQSHandler_handle_RawLifecycleAction(t *testing.T) {
+	deleted := 0
+	sh := newTestSQSHandler(func(r *request.Request) {
+		if _, ok := r.Params.(*sqs.DeleteMessageInput); ok {
+			deleted++
+		}
+	})
+
+	for i, body := range []string{
+		`{"Event": "autoscaling:TEST_NOTIFICATION", "AutoScalingGroupName": "cat-theatre-napkin-hose"}`,
+		`{
+			"Origin": "EC2",
+			"Destination": "AutoScalingGroup",
+			"Service": "AWS Auto Scaling",
+			"Time": "2018-01-09T19:40:50.123Z",
+			"AccountId": "999999999999",
+			"RequestId": "d00d",
+			"LifecycleTransition": "autoscaling:EC2_INSTANCE_TERMINATING",
+			"EC2InstanceId": "i-fafafaf",
+			"LifecycleActionToken": "TOKEYTOKETOK",
+			"AutoScalingGroupName": "cat-theatre-napkin-hose",
+			"LifecycleHookName": "huzzah-9001"
+		}`,
+	} {
+		sh.handle(context.Background(), shushLog, &sqs.Message{
+			MessageId:     aws.String(fmt.Sprintf("c0ffee-%d", i)),
+			ReceiptHandle: aws.String("handle-with-care"),
+			Body:          aws.String(body),
+		})
+	}
+
+	assert.Equal(t, 2, deleted)
+
+	state, err := sh.db.fetchInstanceState("i-fafafaf")
+	assert.Nil(t, err)
+	assert.Equal(t, "down", state)
+
+	las, err := sh.db.fetchInstanceLifecycleActions("terminating", "i-fafafaf")
+	assert.Nil(t, err)
+	assert.Len(t, las, 1)
+}
+
+func TestSQSHandler_handle_Replayed(t *testing.T) {
+	deleted := 0
+	sh := newTestSQSHandler(func(r *request.Request) {
+		if _, ok := r.Params.(*sqs.DeleteMessageInput); ok {
+			deleted++
+		}
+	})
+
+	body := `{
+		"LifecycleTransition": "autoscaling:EC2_INSTANCE_TERMINATING",
+		"EC2InstanceId": "i-fafafaf",
+		"LifecycleActionToken": "TOKEYTOKETOK",
+		"AutoScalingGroupName": "cat-theatre-napkin-hose",
+		"LifecycleHookName": "huzzah-9001"
+	}`
+
+	for i := 0; i < 2; i++ {
+		sh.handle(context.Background(), shushLog, &sqs.Message{
+			MessageId:     aws.String("c0ffee"),
+			ReceiptHandle: aws.String("handle-with-care"),
+			Body:          aws.String(body),
+		})
+		_ = sh.db.setInstanceState("i-fafafaf", "up")
+	}
+
+	assert.Equal(t, 2, deleted)
+
+	state, err := sh.db.fetchInstanceState("i-fafafaf")
+	assert.Nil(t, err)
+	assert.Equal(t, "up", state)
+}
+
+func TestSQSHandler_handle_DisallowedASG(t *testing.T) {
+	deleted := 0
+	sh := newTestSQSHandler(func(r *request.Request) {
+		if _, ok := r.Params.(*sqs.DeleteMessageInput); ok {
+			deleted++
+		}
+	})
+	sh.allowlist, _ = newLifecycleAllowlist(nil, nil, []string{"workers-*"})
+
+	sh.handle(context.Background(), shushLog, &sqs.Message{
+		MessageId:     aws.String("c0ffee"),
+		ReceiptHandle: aws.String("handle-with-care"),
+		Body:          aws.String(testSQSLaunchingBody),
+	})
+
+	assert.Equal(t, 1, deleted)
+
+	_, err := sh.db.fetchInstanceState("i-fafafaf")
+	assert.NotNil(t, err)
+}
+
+func TestSQSHandler_handle_InvalidBody(t *testing.T) {
+	deleted := 0
+	sh := newTestSQSHandler(func(r *request.Request) {
+		if _, ok := r.Params.(*sqs.DeleteMessageInput); ok {
+			deleted++
+		}
+	})
+
+	for _, body := range []string{
+		`{bogus`,
+		`{"Type": "Gossip"}`,
+		`{"Gossip": "juicy"}`,
+		`{"Type": "Notification", "Message": "{\"LifecycleTransition\":\"autoscaling:EC2_INSTANCE_LAUNCHING\"}"}`,
+	} {
+		sh.handle(context.Background(), shushLog, &sqs.Message{
+			MessageId:     aws.String("c0ffee"),
+			ReceiptHandle: aws.String("handle-with-care"),
+			Body:          aws.String(body),
+		})
+	}
+
+	assert.Equal(t, 0, deleted)
+}
+
+func TestSQSHandler_handle_ExtendsVisibility(t *testing.T) {
+	extended := make(chan string, 1)
+	sh := newTestSQSHandler(func(r *request.Request) {
+		if v, ok := r.Params.(*sqs.ChangeMessageVisibilityInput); ok {
+			select {
+			case extended <- *v.ReceiptHandle:
+			default:
+			}
+		}
+	})
+
+	stop := sh.extendVisibility(context.Background(), shushLog, &sqs.Message{
+		ReceiptHandle: aws.String("handle-with-care"),
+	})
+	defer stop()
+
+	select {
+	case rh := <-extended:
+		assert.Equal(t, "handle-with-care", rh)
+	case <-time.After(3 * time.Second):
+		assert.Fail(t, "visibility was never extended")
+	}
+}
+
+func TestSQSHandler_Run(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	received := 0
+	deleted := 0
+	sh := newTestSQSHandler(func(r *request.Request) {
+		switch r.Params.(type) {
+		case *sqs.ReceiveMessageInput:
+			received++
+			if received > 1 {
+				cancel()
+				return
+			}
+			r.Data.(*sqs.ReceiveMessageOutput).Messages = []*sqs.Message{
+				{
+					MessageId:     aws.String("c0ffee"),
+					ReceiptHandle: aws.String("handle-with-care"),
+					Body:          aws.String(strings.Replace(testSQSLaunchingBody, "i-fafafaf", "i-babadad", 1)),
+				},
+			}
+		case *sqs.DeleteMessageInput:
+			deleted++
+		}
+	})
+
+	err := sh.Run(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, deleted)
+
+	state, err := sh.db.fetchInstanceState("i-babadad")
+	assert.Nil(t, err)
+	assert.Equal(t, "up", state)
+}